@@ -2,13 +2,13 @@ package cert
 
 import (
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"time"
 )
@@ -34,13 +34,24 @@ func GetSN() (*big.Int, error) {
 	return sn, nil
 }
 
-func GetOrGenerateKeyPair(c, k, cn string, org []string, isCA bool, parent *x509.Certificate) (*tls.Certificate, error) {
+const (
+	// The longest validity the CA/Browser Forum allows for a leaf certificate
+	maxLeafValidity = 397 * 24 * time.Hour
+)
+
+// GetOrGenerateKeyPair loads the key pair in c and k, generating it first with a
+// key of type kt if k doesn't exist. If parent is nil, the certificate is
+// self-signed.
+func GetOrGenerateKeyPair(c, k, cn string, org []string, isCA bool, parent *tls.Certificate, kt KeyType) (*tls.Certificate, error) {
 	if _, err := os.Lstat(k); err != nil {
 		sn, err := GetSN()
 		if err != nil {
 			return nil, err
 		}
-		GenerateRSAKeyPair(c, k, 1024, cn, org, sn, isCA, parent)
+		err = GenerateKeyPair(c, k, kt, cn, org, sn, isCA, parent)
+		if err != nil {
+			return nil, err
+		}
 	}
 	keypair, err := tls.LoadX509KeyPair(c, k)
 	if err != nil {
@@ -49,15 +60,24 @@ func GetOrGenerateKeyPair(c, k, cn string, org []string, isCA bool, parent *x509
 	return &keypair, nil
 }
 
-func GenerateRSAKeyPair(c, k string, bits int, cn string, org []string, sn *big.Int, isCA bool, parent *x509.Certificate) error {
-	priv, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return fmt.Errorf("Failed to generate private key: %v", err)
-	}
-	now := time.Now()
+// GenerateKeyPair writes a certificate for cn, signed by parent, or self-signed if
+// parent is nil, to c, and its key, of type kt, to k.
+func GenerateKeyPair(c, k string, kt KeyType, cn string, org []string, sn *big.Int, isCA bool, parent *tls.Certificate) error {
+	_, err := generateKeyPair(c, k, kt, newTemplate(cn, org, sn, isCA, time.Now()), parent)
+	return err
+}
+
+// NewKeyPair is like GenerateKeyPair, but returns the key pair without writing it
+// to disk.
+func NewKeyPair(kt KeyType, cn string, org []string, isCA bool, parent *tls.Certificate) (*tls.Certificate, error) {
+	sn, err := GetSN()
 	if err != nil {
-		return fmt.Errorf("Couldn't get new certificate serial number: %v", err)
+		return nil, err
 	}
+	return generateKeyPair("", "", kt, newTemplate(cn, org, sn, isCA, time.Now()), parent)
+}
+
+func newTemplate(cn string, org []string, sn *big.Int, isCA bool, now time.Time) *x509.Certificate {
 	template := x509.Certificate{
 		SerialNumber: sn,
 		Subject: pkix.Name{
@@ -65,32 +85,133 @@ func GenerateRSAKeyPair(c, k string, bits int, cn string, org []string, sn *big.
 			Organization: org,
 		},
 		NotBefore:             now.Add(-2 * 24 * time.Hour).UTC(),
-		NotAfter:              now.Add(time.Hour * 24 * 365 * 10).UTC(), // valid for 10 years.
-		BasicConstraintsValid: isCA,
+		BasicConstraintsValid: true,
 		IsCA:                  isCA,
-		SubjectKeyId:          []byte{1, 2, 3, 4},
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 	}
-	if parent == nil {
-		parent = &template
+	if isCA {
+		template.NotAfter = now.Add(time.Hour * 24 * 365 * 10).UTC() // valid for 10 years.
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.NotAfter = now.Add(time.Hour * 24 * 365).UTC()
+		template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if ip := net.ParseIP(cn); ip != nil {
+			template.IPAddresses = []net.IP{ip}
+		} else {
+			template.DNSNames = []string{cn}
+		}
 	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, &priv.PublicKey, priv)
+	return &template
+}
+
+// MimicKeyPair generates a leaf certificate, signed by parent, that copies the
+// subject, subject alternative names and key usages of upstream, a certificate
+// presented by a real server. The validity window is upstream's, unless it is
+// longer than a leaf certificate may be valid for, in which case it starts a day
+// ago. If c and k are not empty, the key pair is also written to them.
+func MimicKeyPair(c, k string, kt KeyType, upstream *x509.Certificate, parent *tls.Certificate) (*tls.Certificate, error) {
+	sn, err := GetSN()
 	if err != nil {
-		return fmt.Errorf("Failed to create certificate: %s", err)
+		return nil, err
 	}
+	return generateKeyPair(c, k, kt, mimicTemplate(upstream, sn, time.Now()), parent)
+}
 
-	cOut, err := os.Create(c)
-	if err != nil {
-		return fmt.Errorf("Failed to open %s for writing: %v", c, err)
+func mimicTemplate(upstream *x509.Certificate, sn *big.Int, now time.Time) *x509.Certificate {
+	template := x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               upstream.Subject,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+		KeyUsage:              upstream.KeyUsage &^ (x509.KeyUsageCertSign | x509.KeyUsageCRLSign),
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		UnknownExtKeyUsage:    upstream.UnknownExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              upstream.DNSNames,
+		EmailAddresses:        upstream.EmailAddresses,
+		IPAddresses:           upstream.IPAddresses,
+		URIs:                  upstream.URIs,
+	}
+	template.Subject.Names = nil
+	if template.KeyUsage == 0 {
+		template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 && upstream.Subject.CommonName != "" {
+		if ip := net.ParseIP(upstream.Subject.CommonName); ip != nil {
+			template.IPAddresses = []net.IP{ip}
+		} else {
+			template.DNSNames = []string{upstream.Subject.CommonName}
+		}
 	}
-	pem.Encode(cOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	cOut.Close()
+	if template.NotAfter.Sub(template.NotBefore) > maxLeafValidity {
+		// Valid from a day ago, unless the upstream certificate had expired by
+		// then, in which case the mimic expires when it did
+		template.NotBefore = now.Add(-24 * time.Hour).UTC()
+		if template.NotBefore.After(template.NotAfter) {
+			template.NotBefore = template.NotAfter.Add(-maxLeafValidity)
+		}
+		if template.NotAfter.Sub(template.NotBefore) > maxLeafValidity {
+			template.NotAfter = template.NotBefore.Add(maxLeafValidity)
+		}
+	}
+	return &template
+}
 
-	kOut, err := os.OpenFile(k, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// generateKeyPair generates a key pair of type kt for template, signed by parent,
+// or self-signed if parent is nil, and writes it to c and k if they aren't empty.
+func generateKeyPair(c, k string, kt KeyType, template *x509.Certificate, parent *tls.Certificate) (*tls.Certificate, error) {
+	priv, err := kt.generate()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate private key: %v", err)
+	}
+	template.SubjectKeyId, err = subjectKeyId(priv.Public())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal public key: %v", err)
+	}
+	template.KeyUsage = kt.keyUsage(template.KeyUsage)
+	parentCert := template
+	var signer interface{} = priv
+	if parent != nil {
+		parentCert = parent.Leaf
+		if parentCert == nil {
+			parentCert, err = x509.ParseCertificate(parent.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse parent certificate: %s", err)
+			}
+		}
+		signer = parent.PrivateKey
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parentCert, priv.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
 	if err != nil {
-		return fmt.Errorf("Failed to open %s for writing: %v", k, err)
+		return nil, fmt.Errorf("Failed to parse generated certificate: %s", err)
 	}
-	pem.Encode(kOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-	kOut.Close()
-	return nil
+	if c != "" && k != "" {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal private key: %v", err)
+		}
+		cOut, err := os.Create(c)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open %s for writing: %v", c, err)
+		}
+		pem.Encode(cOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+		cOut.Close()
+
+		kOut, err := os.OpenFile(k, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open %s for writing: %v", k, err)
+		}
+		pem.Encode(kOut, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+		kOut.Close()
+	}
+	keypair := tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+	return &keypair, nil
 }
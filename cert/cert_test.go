@@ -1,8 +1,128 @@
 package cert
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestSomething(t *testing.T) {
 }
+
+func TestGenerateSigned(t *testing.T) {
+	sn, _ := GetSN()
+	ca, err := generateKeyPair("", "", RSA2048, &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: "ca.sniffy.local"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	upstream := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "*.example.com", Organization: []string{"Example"}},
+		NotBefore:   now.Add(-30 * 24 * time.Hour),
+		NotAfter:    now.Add(60 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{"*.example.com", "example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	kp, err := MimicKeyPair("", "", ECDSAP256, upstream, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := kp.Leaf
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for _, name := range []string{"www.example.com", "example.com", "192.0.2.1"} {
+		if _, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if leaf.Subject.String() != upstream.Subject.String() {
+		t.Errorf("Got subject %s; want %s", leaf.Subject, upstream.Subject)
+	}
+	if leaf.KeyUsage != x509.KeyUsageDigitalSignature || leaf.IsCA {
+		t.Errorf("Leaf has key usage %v (CA: %v)", leaf.KeyUsage, leaf.IsCA)
+	}
+	if !leaf.NotBefore.Equal(upstream.NotBefore.Truncate(time.Second)) || !leaf.NotAfter.Equal(upstream.NotAfter.Truncate(time.Second)) {
+		t.Errorf("Got validity %s - %s; want %s - %s", leaf.NotBefore, leaf.NotAfter, upstream.NotBefore, upstream.NotAfter)
+	}
+	if len(leaf.SubjectKeyId) != 20 || string(leaf.AuthorityKeyId) != string(ca.Leaf.SubjectKeyId) {
+		t.Errorf("Got key IDs %x/%x", leaf.SubjectKeyId, leaf.AuthorityKeyId)
+	}
+
+	// Windows longer than a leaf may be valid for are shortened
+	tmpl := mimicTemplate(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "old.example.com"},
+		NotBefore: now.Add(-3 * 365 * 24 * time.Hour),
+		NotAfter:  now.Add(2 * 365 * 24 * time.Hour),
+	}, big.NewInt(1), now)
+	if d := tmpl.NotAfter.Sub(tmpl.NotBefore); d != maxLeafValidity || tmpl.NotBefore.After(now) {
+		t.Errorf("Got validity %s - %s", tmpl.NotBefore, tmpl.NotAfter)
+	}
+	if len(tmpl.DNSNames) != 1 || tmpl.DNSNames[0] != "old.example.com" {
+		t.Errorf("Got DNS names %v for a certificate without SANs", tmpl.DNSNames)
+	}
+	// ...and still end when the upstream certificate did if it has expired
+	expired := now.Add(-30 * 24 * time.Hour)
+	tmpl = mimicTemplate(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "expired.example.com"},
+		NotBefore: expired.Add(-3 * 365 * 24 * time.Hour),
+		NotAfter:  expired,
+	}, big.NewInt(1), now)
+	if d := tmpl.NotAfter.Sub(tmpl.NotBefore); d != maxLeafValidity || !tmpl.NotAfter.Equal(expired) {
+		t.Errorf("Got validity %s - %s for a certificate that expired %s", tmpl.NotBefore, tmpl.NotAfter, expired)
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := GetOrGenerateKeyPair(path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), "ca.sniffy.local", []string{"Sniffy"}, true, nil, ECDSAP384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kt := range KeyTypes {
+		c, k := path.Join(dir, string(kt)+"_cert.pem"), path.Join(dir, string(kt)+"_key.pem")
+		kp, err := GetOrGenerateKeyPair(c, k, "example.com", []string{"Sniffy"}, false, ca, kt)
+		if err != nil {
+			t.Fatalf("%s: %s", kt, err)
+		}
+		leaf, err := x509.ParseCertificate(kp.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+			t.Errorf("%s: %s", kt, err)
+		}
+		if kt == RSA3072 && leaf.PublicKey.(*rsa.PublicKey).N.BitLen() != 3072 {
+			t.Errorf("Got a %d-bit RSA key", leaf.PublicKey.(*rsa.PublicKey).N.BitLen())
+		}
+		if kt == Ed25519 && leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+			t.Error("Ed25519 certificate allows key encipherment")
+		}
+	}
+	if _, err = ParseKeyType("rsa1024"); err == nil {
+		t.Error("Parsed key type rsa1024")
+	}
+	if kt, _ := ParseKeyType("ECDSA-P384"); kt != ECDSAP384 {
+		t.Errorf("Parsed ECDSA-P384 as %q", kt)
+	}
+}
@@ -0,0 +1,92 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// A KeyType is the algorithm, and size, of the keys of generated certificates.
+type KeyType string
+
+const (
+	RSA2048   KeyType = "rsa2048"
+	RSA3072   KeyType = "rsa3072"
+	RSA4096   KeyType = "rsa4096"
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	Ed25519   KeyType = "ed25519"
+
+	DefaultKeyType = ECDSAP256
+)
+
+var KeyTypes = []KeyType{RSA2048, RSA3072, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+// ParseKeyType returns the KeyType named s, or DefaultKeyType if s is empty.
+func ParseKeyType(s string) (KeyType, error) {
+	if s == "" {
+		return DefaultKeyType, nil
+	}
+	kt := KeyType(strings.ToLower(s))
+	for _, v := range KeyTypes {
+		if kt == v {
+			return kt, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown key type %q", s)
+}
+
+func (kt KeyType) generate() (crypto.Signer, error) {
+	switch kt {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("Unknown key type %q", string(kt))
+}
+
+// keyUsage returns the usages a leaf certificate for a key of this type may have:
+// only RSA keys can be used for key encipherment.
+func (kt KeyType) keyUsage(ku x509.KeyUsage) x509.KeyUsage {
+	if !strings.HasPrefix(string(kt), "rsa") {
+		ku &^= x509.KeyUsageKeyEncipherment
+	}
+	return ku
+}
+
+// subjectKeyId returns the SHA-1 hash of the subjectPublicKey of pub (RFC 5280,
+// 4.2.1.2, method 1).
+func subjectKeyId(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err = asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultStickyCookie = "SNIFFYLB"
+)
+
+// stickyId returns the opaque value stored in the sticky session cookie for the
+// backend addr, so that backend addresses aren't revealed to clients.
+func stickyId(addr string) string {
+	return fmt.Sprintf("%016x", hash64(addr))
+}
+
+func (lb *LoadBalancerHandler) stickyCookieName() string {
+	if lb.StickyCookie != "" {
+		return lb.StickyCookie
+	}
+	return DefaultStickyCookie
+}
+
+// stickyBackend returns the backend in ds named by the sticky session cookie sent
+// with req, or an empty string if there is none.
+func (lb *LoadBalancerHandler) stickyBackend(req *http.Request, ds []string) string {
+	c, err := req.Cookie(lb.stickyCookieName())
+	if err != nil {
+		return ""
+	}
+	for _, v := range ds {
+		if stickyId(v) == c.Value {
+			return v
+		}
+	}
+	return ""
+}
+
+// setStickyCookie makes the client stick to dest, unless it already does.
+func (lb *LoadBalancerHandler) setStickyCookie(s *ProxySession, dest string) {
+	id := stickyId(dest)
+	name := lb.stickyCookieName()
+	if c, err := s.Request.Cookie(name); err == nil && c.Value == id {
+		return
+	}
+	c := &http.Cookie{
+		Name:     name,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.Request.TLS != nil,
+	}
+	s.Response.Header.Add("Set-Cookie", c.String())
+}
+
+// rendezvous picks a backend from ds for key using weighted rendezvous (highest
+// random weight) hashing. Every key maps to the same backend as long as it is
+// available, and when a backend is added or removed only the keys that move to
+// or from it are remapped. lb.mu must be held.
+func (lb *LoadBalancerHandler) rendezvous(key string, ds []string, now time.Time) string {
+	var (
+		best  string
+		score = math.Inf(-1)
+	)
+	for _, v := range ds {
+		h := hash64(key + "\x00" + v)
+		// Map the hash to (0, 1), then to a score that is proportional to
+		// the backend's weight across keys
+		u := (float64(h>>11) + 0.5) / (1 << 53)
+		sc := float64(lb.effectiveWeight(lb.getBackend(v), now)) / -math.Log(u)
+		if sc > score {
+			best, score = v, sc
+		}
+	}
+	return best
+}
+
+func clientIP(req *http.Request) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// hash64 returns the FNV-1a hash of s, finalized so that similar strings produce
+// very different hashes.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"github.com/pmylund/sniffy/cert"
+
+	"crypto/tls"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// A CertificateStore returns the certificate a TLS-terminating ProxyServer should
+// present for the server name (SNI) sent by a client.
+type CertificateStore interface {
+	GetCertificate(serverName string) (*tls.Certificate, error)
+}
+
+// FileCertStore serves certificates loaded from PEM files. Hosts may be exact
+// names or wildcards like "*.example.com", which match a single label.
+type FileCertStore struct {
+	certs map[string]*tls.Certificate
+	mu    *sync.RWMutex
+}
+
+func (fs *FileCertStore) Add(host, certFile, keyFile string) error {
+	keypair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't load key pair for %s: %s", host, err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.certs[strings.ToLower(host)] = &keypair
+	return nil
+}
+
+func (fs *FileCertStore) Remove(host string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.certs, strings.ToLower(host))
+}
+
+func (fs *FileCertStore) GetCertificate(serverName string) (*tls.Certificate, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, v := range CertificateNames(serverName) {
+		if c, found := fs.certs[v]; found {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("No certificate for %s", serverName)
+}
+
+func NewFileCertStore() *FileCertStore {
+	fs := FileCertStore{
+		certs: map[string]*tls.Certificate{},
+		mu:    &sync.RWMutex{},
+	}
+	return &fs
+}
+
+// GeneratedCertStore generates (and caches) a certificate for every server name it
+// is asked for using the cert package, storing the key pairs in Folder. If Parent
+// is nil, the certificates are self-signed.
+type GeneratedCertStore struct {
+	Folder       string
+	Organization []string
+	Parent       *tls.Certificate
+	KeyType      cert.KeyType
+	cache        map[string]*tls.Certificate
+	mu           *sync.Mutex
+}
+
+func (gs *GeneratedCertStore) GetCertificate(serverName string) (*tls.Certificate, error) {
+	name := strings.ToLower(serverName)
+	if !ValidServerName(name) {
+		return nil, fmt.Errorf("Invalid server name %q", serverName)
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if c, found := gs.cache[name]; found {
+		return c, nil
+	}
+	c, err := cert.GetOrGenerateKeyPair(path.Join(gs.Folder, name+"_cert.pem"), path.Join(gs.Folder, name+"_key.pem"), name, gs.Organization, false, gs.Parent, gs.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	gs.cache[name] = c
+	return c, nil
+}
+
+func NewGeneratedCertStore(folder string, parent *tls.Certificate) *GeneratedCertStore {
+	gs := GeneratedCertStore{
+		Folder:       folder,
+		Organization: []string{"Sniffy"},
+		Parent:       parent,
+		KeyType:      cert.DefaultKeyType,
+		cache:        map[string]*tls.Certificate{},
+		mu:           &sync.Mutex{},
+	}
+	return &gs
+}
+
+// CertificateNames returns the names a certificate for serverName may be stored
+// under, most specific first, e.g. "a.example.com" and "*.example.com".
+func CertificateNames(serverName string) []string {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	names := []string{name}
+	if i := strings.Index(name, "."); i > 0 {
+		names = append(names, "*"+name[i:])
+	}
+	return names
+}
+
+// ValidServerName reports whether name looks like a hostname, and is therefore
+// safe to use in file names.
+func ValidServerName(name string) bool {
+	if name == "" || len(name) > 253 || strings.HasPrefix(name, ".") || strings.Contains(name, "..") {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '*':
+		default:
+			return false
+		}
+	}
+	return true
+}
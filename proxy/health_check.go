@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HealthCheck describes the HTTP probe a LoadBalancerHandler periodically sends to
+// each of its backends. A backend is taken out of rotation after Fall consecutive
+// failed probes, and put back after Rise consecutive successful ones.
+type HealthCheck struct {
+	Path           string        // e.g. "/health". Empty only checks that a TCP connection can be made
+	Host           string        // Host header to send. Defaults to the backend address
+	Interval       time.Duration // Time between probes
+	Timeout        time.Duration // Time before a probe is considered failed
+	ExpectedStatus int           // Status code that means healthy. 0 means any 2xx or 3xx
+	Rise           int
+	Fall           int
+}
+
+func NewHealthCheck(path string, interval time.Duration) *HealthCheck {
+	hc := HealthCheck{
+		Path:     path,
+		Interval: interval,
+		Timeout:  interval / 2,
+		Rise:     2,
+		Fall:     3,
+	}
+	return &hc
+}
+
+func (hc *HealthCheck) client(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             nil,
+			DisableKeepAlives: true,
+			TLSClientConfig:   tlsConfig,
+		},
+		Timeout: hc.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probe sends one health check request to the backend at u and returns an error
+// describing why the backend is unhealthy, if it is.
+func (hc *HealthCheck) probe(c *http.Client, u *url.URL) error {
+	if hc.Path == "" {
+		conn, err := net.DialTimeout("tcp", u.Host, hc.Timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+joinPath(u.Path, hc.Path), nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	req.Header.Set("User-Agent", DefaultProxyAgent+" health check")
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if hc.ExpectedStatus != 0 {
+		if res.StatusCode != hc.ExpectedStatus {
+			return fmt.Errorf("Got status %d; expected %d", res.StatusCode, hc.ExpectedStatus)
+		}
+	} else if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("Got status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// StartHealthChecks starts probing every backend according to lb.HealthCheck until
+// StopHealthChecks is called.
+func (lb *LoadBalancerHandler) StartHealthChecks() {
+	if lb.HealthCheck == nil {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.checking = true
+	for _, b := range lb.backends {
+		lb.startHealthCheck(b)
+	}
+}
+
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) startHealthCheck(b *backend) {
+	if !lb.checking || b.stop != nil {
+		return
+	}
+	b.stop = make(chan bool)
+	go lb.runHealthCheck(b, lb.HealthCheck, lb.backendTLS(b.addr), b.stop)
+}
+
+func (lb *LoadBalancerHandler) StopHealthChecks() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.checking = false
+	for _, b := range lb.backends {
+		stopHealthCheck(b)
+	}
+}
+
+func stopHealthCheck(b *backend) {
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+func (lb *LoadBalancerHandler) runHealthCheck(b *backend, hc *HealthCheck, tlsConfig *tls.Config, stop chan bool) {
+	c := hc.client(tlsConfig)
+	t := time.NewTicker(hc.Interval)
+	defer t.Stop()
+	for {
+		err := hc.probe(c, b.url)
+		lb.mu.Lock()
+		lb.recordHealthCheck(b, hc, err)
+		lb.mu.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) recordHealthCheck(b *backend, hc *HealthCheck, err error) {
+	b.lastCheck = time.Now()
+	if err != nil {
+		b.lastError = err.Error()
+		b.successes = 0
+		b.failures++
+		if b.healthy && b.failures >= hc.Fall {
+			b.healthy = false
+		}
+		return
+	}
+	b.lastError = ""
+	b.failures = 0
+	b.successes++
+	if !b.healthy && b.successes >= hc.Rise {
+		b.healthy = true
+		b.start = b.lastCheck
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"github.com/pmylund/sniffy/common"
 
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -32,6 +33,9 @@ type ProxyServer struct {
 	ProxyAgent            string
 	ConnectResponseHeader []byte
 	Transport             *http.Transport
+	ReverseProxy          bool
+	ReverseRoutes         []*ReverseRoute
+	CertStore             CertificateStore // Selects certificates by SNI in ListenAndServeTLS
 	client                *http.Client
 }
 
@@ -44,8 +48,12 @@ func (ps *ProxyServer) ListenAndServe() error {
 	return err
 }
 
+// ListenAndServeTLS terminates TLS and serves the decrypted requests. If ps.CertStore
+// is set, the certificate is chosen by the server name the client asks for, and
+// certFile/keyFile, which may then be empty, are only used for clients that don't
+// send one.
 func (ps *ProxyServer) ListenAndServeTLS(certFile, keyFile string) error {
-	srv, err := ps.getServer()
+	srv, err := ps.getTLSServer()
 	if err != nil {
 		return err
 	}
@@ -53,6 +61,26 @@ func (ps *ProxyServer) ListenAndServeTLS(certFile, keyFile string) error {
 	return err
 }
 
+func (ps *ProxyServer) getTLSServer() (*http.Server, error) {
+	srv, err := ps.getServer()
+	if err != nil {
+		return nil, err
+	}
+	if ps.CertStore != nil {
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: ps.getCertificate,
+		}
+	}
+	return srv, nil
+}
+
+func (ps *ProxyServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		return nil, nil // use the default certificate, if any
+	}
+	return ps.CertStore.GetCertificate(hello.ServerName)
+}
+
 func (ps *ProxyServer) getServer() (*http.Server, error) {
 	var (
 		noEnvProxy bool
@@ -70,7 +98,7 @@ func (ps *ProxyServer) getServer() (*http.Server, error) {
 	if ps.Transport != nil {
 		ps.client.Transport = ps.Transport
 	} else if noEnvProxy {
-		ps.client.Transport = &http.Transport{Proxy: nil}
+		ps.client.Transport = &http.Transport{Proxy: nil, ForceAttemptHTTP2: true}
 	} else {
 		ps.client.Transport = http.DefaultTransport
 	}
@@ -93,9 +121,44 @@ func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		Ps:      ps,
 		W:       w,
 	}
+	if ps.ReverseProxy {
+		if req.Method == "CONNECT" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rr := ps.matchReverseRoute(req)
+		if rr == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		s.ReverseRoute = rr
+		s.publicHost = req.Host
+		s.publicScheme = "http"
+		if req.TLS != nil {
+			s.publicScheme = "https"
+		}
+		rr.rewriteRequest(req, s.publicHost, s.publicScheme)
+	}
+	// Origins behind a reverse proxy or load balancer only see it connecting
+	if _, ok := ps.Handler.(*LoadBalancerHandler); ok || ps.ReverseProxy {
+		addForwardedFor(req)
+	}
 	ps.Handler.HandleProxy(s)
 }
 
+// addForwardedFor appends the client's IP address to req's X-Forwarded-For
+// header.
+func addForwardedFor(req *http.Request) {
+	ip := clientIP(req)
+	if ip == "" {
+		return
+	}
+	if prior, found := req.Header["X-Forwarded-For"]; found {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
+
 func (ps *ProxyServer) ProxyCONNECT(w http.ResponseWriter, req *http.Request) error {
 	dest, err := net.Dial("tcp", req.URL.Host)
 	if err != nil {
@@ -118,10 +181,21 @@ func (ps *ProxyServer) ProxyCONNECT(w http.ResponseWriter, req *http.Request) er
 }
 
 type ProxySession struct {
-	Request  *http.Request
-	Response *http.Response
-	Ps       *ProxyServer
-	W        http.ResponseWriter
+	Request      *http.Request
+	Response     *http.Response
+	Ps           *ProxyServer
+	W            http.ResponseWriter
+	ReverseRoute *ReverseRoute // Set if the request was mapped to an origin in reverse proxy mode
+	// Called with each WebSocket message Do relays. Messages in one direction
+	// are passed in order, and never concurrently.
+	WebSocketHandler func(*WebSocketMessage)
+	// Called with each WebSocket message before Do relays it. It returns the
+	// message to relay: m, another message to send instead, or nil to drop m.
+	WebSocketFilter func(m *WebSocketMessage) *WebSocketMessage
+	ws              *webSocketRelay
+	publicHost      string
+	publicScheme    string
+	transport       *http.Transport // Used instead of Ps's transport if set
 }
 
 // GetResponse performs the client's request, setting s.Response, and returning an error,
@@ -157,14 +231,25 @@ func (s *ProxySession) GetResponse() error {
 		}
 		delete(s.Request.Header, "Proxy-Connection")
 	}
-	res, err := s.Ps.client.Transport.RoundTrip(s.Request)
+	var rt http.RoundTripper = s.Ps.client.Transport
+	if s.transport != nil {
+		rt = s.transport
+	}
+	res, err := rt.RoundTrip(s.Request)
+	if err == nil && s.ReverseRoute != nil {
+		s.ReverseRoute.rewriteResponse(res, s.publicHost, s.publicScheme)
+	}
+	if err == nil && res.StatusCode == http.StatusSwitchingProtocols {
+		s.ws = newWebSocketRelay()
+	}
 	s.Response = res
 	return err
 }
 
 // Do sends the response to the client, performing GetResponse() if it hasn't already been.
 // If the request type is CONNECT, Do opens a tunnel to the destination host, and returns
-// an error, if any, when the tunnel is closed.
+// an error, if any, when the tunnel is closed. If the server switched protocols, e.g. to
+// WebSocket, Do relays the upgraded connection, and returns when it is closed.
 func (s *ProxySession) Do() error {
 	if s.Request.Method == "CONNECT" {
 		return s.Ps.ProxyCONNECT(s.W, s.Request)
@@ -175,6 +260,9 @@ func (s *ProxySession) Do() error {
 			return fmt.Errorf("Could not perform GetResponse: %s", err)
 		}
 	}
+	if s.Response.StatusCode == http.StatusSwitchingProtocols {
+		return s.relayUpgrade()
+	}
 	h := s.W.Header()
 	for k, v := range s.Response.Header {
 		h[k] = v
@@ -185,6 +273,12 @@ func (s *ProxySession) Do() error {
 			delete(h, v)
 		}
 	}
+	// Connection-specific headers aren't allowed in HTTP/2
+	if s.Request.ProtoMajor == 2 {
+		for _, v := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"} {
+			delete(h, v)
+		}
+	}
 	s.W.WriteHeader(s.Response.StatusCode)
 	if s.Response.Body != nil {
 		io.Copy(s.W, s.Response.Body)
@@ -192,10 +286,6 @@ func (s *ProxySession) Do() error {
 	return nil
 }
 
-// TODO: Add
-//       1. HTTP Reverse Proxy Server
-//       2. HTTPS Reverse Proxy Server / SSL termination proxy
-
 type EnvProxyTest struct {
 	Random string
 	Loop   bool
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// How quickly old latency samples lose influence; a sample this old has about
+	// a third of the weight it had when it was taken.
+	DefaultLatencyDecay = 10 * time.Second
+)
+
+// recordLatency adds a latency sample for addr to its exponentially weighted moving
+// average. Only successful requests are sampled, so that backends that fail fast
+// don't look attractive; outlier detection deals with those.
+func (lb *LoadBalancerHandler) recordLatency(addr string, latency time.Duration) {
+	now := time.Now()
+	decay := lb.LatencyDecay
+	if decay <= 0 {
+		decay = DefaultLatencyDecay
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b, found := lb.backends[addr]
+	if !found {
+		return
+	}
+	if b.latencyAt.IsZero() {
+		b.latency = float64(latency)
+	} else {
+		// Samples that arrive further apart count for more
+		alpha := 1 - math.Exp(-float64(now.Sub(b.latencyAt))/float64(decay))
+		b.latency += alpha * (float64(latency) - b.latency)
+	}
+	b.latencyAt = now
+}
+
+// latencyCost estimates how long a new request sent to b would take, given its
+// average latency, in-flight requests and weight. lb.mu must be held.
+func (lb *LoadBalancerHandler) latencyCost(b *backend, now time.Time) float64 {
+	w := lb.effectiveWeight(b, now)
+	if w == 0 {
+		return math.Inf(1)
+	}
+	// Unsampled backends are as fast as possible, but in-flight requests still count
+	l := b.latency
+	if l < 1 {
+		l = 1
+	}
+	return l * float64(b.active+1) / float64(w)
+}
+
+// twoChoices picks two different backends in ds at random, and returns the one
+// with the lower latencyCost. lb.mu must be held.
+func (lb *LoadBalancerHandler) twoChoices(ds []string, now time.Time) string {
+	if len(ds) == 1 {
+		return ds[0]
+	}
+	i := rand.Intn(len(ds))
+	j := rand.Intn(len(ds) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := lb.getBackend(ds[i]), lb.getBackend(ds[j])
+	if lb.latencyCost(b, now) < lb.latencyCost(a, now) {
+		return b.addr
+	}
+	return a.addr
+}
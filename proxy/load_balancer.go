@@ -1,74 +1,435 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
 	StrategyFirst = iota
 	StrategyRandom
 	StrategyRoundrobin
-	StrategyFair
+	StrategyFair         // Least outstanding requests
+	StrategyStickyCookie // Round robin, then the backend named in a proxy-inserted cookie
+	StrategySourceIP     // Consistent hashing on the client's IP address
+	StrategyHash         // Consistent hashing on HashHeader, or the path if it's empty
+	StrategyLatency      // Power of two choices on average latency and in-flight requests
 )
 
+var (
+	ErrNoRoute          = errors.New("Host not found")
+	ErrNoHealthyBackend = errors.New("No healthy backends")
+)
+
+// A LoadBalancerHandler spreads the requests for each route over the route's
+// backends. Routes and Matches must not be modified directly once the handler is
+// in use; use SetRoute, AddBackend, RemoveBackend and SetMatches instead.
 type LoadBalancerHandler struct {
-	Strategy int
-	Routes   map[string][]string
-	dist     map[string]chan string
-	ps       *ProxyServer
+	Strategy         int
+	Routes           map[string][]string
+	Matches          []*RouteMatch           // Rules for choosing a route besides the Routes keys
+	TLS              map[string]*UpstreamTLS // TLS settings for https backends, per route
+	Mirrors          map[string]*Mirror      // Shadow pools to copy requests to, per route
+	Splits           map[string]*Split       // Canary groups, per route
+	HealthCheck      *HealthCheck            // If set, StartHealthChecks probes every backend
+	OutlierDetection *OutlierDetection       // If set, failing backends are ejected
+	Retry            *RetryPolicy            // If set, failed idempotent requests are retried
+	SlowStart        time.Duration           // Time over which new and recovered backends ramp up to full weight
+	StickyCookie     string                  // Cookie name for StrategyStickyCookie
+	HashHeader       string                  // Request header to hash for StrategyHash
+	LatencyDecay     time.Duration           // For StrategyLatency. 0 means DefaultLatencyDecay
+	routeHosts       []*RouteMatch           // Matches on the Routes keys
+	backends         map[string]*backend
+	rrWeights        map[string]map[string]int // Smooth weighted round-robin state per route
+	transports       map[string]*http.Transport
+	mirroring        map[string]int // In-flight shadow requests per route
+	routeStats       map[string]*trafficCounter
+	checking         bool // Whether health checks are running
+	budget           *retryBudget
+	mu               *sync.Mutex
+	ps               *ProxyServer
+}
+
+type backend struct {
+	addr                string
+	url                 *url.URL
+	weight              int
+	start               time.Time // When the backend was added or last recovered
+	active              int       // In-flight requests
+	healthy             bool
+	successes           int // Consecutive successful health checks
+	failures            int // Consecutive failed health checks
+	lastCheck           time.Time
+	lastError           string
+	consecutiveFailures int // Consecutive failed proxied requests
+	ejectedUntil        time.Time
+	draining            bool    // Removed, but still has in-flight requests
+	latency             float64 // Moving average, in nanoseconds
+	latencyAt           time.Time
+	stats               trafficCounter
+	stop                chan bool
+}
+
+// BackendStatus is a snapshot of the state of a backend.
+type BackendStatus struct {
+	Addr      string
+	Weight    int
+	Healthy   bool
+	Ejected   bool
+	Draining  bool
+	Active    int
+	Latency   time.Duration // Moving average of successful requests
+	LastCheck time.Time
+	LastError string
 }
 
 func (lb *LoadBalancerHandler) HandleProxy(s *ProxySession) {
-	dest, err := lb.chooseHost(s.Request.Host)
-	if err != nil {
-		http.Error(s.W, "Not found", http.StatusNotFound)
+	var (
+		req   = s.Request
+		path  = req.URL.Path
+		route string
+		tried []string       // Backends that failed, if the request was retried
+		po    primaryOutcome // Counted in the stats, and compared with the shadow response if mirrored
+		cw    = &countingWriter{ResponseWriter: s.W}
+	)
+	s.W = cw
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	lb.budget.request()
+	ms := lb.startMirror(s)
+	lb.mu.Lock()
+	route = lb.routeFor(req)
+	lb.mu.Unlock()
+	defer func() {
+		po.BytesOut = cw.written()
+		if cw.hijacked {
+			po.Status = http.StatusSwitchingProtocols
+		}
+		lb.count(route, &po)
+		ms.finish(&po)
+	}()
+	for {
+		lb.mu.Lock()
+		dest, err := lb.pick(route, req, tried)
+		lb.mu.Unlock()
+		switch {
+		case err == nil:
+		case len(tried) > 0:
+			// Retried, but there are no other backends left to try
+			po = primaryOutcome{Status: http.StatusBadGateway}
+			http.Error(s.W, "Bad gateway", po.Status)
+			return
+		case err == ErrNoHealthyBackend:
+			po.Status = http.StatusServiceUnavailable
+			http.Error(s.W, "Service unavailable", po.Status)
+			return
+		default:
+			route = "" // Not counted
+			po.Status = http.StatusNotFound
+			http.Error(s.W, "Not found", po.Status)
+			return
+		}
+		s.transport = lb.target(req, route, dest, path)
+		start := time.Now()
+		err = s.GetResponse()
+		po = primaryOutcome{
+			Backend: dest,
+			Latency: time.Since(start),
+			Err:     err,
+		}
+		if req.ContentLength > 0 {
+			po.BytesIn = req.ContentLength
+		}
+		if err == nil {
+			po.Status = s.Response.StatusCode
+		}
+		failed := err != nil || s.Response.StatusCode >= 500
+		lb.recordResult(dest, failed)
+		if !failed {
+			lb.recordLatency(dest, po.Latency)
+		}
+		if failed && lb.shouldRetry(s, err, len(tried)) {
+			if s.Response != nil && s.Response.Body != nil {
+				s.Response.Body.Close()
+			}
+			s.Response = nil
+			lb.count("", &po) // Only the backend's stats count the failed attempt
+			tried = append(tried, dest)
+			lb.release(dest)
+			continue
+		}
+		if err != nil {
+			lb.release(dest)
+			http.Error(s.W, "Bad gateway", http.StatusBadGateway)
+			return
+		}
+		if lb.Strategy == StrategyStickyCookie {
+			lb.setStickyCookie(s, dest)
+		}
+		if err = s.Do(); err != nil {
+			// The response has been (partly) sent, so all that's left is to
+			// count it against the backend
+			log.Println("Error relaying response from", dest, "-", err)
+			lb.recordResult(dest, true)
+		}
+		lb.release(dest)
 		return
 	}
-	s.Request.URL.Scheme = "http"
-	s.Request.URL.Host = dest
-	s.Request.Header.Add("X-Forwarded-For", s.Request.RemoteAddr)
-	s.Do()
 }
 
-func (lb *LoadBalancerHandler) chooseHost(k string) (string, error) {
+// shouldRetry reports whether a request that failed with err (or a 5xx response)
+// after the given number of retries may be sent to another backend.
+func (lb *LoadBalancerHandler) shouldRetry(s *ProxySession, err error, retries int) bool {
+	rp := lb.Retry
+	if rp == nil || retries >= rp.Attempts || !isIdempotent(s.Request) {
+		return false
+	}
+	if err == nil && !isRetryableStatus(s.Response.StatusCode) {
+		return false
+	}
+	return lb.budget.withdraw(rp)
+}
+
+// chooseHost picks an available backend that isn't in exclude for the route matching
+// req, and counts it as having one more in-flight request until release is called.
+func (lb *LoadBalancerHandler) chooseHost(req *http.Request, exclude []string) (string, error) {
+	_, d, err := lb.choose(req, exclude)
+	return d, err
+}
+
+// choose is like chooseHost, but also returns the name of the route.
+func (lb *LoadBalancerHandler) choose(req *http.Request, exclude []string) (string, string, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	k := lb.routeFor(req)
+	d, err := lb.pick(k, req, exclude)
+	return k, d, err
+}
+
+// pick picks an available backend that isn't in exclude from the route k, and
+// acquires it. lb.mu must be held.
+func (lb *LoadBalancerHandler) pick(k string, req *http.Request, exclude []string) (string, error) {
+	now := time.Now()
 	ds, found := lb.Routes[k]
-	if !found {
-		return "", fmt.Errorf("Host not found")
+	if k == "" || !found || len(ds) == 0 {
+		return "", ErrNoRoute
+	}
+	hs := make([]string, 0, len(ds))
+	for _, v := range ds {
+		if lb.isAvailable(v, now) && !contains(exclude, v) {
+			hs = append(hs, v)
+		}
+	}
+	if len(hs) == 0 {
+		return "", ErrNoHealthyBackend
 	}
 	var d string
 	switch lb.Strategy {
+	default:
+		return "", fmt.Errorf("Unknown load balancing strategy %d", lb.Strategy)
 	case StrategyFirst:
-		d = ds[0]
+		d = hs[0]
 	case StrategyRandom:
-		d = ds[rand.Intn(len(ds))]
+		d = lb.weightedRandom(hs, now)
 	case StrategyRoundrobin:
-		d = <-lb.dist[k]
+		d = lb.smoothRoundRobin(k, hs, now)
+	case StrategyFair:
+		d = lb.leastActive(hs, now)
+	case StrategyStickyCookie:
+		d = lb.stickyBackend(req, hs)
+		if d == "" {
+			d = lb.smoothRoundRobin(k, hs, now)
+		}
+	case StrategySourceIP:
+		d = lb.rendezvous(clientIP(req), hs, now)
+	case StrategyHash:
+		key := req.URL.Path
+		if lb.HashHeader != "" {
+			key = req.Header.Get(lb.HashHeader)
+		}
+		d = lb.rendezvous(key, hs, now)
+	case StrategyLatency:
+		d = lb.twoChoices(hs, now)
 	}
+	lb.acquire(d)
 	return d, nil
 }
 
-func RoundRobinDispatcher(routes []string, dist chan<- string) {
-	for {
-		for _, v := range routes {
-			dist <- v
+// target points req, whose original path is path, at the backend dest of the
+// route, and returns the transport to send it with, or nil for the default.
+func (lb *LoadBalancerHandler) target(req *http.Request, route, dest, path string) *http.Transport {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	u := lb.backendURL(dest)
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.URL.Path = joinPath(u.Path, path)
+	req.URL.RawPath = ""
+	return lb.transport(route)
+}
+
+// leastActive returns the backend in ds with the fewest in-flight requests relative
+// to its weight. Ties are broken by starting the search at a random offset. lb.mu
+// must be held.
+func (lb *LoadBalancerHandler) leastActive(ds []string, now time.Time) string {
+	var (
+		n     = len(ds)
+		start = rand.Intn(n)
+		d     = ds[start]
+		b     = lb.getBackend(d)
+		w     = lb.effectiveWeight(b, now)
+	)
+	for i := 1; i < n; i++ {
+		ob := lb.getBackend(ds[(start+i)%n])
+		ow := lb.effectiveWeight(ob, now)
+		if ob.active*w < b.active*ow {
+			b, w = ob, ow
+		}
+	}
+	return b.addr
+}
+
+// getBackend returns the backend for addr, or nil if it has been removed.
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) getBackend(addr string) *backend {
+	return lb.backends[addr]
+}
+
+// newBackend returns the backend for addr, creating it if it doesn't exist.
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) newBackend(addr string) *backend {
+	b, found := lb.backends[addr]
+	if !found {
+		b = &backend{
+			addr:    addr,
+			url:     parseBackendURL(addr),
+			weight:  1,
+			start:   time.Now(),
+			healthy: true,
+		}
+		lb.backends[addr] = b
+	}
+	return b
+}
+
+// backendURL returns the URL of the backend addr, even if it has been removed
+// since it was picked. lb.mu must be held.
+func (lb *LoadBalancerHandler) backendURL(addr string) *url.URL {
+	if b := lb.getBackend(addr); b != nil {
+		return b.url
+	}
+	return parseBackendURL(addr)
+}
+
+func parseBackendURL(addr string) *url.URL {
+	u, err := ParseBackend(addr)
+	if err != nil {
+		u = &url.URL{Scheme: "http", Host: addr}
+	}
+	return u
+}
+
+// isAvailable reports whether addr is healthy, not ejected or draining, and has a
+// weight above zero. lb.mu must be held.
+func (lb *LoadBalancerHandler) isAvailable(addr string, now time.Time) bool {
+	b := lb.getBackend(addr)
+	return b != nil && b.healthy && !b.draining && b.weight > 0 && !now.Before(b.ejectedUntil)
+}
+
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) acquire(addr string) {
+	lb.getBackend(addr).active++
+}
+
+func (lb *LoadBalancerHandler) release(addr string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b := lb.getBackend(addr)
+	if b != nil && b.active > 0 {
+		b.active--
+	}
+}
+
+// Active returns the number of in-flight requests for each busy backend.
+func (lb *LoadBalancerHandler) Active() map[string]int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := map[string]int{}
+	for k, v := range lb.backends {
+		if v.active > 0 {
+			res[k] = v.active
+		}
+	}
+	return res
+}
+
+// Status returns the state of every backend, ordered by address.
+func (lb *LoadBalancerHandler) Status() []BackendStatus {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := make([]BackendStatus, 0, len(lb.backends))
+	now := time.Now()
+	for _, v := range lb.backends {
+		res = append(res, BackendStatus{
+			Addr:      v.addr,
+			Weight:    v.weight,
+			Healthy:   v.healthy,
+			Ejected:   now.Before(v.ejectedUntil),
+			Draining:  v.draining,
+			Active:    v.active,
+			Latency:   time.Duration(v.latency),
+			LastCheck: v.lastCheck,
+			LastError: v.lastError,
+		})
+	}
+	sort.Sort(backendStatusByAddr(res))
+	return res
+}
+
+type backendStatusByAddr []BackendStatus
+
+func (s backendStatusByAddr) Len() int           { return len(s) }
+func (s backendStatusByAddr) Less(i, j int) bool { return s[i].Addr < s[j].Addr }
+func (s backendStatusByAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
 		}
 	}
+	return false
 }
 
 func NewHTTPLoadBalancer(r map[string][]string, s int) *LoadBalancerHandler {
 	lb := &LoadBalancerHandler{
-		Routes:   r,
-		Strategy: s,
+		Routes:     map[string][]string{},
+		Strategy:   s,
+		TLS:        map[string]*UpstreamTLS{},
+		Mirrors:    map[string]*Mirror{},
+		Splits:     map[string]*Split{},
+		backends:   map[string]*backend{},
+		rrWeights:  map[string]map[string]int{},
+		transports: map[string]*http.Transport{},
+		mirroring:  map[string]int{},
+		routeStats: map[string]*trafficCounter{},
+		budget:     newRetryBudget(),
+		mu:         &sync.Mutex{},
 	}
-	if s == StrategyRoundrobin {
-		lb.dist = map[string]chan string{}
-		for k, v := range r {
-			dist := make(chan string, 2)
-			go RoundRobinDispatcher(v, dist)
-			lb.dist[k] = dist
+	for k, v := range r {
+		lb.Routes[k] = append([]string{}, v...)
+		for _, ov := range v {
+			lb.newBackend(ov)
 		}
 	}
+	lb.updateRouteHosts()
 	return lb
 }
@@ -1,10 +1,26 @@
 package proxy
 
 import (
+	"github.com/pmylund/sniffy/cert"
+
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type TestServer struct {
@@ -31,6 +47,12 @@ func GetNoProxyClient() *http.Client {
 
 }
 
+func newTestRequest(host string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
 func GetTestServer() (*TestServer, error) {
 	ts := &TestServer{
 		ch: make(chan *http.Request),
@@ -46,6 +68,7 @@ func GetTestServer() (*TestServer, error) {
 	if err != nil {
 		return nil, err
 	}
+	ts.l = l
 	ts.Addr = l.Addr().String()
 	go srv.Serve(l)
 	return ts, nil
@@ -124,3 +147,1128 @@ func TestLoadBalancer(t *testing.T) {
 		}(k, v)
 	}
 }
+
+func TestStrategyFairPicksLeastActive(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFair)
+	lb.backends["10.0.0.1:80"].active = 5
+	lb.backends["10.0.0.3:80"].active = 2
+	for i := 0; i < 2; i++ {
+		d, err := lb.chooseHost(newTestRequest("a.com"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != "10.0.0.2:80" {
+			t.Fatalf("Request %d went to %s when 10.0.0.2:80 had the fewest in-flight requests", i, d)
+		}
+	}
+	d, _ := lb.chooseHost(newTestRequest("a.com"), nil)
+	if d != "10.0.0.3:80" && d != "10.0.0.2:80" {
+		t.Fatalf("Request went to %s when 10.0.0.1:80 was the most loaded", d)
+	}
+	lb.release(d)
+	lb.release("10.0.0.2:80")
+	lb.release("10.0.0.2:80")
+	if n := lb.Active()["10.0.0.2:80"]; n != 0 {
+		t.Fatalf("10.0.0.2:80 has %d in-flight requests after they were all released", n)
+	}
+}
+
+func TestStrategyFair(t *testing.T) {
+	const n = 3
+	g, err := GetTestServerGroup(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := map[string][]string{"a.com": {}}
+	for _, v := range g {
+		defer v.Close()
+		routes["a.com"] = append(routes["a.com"], v.Addr)
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFair)
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	c := GetNoProxyClient()
+	done := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/", nil)
+			req.Host = "a.com"
+			res, err := c.Do(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			done <- err == nil
+		}()
+	}
+	// The test servers block until their request is read, so every backend
+	// should be holding exactly one in-flight request.
+	for _, v := range g {
+		select {
+		case <-v.ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Backend %s didn't receive a request while the others were busy", v.Addr)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !<-done {
+			t.Error("Request through the load balancer failed")
+		}
+	}
+}
+
+type healthServer struct {
+	Addr string
+	mu   sync.Mutex
+	ok   bool
+}
+
+func (hs *healthServer) setOK(ok bool) {
+	hs.mu.Lock()
+	hs.ok = ok
+	hs.mu.Unlock()
+}
+
+func (hs *healthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if req.URL.Path != "/health" || !hs.ok {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hs := &healthServer{Addr: l.Addr().String(), ok: true}
+	go (&http.Server{Handler: hs}).Serve(l)
+
+	routes := map[string][]string{
+		"a.com": {hs.Addr, "127.0.0.1:1"}, // nothing listens on port 1
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyRandom)
+	lb.HealthCheck = NewHealthCheck("/health", 10*time.Millisecond)
+	lb.HealthCheck.Rise = 1
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+
+	healthy := func(addr string) bool {
+		for _, v := range lb.Status() {
+			if v.Addr == addr {
+				return v.Healthy
+			}
+		}
+		return false
+	}
+	waitFor(t, "dead backend to be taken out of rotation", func() bool { return !healthy("127.0.0.1:1") })
+	for i := 0; i < 20; i++ {
+		d, err := lb.chooseHost(newTestRequest("a.com"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.release(d)
+		if d != hs.Addr {
+			t.Fatalf("Request went to unhealthy backend %s", d)
+		}
+	}
+
+	hs.setOK(false)
+	waitFor(t, "failing backend to be taken out of rotation", func() bool { return !healthy(hs.Addr) })
+	if _, err := lb.chooseHost(newTestRequest("a.com"), nil); err != ErrNoHealthyBackend {
+		t.Fatalf("Expected ErrNoHealthyBackend with no healthy backends; got %v", err)
+	}
+	hs.setOK(true)
+	waitFor(t, "recovered backend to be put back in rotation", func() bool { return healthy(hs.Addr) })
+}
+
+func TestRetryAndOutlierDetection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hs := &healthServer{Addr: l.Addr().String(), ok: true}
+	go (&http.Server{Handler: hs}).Serve(l)
+
+	const dead = "127.0.0.1:1"
+	routes := map[string][]string{
+		"a.com": {dead, hs.Addr},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFirst)
+	lb.OutlierDetection = &OutlierDetection{
+		ConsecutiveFailures: 2,
+		EjectionTime:        time.Minute,
+	}
+	lb.Retry = &RetryPolicy{
+		Attempts:   1,
+		MinRetries: 2,
+	}
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	c := GetNoProxyClient()
+	do := func(method string) int {
+		req, _ := http.NewRequest(method, "http://"+pl.Addr().String()+"/health", nil)
+		req.Host = "a.com"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := do("POST"); code != http.StatusBadGateway {
+		t.Fatalf("Non-idempotent request to a dead backend got status %d; expected 502", code)
+	}
+	if code := do("GET"); code != http.StatusOK {
+		t.Fatalf("GET wasn't retried on the healthy backend; got status %d", code)
+	}
+	for _, v := range lb.Status() {
+		if v.Addr == dead && !v.Ejected {
+			t.Fatal("Dead backend wasn't ejected after two consecutive failures")
+		}
+	}
+	// The dead backend is ejected, so these go straight to the healthy one
+	for i := 0; i < 3; i++ {
+		if code := do("GET"); code != http.StatusOK {
+			t.Fatalf("Request %d got status %d with the dead backend ejected", i, code)
+		}
+	}
+	lb.mu.Lock()
+	lb.backends[dead].ejectedUntil = time.Time{}
+	lb.mu.Unlock()
+	lb.Retry.MinRetries = 0
+	if code := do("GET"); code != http.StatusBadGateway {
+		t.Fatalf("Request was retried with an exhausted retry budget; got status %d", code)
+	}
+}
+
+func TestWeightedStrategies(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyRoundrobin)
+	lb.SetWeight("10.0.0.1:80", 5)
+	lb.SetWeight("10.0.0.2:80", 1)
+	lb.SetWeight("10.0.0.3:80", 1)
+	var seq string
+	for i := 0; i < 7; i++ {
+		d, _ := lb.chooseHost(newTestRequest("a.com"), nil)
+		lb.release(d)
+		seq += d[7:8]
+	}
+	// The smooth algorithm spreads the heavy backend's turns out
+	if seq != "1121311" {
+		t.Errorf("Smooth weighted round-robin picked %s; expected 1121311", seq)
+	}
+
+	lb.Strategy = StrategyRandom
+	lb.SetWeight("10.0.0.3:80", 0)
+	counts := map[string]int{}
+	for i := 0; i < 6000; i++ {
+		d, _ := lb.chooseHost(newTestRequest("a.com"), nil)
+		lb.release(d)
+		counts[d]++
+	}
+	if counts["10.0.0.3:80"] != 0 {
+		t.Errorf("Backend with weight 0 received %d requests", counts["10.0.0.3:80"])
+	}
+	if n := counts["10.0.0.2:80"]; n < 700 || n > 1300 {
+		t.Errorf("Backend with 1/6 of the weight received %d of 6000 requests", n)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyRoundrobin)
+	lb.SlowStart = time.Minute
+	now := time.Now()
+	lb.backends["10.0.0.1:80"].start = now.Add(-time.Hour)
+	lb.backends["10.0.0.2:80"].start = now.Add(-6 * time.Second) // 10% of the way
+	counts := map[string]int{}
+	for i := 0; i < 110; i++ {
+		d, _ := lb.chooseHost(newTestRequest("a.com"), nil)
+		lb.release(d)
+		counts[d]++
+	}
+	if n := counts["10.0.0.2:80"]; n < 5 || n > 15 {
+		t.Errorf("Slow-starting backend received %d of 110 requests; expected about 10", n)
+	}
+	lb.backends["10.0.0.2:80"].start = now.Add(-time.Hour)
+	counts = map[string]int{}
+	for i := 0; i < 100; i++ {
+		d, _ := lb.chooseHost(newTestRequest("a.com"), nil)
+		lb.release(d)
+		counts[d]++
+	}
+	if counts["10.0.0.2:80"] != 50 {
+		t.Errorf("Backend past its slow start received %d of 100 requests; expected 50", counts["10.0.0.2:80"])
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyStickyCookie)
+	req := newTestRequest("a.com")
+	first, _ := lb.chooseHost(req, nil)
+	lb.release(first)
+	s := &ProxySession{
+		Request:  req,
+		Response: &http.Response{Header: http.Header{}},
+	}
+	lb.setStickyCookie(s, first)
+	cookies := (&http.Response{Header: s.Response.Header}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultStickyCookie {
+		t.Fatalf("Expected a %s cookie; got %v", DefaultStickyCookie, s.Response.Header)
+	}
+	req.AddCookie(cookies[0])
+	for i := 0; i < 10; i++ {
+		d, _ := lb.chooseHost(req, nil)
+		lb.release(d)
+		if d != first {
+			t.Fatalf("Request with a sticky cookie for %s went to %s", first, d)
+		}
+	}
+	s.Response.Header = http.Header{}
+	lb.setStickyCookie(s, first)
+	if len(s.Response.Header["Set-Cookie"]) != 0 {
+		t.Error("Sticky cookie was set again for a client that already had it")
+	}
+	d, _ := lb.chooseHost(req, []string{first})
+	if d == first {
+		t.Error("Sticky backend was chosen even though it was excluded")
+	}
+}
+
+func TestSourceIPHash(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategySourceIP)
+	req := newTestRequest("a.com")
+	first, _ := lb.chooseHost(req, nil)
+	for i := 0; i < 10; i++ {
+		req.RemoteAddr = fmt.Sprintf("192.0.2.1:%d", 2000+i)
+		d, _ := lb.chooseHost(req, nil)
+		if d != first {
+			t.Fatalf("Client 192.0.2.1 went to %s and then %s", first, d)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}
+	routes := map[string][]string{
+		"a.com": backends,
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyHash)
+	lb.HashHeader = "X-User"
+	const n = 2000
+	before := make([]string, n)
+	counts := map[string]int{}
+	req := newTestRequest("a.com")
+	for i := 0; i < n; i++ {
+		req.Header.Set("X-User", fmt.Sprintf("user%d", i))
+		before[i], _ = lb.chooseHost(req, nil)
+		lb.release(before[i])
+		counts[before[i]]++
+	}
+	for _, v := range backends {
+		if counts[v] < n/4-150 || counts[v] > n/4+150 {
+			t.Errorf("%s received %d of %d keys", v, counts[v], n)
+		}
+	}
+	if !lb.RemoveBackend("a.com", backends[3], 0) {
+		t.Fatalf("Idle backend %s wasn't drained cleanly", backends[3])
+	}
+	moved := 0
+	for i := 0; i < n; i++ {
+		req.Header.Set("X-User", fmt.Sprintf("user%d", i))
+		d, _ := lb.chooseHost(req, nil)
+		lb.release(d)
+		if d != before[i] {
+			if before[i] != backends[3] {
+				t.Fatalf("Key user%d moved from %s to %s when only %s was removed", i, before[i], d, backends[3])
+			}
+			moved++
+		}
+	}
+	if moved != counts[backends[3]] {
+		t.Errorf("%d keys moved; expected the %d that were on the removed backend", moved, counts[backends[3]])
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	routes := map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFirst)
+	routes["a.com"][0] = "10.0.0.9:80"
+	if lb.ListRoutes()["a.com"][0] != "10.0.0.1:80" {
+		t.Fatalf("Load balancer shares its routes with the caller")
+	}
+	req := newTestRequest("b.com")
+	if _, err := lb.chooseHost(req, nil); err != ErrNoRoute {
+		t.Fatalf("Got %v for unknown route; expected ErrNoRoute", err)
+	}
+	lb.AddBackend("b.com", "10.0.0.3:80")
+	d, err := lb.chooseHost(req, nil)
+	if err != nil || d != "10.0.0.3:80" {
+		t.Fatalf("Added route b.com went to %q (%v)", d, err)
+	}
+	// The in-flight request keeps 10.0.0.3 draining until it's released, but the
+	// route is gone right away
+	done := lb.RemoveBackendAsync("b.com", "10.0.0.3:80", 0)
+	if _, found := lb.ListRoutes()["b.com"]; found {
+		t.Fatalf("b.com is still routed while its backend drains")
+	}
+	if _, err := lb.chooseHost(req, nil); err != ErrNoRoute {
+		t.Fatalf("Got %v for removed route; expected ErrNoRoute", err)
+	}
+	st := lb.Status()
+	if len(st) != 3 || st[2].Addr != "10.0.0.3:80" || !st[2].Draining {
+		t.Fatalf("10.0.0.3 isn't draining: %+v", st)
+	}
+	select {
+	case <-done:
+		t.Fatalf("RemoveBackend returned with a request still in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lb.release(d)
+	if ok := <-done; !ok {
+		t.Fatalf("RemoveBackend reported an unclean drain")
+	}
+	if len(lb.Status()) != 2 {
+		t.Fatalf("Removed backend wasn't forgotten: %+v", lb.Status())
+	}
+	// A backend that doesn't drain in time is forgotten anyway
+	req = newTestRequest("a.com")
+	d, _ = lb.chooseHost(req, nil)
+	if d != "10.0.0.1:80" {
+		t.Fatalf("a.com went to %s", d)
+	}
+	if lb.RemoveBackend("a.com", d, 50*time.Millisecond) {
+		t.Fatalf("RemoveBackend reported a clean drain with a request in flight")
+	}
+	lb.release(d)
+	d, _ = lb.chooseHost(req, nil)
+	lb.release(d)
+	if d != "10.0.0.2:80" {
+		t.Fatalf("a.com went to %s after 10.0.0.1 was removed", d)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	lb := NewHTTPLoadBalancer(map[string][]string{
+		"a.com": {"10.0.0.1:80", "10.0.0.2:80"},
+	}, StrategyFirst)
+	lb.OutlierDetection = &OutlierDetection{
+		ConsecutiveFailures: 1,
+		EjectionTime:        time.Minute,
+	}
+	d, err := lb.chooseHost(newTestRequest("a.com"), nil)
+	if err != nil || d != "10.0.0.1:80" {
+		t.Fatalf("a.com went to %q (%v)", d, err)
+	}
+	if lb.RemoveBackend("a.com", d, 10*time.Millisecond) {
+		t.Fatalf("RemoveBackend reported a clean drain with a request in flight")
+	}
+	// The request finishes after its backend was forgotten
+	lb.recordResult(d, true)
+	lb.recordLatency(d, time.Millisecond)
+	lb.count("a.com", &primaryOutcome{Backend: d, Status: http.StatusOK})
+	lb.release(d)
+	st := lb.Status()
+	if len(st) != 1 || st[0].Addr != "10.0.0.2:80" {
+		t.Fatalf("Removed backend came back after its request finished: %+v", st)
+	}
+	if _, found := lb.BackendStats()[d]; found {
+		t.Fatalf("Removed backend came back in the stats")
+	}
+	if err = lb.SetWeight(d, 5); err == nil {
+		t.Fatalf("Set the weight of a removed backend")
+	}
+	if len(lb.Status()) != 1 {
+		t.Fatalf("SetWeight added a backend: %+v", lb.Status())
+	}
+}
+
+func TestRouting(t *testing.T) {
+	routes := map[string][]string{
+		"example.com":       {"10.0.0.1:80"},
+		"*.example.com":     {"10.0.0.2:80"},
+		"*.api.example.com": {"10.0.0.3:80"},
+		"*":                 {"10.0.0.4:80"},
+		"api":               {"10.0.0.5:80"},
+		"static":            {"10.0.0.6:80"},
+		"images":            {"10.0.0.7:80"},
+		"beta":              {"10.0.0.8:80"},
+		"priority":          {"10.0.0.9:80"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFirst)
+	images := NewRouteMatch("images", "example.com", "/static/")
+	images.PathRegexp = regexp.MustCompile(`\.(png|jpg)$`)
+	beta := NewRouteMatch("beta", "example.com", "/api/")
+	beta.Header = "X-Beta"
+	priority := NewRouteMatch("priority", "", "/admin/")
+	priority.Priority = 1
+	lb.SetMatches([]*RouteMatch{
+		NewRouteMatch("api", "example.com", "/api/"),
+		NewRouteMatch("api", "*.example.com", "/api/"),
+		NewRouteMatch("static", "example.com", "/static/"),
+		images,
+		beta,
+		priority,
+		NewRouteMatch("static", "example.com", "/api/"), // Loses the tie with the first match
+	})
+	cases := []struct {
+		host, path, header string
+		expected           string
+	}{
+		{"example.com", "/", "", "example.com"},
+		{"EXAMPLE.com:8080", "/", "", "example.com"},
+		{"example.com.", "/", "", "example.com"},
+		{"www.example.com", "/", "", "*.example.com"},
+		{"a.b.example.com:443", "/", "", "*.example.com"},
+		{"v1.api.example.com", "/", "", "*.api.example.com"},
+		{"example.org", "/", "", "*"},
+		{"notexample.com", "/", "", "*"},
+		{"example.com", "/api/users", "", "api"},
+		{"example.com", "/api", "", "example.com"},
+		{"www.example.com", "/api/users", "", "api"},
+		{"v1.api.example.com", "/api/users", "", "*.api.example.com"},
+		{"example.com", "/static/app.js", "", "static"},
+		{"example.com", "/static/logo.png", "", "images"},
+		{"example.com", "/api/users", "1", "beta"},
+		{"example.com", "/admin/", "", "priority"},
+		{"example.org", "/admin/", "", "priority"},
+	}
+	for _, c := range cases {
+		req := newTestRequest(c.host)
+		req.URL.Path = c.path
+		if c.header != "" {
+			req.Header.Set("X-Beta", c.header)
+		}
+		d, err := lb.chooseHost(req, nil)
+		if err != nil {
+			t.Errorf("%s%s: %s", c.host, c.path, err)
+			continue
+		}
+		lb.release(d)
+		if d != routes[c.expected][0] {
+			t.Errorf("%s%s (header %q) went to %s; expected route %s", c.host, c.path, c.header, d, c.expected)
+		}
+	}
+
+	// A RouteMatch for "*" matches any host, like one for ""
+	lb = NewHTTPLoadBalancer(map[string][]string{
+		"example.com": {"10.0.0.1:80"},
+		"admin":       {"10.0.0.2:80"},
+	}, StrategyFirst)
+	lb.SetMatches([]*RouteMatch{{Route: "admin", Host: "*", PathPrefix: "/admin/"}})
+	for host, expected := range map[string]string{
+		"example.org": "10.0.0.2:80",
+		"example.com": "10.0.0.1:80", // The exact host wins
+	} {
+		req := newTestRequest(host)
+		req.URL.Path = "/admin/"
+		d, err := lb.chooseHost(req, nil)
+		if err != nil || d != expected {
+			t.Errorf("%s/admin/ went to %q (%v); expected %s", host, d, err, expected)
+		}
+		lb.release(d)
+	}
+
+	lb = NewHTTPLoadBalancer(map[string][]string{"example.com": {"10.0.0.1:80"}}, StrategyFirst)
+	for _, v := range []string{"example.org", "www.example.com"} {
+		if _, err := lb.chooseHost(newTestRequest(v), nil); err != ErrNoRoute {
+			t.Errorf("Got %v for %s without a default route; expected ErrNoRoute", err, v)
+		}
+	}
+}
+
+func TestHTTPSBackends(t *testing.T) {
+	folder, err := ioutil.TempDir("", "sniffy-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	clientCert, err := cert.GetOrGenerateKeyPair(path.Join(folder, "client_cert.pem"), path.Join(folder, "client_key.pem"), "client", nil, false, nil, cert.RSA2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("X-Path", req.URL.Path)
+		h.Set("X-SNI", req.TLS.ServerName)
+		if len(req.TLS.PeerCertificates) > 0 {
+			h.Set("X-Client", req.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	backend := ts.URL + "/app"
+	lb := NewHTTPLoadBalancer(map[string][]string{"a.com": {backend}}, StrategyFirst)
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	c := GetNoProxyClient()
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/x", nil)
+		req.Host = "a.com"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := get(); res.StatusCode != http.StatusBadGateway {
+		t.Errorf("Got status %d from backend with an untrusted certificate; expected 502", res.StatusCode)
+	}
+
+	lb.SetTLS("a.com", &UpstreamTLS{InsecureSkipVerify: true})
+	res := get()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %d with InsecureSkipVerify", res.StatusCode)
+	}
+	if p := res.Header.Get("X-Path"); p != "/app/x" {
+		t.Errorf("Backend got path %s; expected /app/x", p)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	lb.SetTLS("a.com", &UpstreamTLS{
+		RootCAs:      roots,
+		ServerName:   "example.com", // One of the names in the httptest certificate
+		Certificates: []tls.Certificate{*clientCert},
+	})
+	res = get()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %d with a custom CA", res.StatusCode)
+	}
+	if sni := res.Header.Get("X-SNI"); sni != "example.com" {
+		t.Errorf("Backend got SNI %q; expected example.com", sni)
+	}
+	if cn := res.Header.Get("X-Client"); cn != "client" {
+		t.Errorf("Backend got client certificate %q; expected client", cn)
+	}
+
+	lb.HealthCheck = NewHealthCheck("/health", 50*time.Millisecond)
+	lb.HealthCheck.Timeout = time.Second // Every probe does a full handshake
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+	waitFor(t, "a health check over TLS", func() bool {
+		st := lb.Status()[0]
+		return !st.LastCheck.IsZero() && st.LastError == "" && st.Healthy
+	})
+}
+
+func TestMirroring(t *testing.T) {
+	type seen struct {
+		method, path, body string
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	shadowCh := make(chan seen, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		shadowCh <- seen{req.Method, req.URL.RequestURI(), string(b)}
+		time.Sleep(300 * time.Millisecond) // Must not delay the primary response
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	routes := map[string][]string{
+		"a.com":        {primary.URL},
+		"a.com-shadow": {shadow.URL + "/v2"},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFirst)
+	results := make(chan *MirrorResult, 10)
+	lb.SetMirror("a.com", &Mirror{
+		Route:       "a.com-shadow",
+		MaxBodySize: 8,
+		OnResult: func(res *MirrorResult) {
+			results <- res
+		},
+	})
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	c := GetNoProxyClient()
+	post := func(body string) {
+		req, _ := http.NewRequest("POST", "http://"+pl.Addr().String()+"/x?y=1", strings.NewReader(body))
+		req.Host = "a.com"
+		start := time.Now()
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(b) != "primary" {
+			t.Fatalf("Client got %d %q; expected the primary response", res.StatusCode, b)
+		}
+		if time.Since(start) >= 300*time.Millisecond {
+			t.Errorf("Primary response was delayed by the shadow request")
+		}
+	}
+
+	post("hello")
+	select {
+	case v := <-shadowCh:
+		if v != (seen{"POST", "/v2/x?y=1", "hello"}) {
+			t.Errorf("Shadow got %+v", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Request wasn't mirrored")
+	}
+	res := <-results
+	if res.Route != "a.com" || res.ShadowRoute != "a.com-shadow" || res.URL != "/x?y=1" {
+		t.Errorf("Wrong request in mirror result: %+v", res)
+	}
+	if res.PrimaryStatus != http.StatusOK || res.ShadowStatus != http.StatusInternalServerError {
+		t.Errorf("Got primary status %d and shadow status %d; expected 200 and 500", res.PrimaryStatus, res.ShadowStatus)
+	}
+	if res.ShadowLatency < 300*time.Millisecond || res.ShadowLatency < res.PrimaryLatency {
+		t.Errorf("Shadow latency %s isn't above primary latency %s", res.ShadowLatency, res.PrimaryLatency)
+	}
+
+	// Bodies above MaxBodySize are passed through, but not mirrored
+	post("too large to mirror")
+	select {
+	case v := <-shadowCh:
+		t.Errorf("Shadow got oversized request %+v", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer stable.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer canary.Close()
+	routes := map[string][]string{
+		"a.com":        {stable.URL},
+		"a.com-canary": {canary.URL},
+	}
+	lb := NewHTTPLoadBalancer(routes, StrategyFirst)
+	lb.SetSplit("a.com", &Split{
+		Route:       "a.com-canary",
+		Percent:     20,
+		Header:      "X-Canary",
+		HeaderValue: "1",
+		Cookie:      "canary",
+	})
+
+	const n = 2000
+	count := func(f func(*http.Request)) int {
+		c := 0
+		for i := 0; i < n; i++ {
+			req := newTestRequest("a.com")
+			f(req)
+			d, _ := lb.chooseHost(req, nil)
+			lb.release(d)
+			if d == canary.URL {
+				c++
+			}
+		}
+		return c
+	}
+	if c := count(func(*http.Request) {}); c < n/5-100 || c > n/5+100 {
+		t.Errorf("%d of %d requests went to the canary; expected about 20%%", c, n)
+	}
+	if c := count(func(req *http.Request) { req.Header.Set("X-Canary", "1") }); c != n {
+		t.Errorf("%d of %d requests with X-Canary: 1 went to the canary", c, n)
+	}
+	if c := count(func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "canary", Value: "yes"}) }); c != n {
+		t.Errorf("%d of %d requests with the canary cookie went to the canary", c, n)
+	}
+
+	// Adjusted at runtime
+	lb.SetSplit("a.com", &Split{Route: "a.com-canary", Percent: 0})
+	if c := count(func(*http.Request) {}); c != 0 {
+		t.Errorf("%d requests went to the canary at 0%%", c)
+	}
+	lb.SetSplit("a.com", &Split{Route: "a.com-canary", Percent: 100})
+	if c := count(func(*http.Request) {}); c != n {
+		t.Errorf("%d of %d requests went to the canary at 100%%", c, n)
+	}
+
+	lb.SetSplit("a.com", &Split{Route: "a.com-canary", Percent: 50})
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+	c := GetNoProxyClient()
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/", nil)
+		req.Host = "a.com"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	st := lb.RouteStats()
+	if st["a.com"].Requests+st["a.com-canary"].Requests != 100 {
+		t.Fatalf("Route stats don't add up to 100 requests: %+v", st)
+	}
+	if st["a.com"].Errors != 0 || st["a.com"].ErrorRate() != 0 {
+		t.Errorf("Stable group has errors: %+v", st["a.com"])
+	}
+	if st["a.com-canary"].Requests == 0 || st["a.com-canary"].ErrorRate() != 1 {
+		t.Errorf("Canary group should have failed every request: %+v", st["a.com-canary"])
+	}
+}
+
+// echoServer writes its name, then echoes everything it reads.
+func echoServer(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte(name))
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPLoadBalancer(t *testing.T) {
+	e1 := echoServer(t, "e1")
+	defer e1.Close()
+	e2 := echoServer(t, "e2")
+	defer e2.Close()
+	const dead = "127.0.0.1:1"
+	lb := NewHTTPLoadBalancer(map[string][]string{
+		"db": {e1.Addr().String(), dead, e2.Addr().String()},
+	}, StrategyRoundrobin)
+	lb.OutlierDetection = &OutlierDetection{
+		ConsecutiveFailures: 1,
+		EjectionTime:        time.Minute,
+	}
+	tl := NewTCPLoadBalancer(lb, "db")
+	closed := make(chan *TCPConnStats, 10)
+	tl.OnClose = func(cs *TCPConnStats) {
+		closed <- cs
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tl.Serve(l)
+	defer tl.Close()
+
+	var names []string
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := make([]byte, 2)
+		if _, err := io.ReadFull(c, name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, string(name))
+		c.Write([]byte("hello"))
+		echo := make([]byte, 5)
+		if _, err := io.ReadFull(c, echo); err != nil || string(echo) != "hello" {
+			t.Fatalf("Got echo %q (%v)", echo, err)
+		}
+		c.(*net.TCPConn).CloseWrite()
+		if rest, _ := ioutil.ReadAll(c); len(rest) != 0 {
+			t.Errorf("Got unexpected data %q", rest)
+		}
+		c.Close()
+		cs := <-closed
+		if cs.BytesIn != 5 || cs.BytesOut != 7 || cs.Error != "" {
+			t.Errorf("Wrong accounting for connection to %s: %+v", name, cs)
+		}
+		if cs.Duration <= 0 || cs.Client != c.LocalAddr().String() {
+			t.Errorf("Wrong connection details: %+v", cs)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "e1 e1 e2 e2" {
+		t.Errorf("Connections went to %v; expected two each to e1 and e2", names)
+	}
+	st := tl.Stats()
+	if st.Connections != 4 || st.Active != 0 || st.Failed != 0 || st.BytesIn != 20 || st.BytesOut != 28 {
+		t.Errorf("Wrong stats: %+v", st)
+	}
+	for _, v := range lb.Status() {
+		if v.Addr == dead && !v.Ejected {
+			t.Errorf("Unreachable backend wasn't ejected")
+		}
+	}
+
+	// A TCP health check takes down backends that don't accept connections
+	e2.Close()
+	lb.HealthCheck = NewHealthCheck("", 10*time.Millisecond)
+	lb.HealthCheck.Fall = 1
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+	waitFor(t, "e2 to be marked unhealthy", func() bool {
+		for _, v := range lb.Status() {
+			if v.Addr == e2.Addr().String() {
+				return !v.Healthy
+			}
+		}
+		return false
+	})
+	for _, v := range lb.Status() {
+		if v.Addr == e1.Addr().String() && !v.Healthy {
+			t.Errorf("e1 was marked unhealthy: %s", v.LastError)
+		}
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+	lb := NewHTTPLoadBalancer(map[string][]string{
+		"a.com": {fast.URL, slow.URL},
+	}, StrategyLatency)
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+	c := GetNoProxyClient()
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/", nil)
+		req.Host = "a.com"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	latency := map[string]time.Duration{}
+	for _, v := range lb.Status() {
+		latency[v.Addr] = v.Latency
+	}
+	if latency[slow.URL] < 20*time.Millisecond || latency[fast.URL] >= latency[slow.URL] {
+		t.Errorf("Got average latencies %s (fast) and %s (slow)", latency[fast.URL], latency[slow.URL])
+	}
+
+	backends := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	lb = NewHTTPLoadBalancer(map[string][]string{"a.com": backends}, StrategyLatency)
+	lb.recordLatency(backends[0], 10*time.Millisecond)
+	lb.recordLatency(backends[1], 10*time.Millisecond)
+	lb.recordLatency(backends[2], 100*time.Millisecond)
+	counts := map[string]int{}
+	req := newTestRequest("a.com")
+	for i := 0; i < 1000; i++ {
+		d, _ := lb.chooseHost(req, nil)
+		lb.release(d)
+		counts[d]++
+	}
+	// Of two different candidates, the slowest backend is never the better one
+	if counts[backends[2]] != 0 || counts[backends[0]] < 400 || counts[backends[1]] < 400 {
+		t.Errorf("Got distribution %v; expected the first two backends to share all requests", counts)
+	}
+
+	// Enough in-flight requests make a fast backend costlier than a slow one
+	for i := 0; i < 20; i++ {
+		lb.mu.Lock()
+		lb.acquire(backends[0])
+		lb.mu.Unlock()
+	}
+	counts = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		d, _ := lb.chooseHost(req, nil)
+		lb.release(d)
+		counts[d]++
+	}
+	if counts[backends[0]] != 0 || counts[backends[2]] < 250 {
+		t.Errorf("Got distribution %v with 20 requests in flight on %s", counts, backends[0])
+	}
+
+	// The average moves towards new samples
+	lb.recordLatency(backends[2], 10*time.Millisecond)
+	for _, v := range lb.Status() {
+		if v.Addr == backends[2] && (v.Latency >= 100*time.Millisecond || v.Latency <= 10*time.Millisecond) {
+			t.Errorf("Average latency %s didn't move towards the new sample", v.Latency)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	lb := NewHTTPLoadBalancer(map[string][]string{
+		"a.com": {broken.URL, ok.URL},
+	}, StrategyFirst)
+	lb.Retry = &RetryPolicy{
+		Attempts:   1,
+		MinRetries: 100,
+	}
+	ps := &ProxyServer{
+		Handler: lb,
+	}
+	srv, _ := ps.getServer()
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer pl.Close()
+	go srv.Serve(pl)
+	c := GetNoProxyClient()
+	do := func(method, path, body string) {
+		req, _ := http.NewRequest(method, "http://"+pl.Addr().String()+path, strings.NewReader(body))
+		req.Host = "a.com"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	for i := 0; i < 10; i++ {
+		do("GET", "/", "") // Retried on ok after broken fails
+	}
+	do("GET", "/missing", "")
+	do("POST", "/", "data") // Not retried
+
+	rs := lb.RouteStats()["a.com"]
+	if rs.Requests != 12 || rs.Errors != 1 {
+		t.Errorf("Route counted %d requests and %d errors; expected 12 and 1", rs.Requests, rs.Errors)
+	}
+	if rs.StatusClasses != [6]int64{0, 0, 10, 0, 1, 1} {
+		t.Errorf("Wrong route status classes %v", rs.StatusClasses)
+	}
+	if rs.BytesIn != 4 || rs.BytesOut < 50 {
+		t.Errorf("Route counted %d bytes in and %d bytes out", rs.BytesIn, rs.BytesOut)
+	}
+	if rs.LatencyP50 < 10*time.Millisecond || rs.LatencyP99 < rs.LatencyP50 || rs.LatencyP90 < rs.LatencyP50 {
+		t.Errorf("Wrong latency percentiles %s, %s, %s", rs.LatencyP50, rs.LatencyP90, rs.LatencyP99)
+	}
+
+	bs := lb.BackendStats()
+	if b := bs[broken.URL]; b.Requests != 12 || b.Errors != 12 || b.StatusClasses[5] != 12 {
+		t.Errorf("Broken backend stats are wrong: %+v", b)
+	}
+	if b := bs[ok.URL]; b.Requests != 11 || b.Errors != 0 || b.StatusClasses[2] != 10 {
+		t.Errorf("OK backend stats are wrong: %+v", b)
+	}
+
+	var tc trafficCounter
+	for i := 1; i <= 100; i++ {
+		tc.add(&primaryOutcome{Backend: "x", Status: 200, Latency: time.Duration(i) * time.Millisecond})
+	}
+	st := tc.snapshot()
+	for _, v := range []struct {
+		name     string
+		got, exp time.Duration
+	}{
+		{"P50", st.LatencyP50, 50 * time.Millisecond},
+		{"P90", st.LatencyP90, 90 * time.Millisecond},
+		{"P99", st.LatencyP99, 99 * time.Millisecond},
+	} {
+		if v.got < v.exp || float64(v.got) > float64(v.exp)*math.Sqrt2 {
+			t.Errorf("%s is %s; expected %s within one bucket", v.name, v.got, v.exp)
+		}
+	}
+
+	lb.ResetStats()
+	if len(lb.RouteStats()) != 0 || lb.BackendStats()[ok.URL].Requests != 0 {
+		t.Errorf("Stats weren't reset")
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = &countingWriter{ResponseWriter: rec}
+	w.Write([]byte("hello"))
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("countingWriter isn't an http.Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("Flush wasn't passed on")
+	}
+	if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+		t.Error("Hijacked a ResponseRecorder")
+	}
+	if n := w.(*countingWriter).written(); n != 5 {
+		t.Errorf("Counted %d bytes; expected 5", n)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultMirrorMaxBodySize = 1 << 20
+	DefaultMirrorTimeout     = 30 * time.Second
+)
+
+// A Mirror makes a LoadBalancerHandler copy the requests for a route to a shadow
+// pool, i.e. another route. Shadow responses are discarded, and never delay or
+// affect the responses clients get; OnResult, if set, is called with each pair of
+// primary and shadow responses so the two can be compared.
+type Mirror struct {
+	Route       string        // Key in Routes of the shadow pool
+	MaxBodySize int64         // Requests with larger bodies aren't mirrored. 0 means DefaultMirrorMaxBodySize
+	MaxInFlight int           // Shadow requests are dropped while this many are in flight. 0 means no limit
+	Timeout     time.Duration // 0 means DefaultMirrorTimeout
+	OnResult    func(*MirrorResult)
+}
+
+// MirrorResult compares the primary and shadow responses to a mirrored request.
+// Statuses are 0 if no response was received.
+type MirrorResult struct {
+	Time           time.Time
+	Route          string
+	ShadowRoute    string
+	Method         string
+	URL            string
+	PrimaryBackend string
+	PrimaryStatus  int
+	PrimaryLatency time.Duration // Time until the response headers were received
+	PrimaryError   string
+	ShadowBackend  string
+	ShadowStatus   int
+	ShadowLatency  time.Duration
+	ShadowError    string
+}
+
+// SetMirror makes the load balancer copy the requests for the route to the
+// shadow pool described by m. A nil m stops mirroring.
+func (lb *LoadBalancerHandler) SetMirror(route string, m *Mirror) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if m == nil {
+		delete(lb.Mirrors, route)
+	} else {
+		lb.Mirrors[route] = m
+	}
+}
+
+// primaryOutcome describes how a request was handled by a LoadBalancerHandler.
+type primaryOutcome struct {
+	Backend  string // Empty if no backend was tried
+	Status   int    // 0 if there was no response
+	Latency  time.Duration
+	Err      error
+	BytesIn  int64
+	BytesOut int64
+}
+
+type mirrorSession struct {
+	lb      *LoadBalancerHandler
+	m       *Mirror
+	route   string
+	req     *http.Request // The shadow request
+	path    string
+	rt      http.RoundTripper // Used if the shadow pool has no TLS settings
+	primary chan primaryOutcome
+}
+
+// startMirror sends a copy of s's request to the shadow pool of its route, if it
+// has one, and returns the mirrorSession to report the primary outcome to. It
+// buffers the request body so that it can be sent twice.
+func (lb *LoadBalancerHandler) startMirror(s *ProxySession) *mirrorSession {
+	req := s.Request
+	lb.mu.Lock()
+	route := lb.matchRoute(req)
+	m, found := lb.Mirrors[route]
+	if !found || (m.MaxInFlight > 0 && lb.mirroring[route] >= m.MaxInFlight) {
+		lb.mu.Unlock()
+		return nil
+	}
+	lb.mirroring[route]++
+	lb.mu.Unlock()
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		max := m.MaxBodySize
+		if max <= 0 {
+			max = DefaultMirrorMaxBodySize
+		}
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+		if err != nil || int64(len(body)) > max {
+			// Too big (or broken) to mirror; put back what was read
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			lb.endMirror(route)
+			return nil
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sreq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		lb.endMirror(route)
+		return nil
+	}
+	for k, v := range req.Header {
+		sreq.Header[k] = append([]string{}, v...)
+	}
+	sreq.Host = req.Host
+	sreq.RemoteAddr = req.RemoteAddr
+	ms := &mirrorSession{
+		lb:      lb,
+		m:       m,
+		route:   route,
+		req:     sreq,
+		path:    req.URL.Path,
+		rt:      s.Ps.client.Transport,
+		primary: make(chan primaryOutcome, 1),
+	}
+	go ms.run()
+	return ms
+}
+
+func (lb *LoadBalancerHandler) endMirror(route string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.mirroring[route]--
+}
+
+// finish reports the outcome of the primary request. ms may be nil.
+func (ms *mirrorSession) finish(po *primaryOutcome) {
+	if ms == nil {
+		return
+	}
+	ms.primary <- *po
+}
+
+func (ms *mirrorSession) run() {
+	defer ms.lb.endMirror(ms.route)
+	res := &MirrorResult{
+		Time:        time.Now(),
+		Route:       ms.route,
+		ShadowRoute: ms.m.Route,
+		Method:      ms.req.Method,
+		URL:         ms.req.URL.RequestURI(),
+	}
+	ms.lb.mu.Lock()
+	dest, err := ms.lb.pick(ms.m.Route, ms.req, nil)
+	ms.lb.mu.Unlock()
+	if err != nil {
+		res.ShadowError = err.Error()
+	} else {
+		res.ShadowBackend = dest
+		var rt http.RoundTripper = ms.rt
+		if t := ms.lb.target(ms.req, ms.m.Route, dest, ms.path); t != nil {
+			rt = t
+		}
+		timeout := ms.m.Timeout
+		if timeout <= 0 {
+			timeout = DefaultMirrorTimeout
+		}
+		c := &http.Client{
+			Transport: rt,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		start := time.Now()
+		sres, err := c.Do(ms.req)
+		res.ShadowLatency = time.Since(start)
+		if err != nil {
+			res.ShadowError = err.Error()
+		} else {
+			res.ShadowStatus = sres.StatusCode
+			io.Copy(ioutil.Discard, sres.Body)
+			sres.Body.Close()
+		}
+		ms.lb.release(dest)
+	}
+	po := <-ms.primary
+	res.PrimaryBackend = po.Backend
+	res.PrimaryStatus = po.Status
+	res.PrimaryLatency = po.Latency
+	if po.Err != nil {
+		res.PrimaryError = po.Err.Error()
+	}
+	if ms.m.OnResult != nil {
+		ms.m.OnResult(res)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	retryBudgetWindow = 10 * time.Second
+)
+
+// OutlierDetection passively ejects a backend from rotation for EjectionTime after
+// it has failed ConsecutiveFailures proxied requests in a row. A request fails if
+// the backend can't be reached, or if it responds with a 5xx status code.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+}
+
+// RetryPolicy makes a LoadBalancerHandler retry idempotent requests that fail on
+// another backend from the same route. To keep a failing pool from being flooded,
+// retries are limited to Budget times the number of requests (plus MinRetries)
+// every 10 seconds.
+type RetryPolicy struct {
+	Attempts   int     // Maximum number of retries per request
+	Budget     float64 // e.g. 0.2 to allow retries to add at most 20% extra load
+	MinRetries int     // Retries always allowed per window regardless of Budget
+}
+
+type retryBudget struct {
+	start    time.Time
+	requests int
+	retries  int
+	mu       *sync.Mutex
+}
+
+func (rb *retryBudget) reset(now time.Time) {
+	if now.Sub(rb.start) >= retryBudgetWindow {
+		rb.start = now
+		rb.requests = 0
+		rb.retries = 0
+	}
+}
+
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.reset(time.Now())
+	rb.requests++
+}
+
+// withdraw reports whether a retry is allowed, and counts it if it is.
+func (rb *retryBudget) withdraw(rp *RetryPolicy) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.reset(time.Now())
+	if rb.retries >= rp.MinRetries && float64(rb.retries) >= rp.Budget*float64(rb.requests) {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{
+		start: time.Now(),
+		mu:    &sync.Mutex{},
+	}
+}
+
+// recordResult updates the passive outlier detection state of the backend addr
+// after a proxied request.
+func (lb *LoadBalancerHandler) recordResult(addr string, failed bool) {
+	od := lb.OutlierDetection
+	if od == nil {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b := lb.getBackend(addr)
+	if b == nil {
+		return
+	}
+	if !failed {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if od.ConsecutiveFailures > 0 && b.consecutiveFailures >= od.ConsecutiveFailures {
+		b.consecutiveFailures = 0
+		b.ejectedUntil = time.Now().Add(od.EjectionTime)
+		b.start = b.ejectedUntil // slow start once it's back
+	}
+}
+
+// isIdempotent reports whether req can safely be sent again. Requests with a body
+// are never retried since the body has already been consumed.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	default:
+		return false
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	}
+	return req.ContentLength == 0 && (req.Body == nil || req.Body == http.NoBody)
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
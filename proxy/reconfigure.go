@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"time"
+)
+
+const (
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// ListRoutes returns a copy of the load balancer's routes.
+func (lb *LoadBalancerHandler) ListRoutes() map[string][]string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := make(map[string][]string, len(lb.Routes))
+	for k, v := range lb.Routes {
+		res[k] = append([]string{}, v...)
+	}
+	return res
+}
+
+// SetRoute replaces the backends of the route, creating it if it doesn't exist.
+// Backends that are no longer used by any route are drained in the background.
+func (lb *LoadBalancerHandler) SetRoute(route string, addrs []string) {
+	lb.mu.Lock()
+	old := lb.Routes[route]
+	lb.Routes[route] = append([]string{}, addrs...)
+	lb.updateRouteHosts()
+	delete(lb.rrWeights, route)
+	for _, v := range addrs {
+		lb.addBackend(v)
+	}
+	removed := lb.unused(old)
+	lb.mu.Unlock()
+	for _, v := range removed {
+		go lb.drain(v, 0)
+	}
+}
+
+// RemoveRoute removes the route, draining its backends in the background if they
+// aren't used by any other route.
+func (lb *LoadBalancerHandler) RemoveRoute(route string) {
+	lb.mu.Lock()
+	old := lb.Routes[route]
+	delete(lb.Routes, route)
+	lb.updateRouteHosts()
+	delete(lb.rrWeights, route)
+	removed := lb.unused(old)
+	lb.mu.Unlock()
+	for _, v := range removed {
+		go lb.drain(v, 0)
+	}
+}
+
+// AddBackend adds addr to the route, creating the route if it doesn't exist. If
+// addr is draining, it is put back in rotation.
+func (lb *LoadBalancerHandler) AddBackend(route, addr string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if !contains(lb.Routes[route], addr) {
+		lb.Routes[route] = append(append([]string{}, lb.Routes[route]...), addr)
+		lb.updateRouteHosts()
+	}
+	lb.addBackend(addr)
+}
+
+// RemoveBackend stops sending new requests for the route to addr. If addr isn't
+// used by any other route, RemoveBackend waits until its in-flight requests have
+// completed, or until timeout has passed if timeout is more than 0, then forgets
+// about it. It returns false if the backend still had in-flight requests when it
+// was forgotten.
+func (lb *LoadBalancerHandler) RemoveBackend(route, addr string, timeout time.Duration) bool {
+	return <-lb.RemoveBackendAsync(route, addr, timeout)
+}
+
+// RemoveBackendAsync is like RemoveBackend, but returns as soon as addr has been
+// taken out of the route, and drains it in the background. What RemoveBackend
+// would have returned is sent on the returned channel.
+func (lb *LoadBalancerHandler) RemoveBackendAsync(route, addr string, timeout time.Duration) <-chan bool {
+	res := make(chan bool, 1)
+	lb.mu.Lock()
+	ds := lb.Routes[route]
+	if !contains(ds, addr) {
+		lb.mu.Unlock()
+		res <- true
+		return res
+	}
+	nds := make([]string, 0, len(ds)-1)
+	for _, v := range ds {
+		if v != addr {
+			nds = append(nds, v)
+		}
+	}
+	if len(nds) == 0 {
+		delete(lb.Routes, route)
+		lb.updateRouteHosts()
+	} else {
+		lb.Routes[route] = nds
+	}
+	removed := lb.unused([]string{addr})
+	lb.mu.Unlock()
+	if len(removed) == 0 {
+		res <- true
+		return res
+	}
+	go func() {
+		res <- lb.drain(addr, timeout)
+	}()
+	return res
+}
+
+// addBackend makes sure addr is known and not draining. lb.mu must be held.
+func (lb *LoadBalancerHandler) addBackend(addr string) {
+	b := lb.newBackend(addr)
+	if b.draining {
+		b.draining = false
+		b.start = time.Now()
+	}
+	lb.startHealthCheck(b)
+}
+
+// unused marks the backends in addrs that aren't part of any route as draining,
+// and returns them. lb.mu must be held.
+func (lb *LoadBalancerHandler) unused(addrs []string) []string {
+	var res []string
+	for _, v := range addrs {
+		used := false
+		for _, ds := range lb.Routes {
+			if contains(ds, v) {
+				used = true
+				break
+			}
+		}
+		if b := lb.getBackend(v); !used && b != nil {
+			b.draining = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// drain waits for the draining backend addr to finish its in-flight requests, then
+// forgets about it, unless it was added back in the meantime.
+func (lb *LoadBalancerHandler) drain(addr string, timeout time.Duration) bool {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		lb.mu.Lock()
+		b, found := lb.backends[addr]
+		if !found || !b.draining {
+			lb.mu.Unlock()
+			return true
+		}
+		idle := b.active == 0
+		if idle || (!deadline.IsZero() && time.Now().After(deadline)) {
+			stopHealthCheck(b)
+			delete(lb.backends, addr)
+			lb.mu.Unlock()
+			return idle
+		}
+		lb.mu.Unlock()
+		time.Sleep(drainPollInterval)
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A ReverseRoute maps requests for a public host and path prefix to an upstream
+// origin when a ProxyServer is running in reverse proxy mode.
+type ReverseRoute struct {
+	Host         string   // Public hostname, without port. Empty matches any host
+	PathPrefix   string   // Public path prefix, e.g. "/app/". Empty matches any path
+	Origin       *url.URL // Upstream origin, e.g. http://10.0.0.5:8080/internal/
+	StripPrefix  bool     // Remove PathPrefix before appending the path to Origin.Path
+	PreserveHost bool     // Send the public Host header to the origin instead of Origin.Host
+}
+
+func NewReverseRoute(host, pathPrefix, origin string) (*ReverseRoute, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid origin URL %s: %s", origin, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported origin scheme in %s", origin)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Origin URL %s has no host", origin)
+	}
+	rr := &ReverseRoute{
+		Host:       strings.ToLower(host),
+		PathPrefix: pathPrefix,
+		Origin:     u,
+	}
+	return rr, nil
+}
+
+func (rr *ReverseRoute) matches(host, path string) bool {
+	if rr.Host != "" && rr.Host != host {
+		return false
+	}
+	return strings.HasPrefix(path, rr.PathPrefix)
+}
+
+// rewriteRequest points req at the route's origin.
+func (rr *ReverseRoute) rewriteRequest(req *http.Request, publicHost, publicScheme string) {
+	p := req.URL.Path
+	if rr.StripPrefix {
+		p = strings.TrimPrefix(p, rr.PathPrefix)
+	}
+	req.URL.Scheme = rr.Origin.Scheme
+	req.URL.Host = rr.Origin.Host
+	req.URL.Path = joinPath(rr.Origin.Path, p)
+	req.URL.RawPath = ""
+	if !rr.PreserveHost {
+		req.Host = rr.Origin.Host
+	}
+	req.Header.Set("X-Forwarded-Host", publicHost)
+	req.Header.Set("X-Forwarded-Proto", publicScheme)
+}
+
+// rewriteResponse changes Location, Content-Location and Set-Cookie headers that
+// refer to the origin so that they refer to the public host instead.
+func (rr *ReverseRoute) rewriteResponse(res *http.Response, publicHost, publicScheme string) {
+	for _, k := range []string{"Location", "Content-Location"} {
+		v := res.Header.Get(k)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		if u.Host == "" {
+			// Relative to the origin; only the path needs to be mapped back
+			if strings.HasPrefix(u.Path, "/") {
+				u.Path = rr.publicPath(u.Path)
+				u.RawPath = ""
+				res.Header.Set(k, u.String())
+			}
+			continue
+		}
+		if !strings.EqualFold(u.Host, rr.Origin.Host) {
+			continue
+		}
+		u.Scheme = publicScheme
+		u.Host = publicHost
+		u.Path = rr.publicPath(u.Path)
+		u.RawPath = ""
+		res.Header.Set(k, u.String())
+	}
+	cookies := res.Header["Set-Cookie"]
+	for i, v := range cookies {
+		cookies[i] = rr.rewriteSetCookie(v, publicHost)
+	}
+}
+
+// rewriteSetCookie replaces the Domain and Path attributes of a Set-Cookie header
+// value if they refer to the origin, leaving all other attributes untouched.
+func (rr *ReverseRoute) rewriteSetCookie(v, publicHost string) string {
+	originHost := stripPort(rr.Origin.Host)
+	publicHost = stripPort(publicHost)
+	parts := strings.Split(v, ";")
+	for i, part := range parts {
+		if i == 0 {
+			continue // name=value
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		val := strings.TrimSpace(kv[1])
+		switch name {
+		case "domain":
+			if strings.EqualFold(strings.TrimPrefix(val, "."), originHost) {
+				d := publicHost
+				if strings.HasPrefix(val, ".") {
+					d = "." + d
+				}
+				parts[i] = " Domain=" + d
+			}
+		case "path":
+			if strings.HasPrefix(val, "/") {
+				parts[i] = " Path=" + rr.publicPath(val)
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// publicPath maps a path on the origin back to the corresponding public path.
+func (rr *ReverseRoute) publicPath(p string) string {
+	op := strings.TrimSuffix(rr.Origin.Path, "/")
+	if op != "" {
+		if p != op && !strings.HasPrefix(p, op+"/") {
+			return p
+		}
+		p = strings.TrimPrefix(p, op)
+	}
+	if rr.StripPrefix {
+		p = joinPath(rr.PathPrefix, p)
+	}
+	if p == "" {
+		p = "/"
+	}
+	return p
+}
+
+func (ps *ProxyServer) matchReverseRoute(req *http.Request) *ReverseRoute {
+	var (
+		host = strings.ToLower(stripPort(req.Host))
+		best *ReverseRoute
+	)
+	for _, rr := range ps.ReverseRoutes {
+		if !rr.matches(host, req.URL.Path) {
+			continue
+		}
+		// Host-specific routes beat catch-alls, then the longest prefix wins
+		if best == nil || (best.Host == "" && rr.Host != "") || (best.Host == rr.Host && len(rr.PathPrefix) > len(best.PathPrefix)) {
+			best = rr
+		}
+	}
+	return best
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	as := strings.HasSuffix(a, "/")
+	bs := strings.HasPrefix(b, "/")
+	switch {
+	case as && bs:
+		return a + b[1:]
+	case !as && !bs:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
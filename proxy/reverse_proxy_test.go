@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+type originServer struct {
+	Addr string
+}
+
+func (o *originServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("X-Path", req.URL.Path)
+	h.Set("X-Host", req.Host)
+	h.Set("X-Forwarded-Host", req.Header.Get("X-Forwarded-Host"))
+	h.Set("Location", "http://"+o.Addr+"/internal/login?next=1")
+	h.Add("Set-Cookie", "sid=abc; Domain=127.0.0.1; Path=/internal/; HttpOnly")
+	w.WriteHeader(http.StatusFound)
+}
+
+func TestReverseProxy(t *testing.T) {
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ol.Close()
+	origin := &originServer{Addr: ol.Addr().String()}
+	go (&http.Server{Handler: origin}).Serve(ol)
+
+	rr, err := NewReverseRoute("app.example.com", "/app/", "http://"+origin.Addr+"/internal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.StripPrefix = true
+	other, _ := NewReverseRoute("", "/", "http://127.0.0.1:1/")
+	ps := &ProxyServer{
+		ReverseProxy:  true,
+		ReverseRoutes: []*ReverseRoute{other, rr},
+		Handler:       passThroughHandler{},
+	}
+	srv, _ := ps.getServer()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/app/page", nil)
+	req.Host = "app.example.com:8080"
+	res, err := GetNoProxyClient().Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]string{
+		"X-Path":           "/internal/page",
+		"X-Host":           origin.Addr,
+		"X-Forwarded-Host": "app.example.com:8080",
+		"Location":         "http://app.example.com:8080/app/login?next=1",
+		"Set-Cookie":       "sid=abc; Domain=app.example.com; Path=/app/; HttpOnly",
+	}
+	for k, v := range checks {
+		if got := res.Header.Get(k); got != v {
+			t.Errorf("%s is %q; expected %q", k, got, v)
+		}
+	}
+}
+
+// The client is added to X-Forwarded-For once, even when a reverse proxy hands
+// requests to a load balancer
+func TestReverseProxyForwardedFor(t *testing.T) {
+	backend, err := GetTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	rr, err := NewReverseRoute("", "/", "http://origin.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &ProxyServer{
+		ReverseProxy:  true,
+		ReverseRoutes: []*ReverseRoute{rr},
+		Handler:       NewHTTPLoadBalancer(map[string][]string{"origin.example.com": {backend.Addr}}, StrategyFirst),
+	}
+	srv, _ := ps.getServer()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go srv.Serve(pl)
+
+	got := make(chan []string, 1)
+	go func() {
+		got <- (<-backend.ch).Header["X-Forwarded-For"]
+	}()
+	req, _ := http.NewRequest("GET", "http://"+pl.Addr().String()+"/", nil)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	res, err := GetNoProxyClient().Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if xff := <-got; len(xff) != 1 || xff[0] != "192.0.2.1, 127.0.0.1" {
+		t.Errorf("X-Forwarded-For is %q; expected %q", xff, "192.0.2.1, 127.0.0.1")
+	}
+}
+
+type passThroughHandler struct{}
+
+func (h passThroughHandler) HandleProxy(s *ProxySession) {
+	s.Do()
+}
+
+func TestTLSTermination(t *testing.T) {
+	folder, err := ioutil.TempDir("", "sniffy-certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	backend, err := GetTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		req := <-backend.ch
+		if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") != "https" {
+			t.Error("Backend did not receive a plain HTTP request forwarded from HTTPS")
+		}
+	}()
+
+	routes := map[string][]string{"a.example.com": {backend.Addr}}
+	ps := &ProxyServer{
+		Handler:   NewHTTPLoadBalancer(routes, StrategyFirst),
+		CertStore: NewGeneratedCertStore(folder, nil),
+	}
+	srv, _ := ps.getTLSServer()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go srv.ServeTLS(pl, "", "")
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		conn, err := tls.Dial("tcp", pl.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if cn != name {
+			t.Errorf("Client asking for %s got a certificate for %s", name, cn)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "https://"+pl.Addr().String()+"/", nil)
+	req.Host = "a.example.com"
+	c := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "a.example.com",
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-This-Is") != backend.Addr {
+		t.Errorf("Request was not forwarded to %s", backend.Addr)
+	}
+}
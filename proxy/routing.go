@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A RouteMatch sends the requests it matches to one of a LoadBalancerHandler's
+// routes. Every Routes key also acts as a match on the host it names, so routes
+// only need RouteMatches for anything more elaborate than a host lookup.
+//
+// Host may be an exact name like "example.com", a wildcard like "*.example.com"
+// (matching any subdomain, however deep, but not example.com itself), or empty
+// or "*" to match any host. A Routes key of "*" is therefore the default route.
+// Ports are ignored on both sides.
+//
+// When several RouteMatches match a request, the one with the highest Priority
+// wins. Among those, an exact host beats a wildcard, which beats any host, and a
+// longer wildcard beats a shorter one. Then the longest PathPrefix wins, then a
+// match with a PathRegexp, then one with a Header. Any remaining tie goes to the
+// match that comes first in Matches, and explicit matches come before the Routes
+// keys (which are ordered alphabetically).
+type RouteMatch struct {
+	Route       string         // Key in Routes of the backends to use
+	Priority    int            // Matches with higher priorities are preferred
+	Host        string         // See above
+	PathPrefix  string         // e.g. "/api/"
+	PathRegexp  *regexp.Regexp // Matched against the request path
+	Header      string         // Request header that must be present
+	HeaderValue string         // Required value of Header. Empty matches any value
+}
+
+func NewRouteMatch(route, host, pathPrefix string) *RouteMatch {
+	m := RouteMatch{
+		Route:      route,
+		Host:       hostPattern(normalizeHost(host)),
+		PathPrefix: pathPrefix,
+	}
+	return &m
+}
+
+func (m *RouteMatch) matches(host string, req *http.Request) bool {
+	if !hostMatches(m.Host, host) {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if m.PathRegexp != nil && !m.PathRegexp.MatchString(req.URL.Path) {
+		return false
+	}
+	if m.Header != "" {
+		vs, found := req.Header[http.CanonicalHeaderKey(m.Header)]
+		if !found {
+			return false
+		}
+		if m.HeaderValue != "" && !contains(vs, m.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// beats reports whether m takes precedence over o when both match a request.
+func (m *RouteMatch) beats(o *RouteMatch) bool {
+	if m.Priority != o.Priority {
+		return m.Priority > o.Priority
+	}
+	mh, oh := hostPattern(m.Host), hostPattern(o.Host)
+	if mr, or := hostRank(mh), hostRank(oh); mr != or {
+		return mr > or
+	}
+	if len(mh) != len(oh) {
+		return len(mh) > len(oh)
+	}
+	if len(m.PathPrefix) != len(o.PathPrefix) {
+		return len(m.PathPrefix) > len(o.PathPrefix)
+	}
+	if (m.PathRegexp != nil) != (o.PathRegexp != nil) {
+		return m.PathRegexp != nil
+	}
+	if (m.Header != "") != (o.Header != "") {
+		return m.Header != ""
+	}
+	return false
+}
+
+// SetMatches replaces the load balancer's RouteMatches.
+func (lb *LoadBalancerHandler) SetMatches(ms []*RouteMatch) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.Matches = append([]*RouteMatch{}, ms...)
+}
+
+// ListMatches returns a copy of the load balancer's RouteMatches.
+func (lb *LoadBalancerHandler) ListMatches() []*RouteMatch {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return append([]*RouteMatch{}, lb.Matches...)
+}
+
+// matchRoute returns the name of the route req should be sent to, or an empty
+// string if there is none. lb.mu must be held.
+func (lb *LoadBalancerHandler) matchRoute(req *http.Request) string {
+	host := normalizeHost(req.Host)
+	var best *RouteMatch
+	for _, m := range lb.Matches {
+		if m.matches(host, req) && (best == nil || m.beats(best)) {
+			best = m
+		}
+	}
+	for _, m := range lb.routeHosts {
+		if m.matches(host, req) && (best == nil || m.beats(best)) {
+			best = m
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Route
+}
+
+// updateRouteHosts rebuilds the matches on the hosts the Routes keys name, in
+// alphabetical order. It must be called whenever a route is added or removed.
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) updateRouteHosts() {
+	keys := make([]string, 0, len(lb.Routes))
+	for k := range lb.Routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lb.routeHosts = make([]*RouteMatch, len(keys))
+	for i, k := range keys {
+		lb.routeHosts[i] = &RouteMatch{
+			Route: k,
+			Host:  hostPattern(normalizeHost(k)),
+		}
+	}
+}
+
+// hostPattern returns "" for "*", which, like "", matches any host, and pattern
+// otherwise.
+func hostPattern(pattern string) string {
+	if pattern == "*" {
+		return ""
+	}
+	return pattern
+}
+
+func hostMatches(pattern, host string) bool {
+	pattern = hostPattern(pattern)
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func hostRank(pattern string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case strings.HasPrefix(pattern, "*."):
+		return 1
+	}
+	return 2
+}
+
+// normalizeHost lowercases host and removes its port and any trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(stripPort(host)), ".")
+}
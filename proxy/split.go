@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// A Split sends part of a route's traffic to another route, e.g. for a canary
+// release. A request goes to the other route if it has the given header or cookie,
+// or otherwise with a probability of Percent. The route's strategy, health checks
+// and so on apply to both groups as usual.
+type Split struct {
+	Route       string  // Key in Routes of the canary group
+	Percent     float64 // Share of the other requests, from 0 to 100
+	Header      string  // e.g. "X-Canary"
+	HeaderValue string  // Empty matches any value
+	Cookie      string
+	CookieValue string // Empty matches any value
+}
+
+func (sp *Split) selects(req *http.Request) bool {
+	if sp.Header != "" {
+		if vs, found := req.Header[http.CanonicalHeaderKey(sp.Header)]; found && (sp.HeaderValue == "" || contains(vs, sp.HeaderValue)) {
+			return true
+		}
+	}
+	if sp.Cookie != "" {
+		if c, err := req.Cookie(sp.Cookie); err == nil && (sp.CookieValue == "" || c.Value == sp.CookieValue) {
+			return true
+		}
+	}
+	return sp.Percent > 0 && rand.Float64()*100 < sp.Percent
+}
+
+// SetSplit makes the load balancer send part of the route's traffic to the route
+// sp.Route. A nil sp sends all of it to the route itself again.
+func (lb *LoadBalancerHandler) SetSplit(route string, sp *Split) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if sp == nil {
+		delete(lb.Splits, route)
+	} else {
+		lb.Splits[route] = sp
+	}
+}
+
+// ListSplits returns a copy of the load balancer's Splits.
+func (lb *LoadBalancerHandler) ListSplits() map[string]Split {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := make(map[string]Split, len(lb.Splits))
+	for k, v := range lb.Splits {
+		res[k] = *v
+	}
+	return res
+}
+
+// routeFor returns the name of the route, or canary group, that req should be
+// sent to. lb.mu must be held.
+func (lb *LoadBalancerHandler) routeFor(req *http.Request) string {
+	k := lb.matchRoute(req)
+	if sp, found := lb.Splits[k]; found && len(lb.Routes[sp.Route]) > 0 && sp.selects(req) {
+		return sp.Route
+	}
+	return k
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyBuckets  = 48
+	minLatencyBound = 100 * time.Microsecond
+)
+
+// Upper bounds of the latency histogram buckets, growing by a factor of √2 from
+// 100µs to about 20 minutes
+var latencyBounds [latencyBuckets]time.Duration
+
+func init() {
+	for i := range latencyBounds {
+		latencyBounds[i] = time.Duration(float64(minLatencyBound) * math.Pow(2, float64(i)/2))
+	}
+}
+
+// TrafficStats summarizes the requests handled by a route or backend of a
+// LoadBalancerHandler since it was created, or since ResetStats was called.
+// Latencies are the time until the response headers were received, and the
+// percentiles are accurate to within about 40%.
+type TrafficStats struct {
+	Requests      int64
+	Errors        int64    // Requests that got no response, or a 5xx response
+	StatusClasses [6]int64 // Responses by class, e.g. [2] counts 2xx. [0] counts requests without a response
+	BytesIn       int64    // Request body bytes
+	BytesOut      int64    // Response bytes sent to clients
+	LatencyP50    time.Duration
+	LatencyP90    time.Duration
+	LatencyP99    time.Duration
+}
+
+func (ts TrafficStats) ErrorRate() float64 {
+	if ts.Requests == 0 {
+		return 0
+	}
+	return float64(ts.Errors) / float64(ts.Requests)
+}
+
+type trafficCounter struct {
+	requests      int64
+	errors        int64
+	statusClasses [6]int64
+	bytesIn       int64
+	bytesOut      int64
+	latencies     [latencyBuckets]int64
+}
+
+func (tc *trafficCounter) add(po *primaryOutcome) {
+	tc.requests++
+	if po.Err != nil || po.Status >= 500 {
+		tc.errors++
+	}
+	class := po.Status / 100
+	if po.Err != nil || class < 1 || class > 5 {
+		class = 0
+	}
+	tc.statusClasses[class]++
+	tc.bytesIn += po.BytesIn
+	tc.bytesOut += po.BytesOut
+	if class != 0 && po.Backend != "" {
+		i := 0
+		for i < latencyBuckets-1 && po.Latency > latencyBounds[i] {
+			i++
+		}
+		tc.latencies[i]++
+	}
+}
+
+// percentile returns the upper bound of the bucket containing the p'th (0-1)
+// percentile of the sampled latencies, or 0 if there are none.
+func (tc *trafficCounter) percentile(p float64) time.Duration {
+	var total int64
+	for _, v := range tc.latencies {
+		total += v
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	var seen int64
+	for i, v := range tc.latencies {
+		seen += v
+		if seen >= rank {
+			return latencyBounds[i]
+		}
+	}
+	return latencyBounds[latencyBuckets-1]
+}
+
+func (tc *trafficCounter) snapshot() TrafficStats {
+	return TrafficStats{
+		Requests:      tc.requests,
+		Errors:        tc.errors,
+		StatusClasses: tc.statusClasses,
+		BytesIn:       tc.bytesIn,
+		BytesOut:      tc.bytesOut,
+		LatencyP50:    tc.percentile(0.5),
+		LatencyP90:    tc.percentile(0.9),
+		LatencyP99:    tc.percentile(0.99),
+	}
+}
+
+// RouteStats returns the traffic stats of every route that has received requests.
+// Requests that were sent to a canary group are counted for the group's route.
+func (lb *LoadBalancerHandler) RouteStats() map[string]TrafficStats {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := make(map[string]TrafficStats, len(lb.routeStats))
+	for k, v := range lb.routeStats {
+		res[k] = v.snapshot()
+	}
+	return res
+}
+
+// BackendStats returns the traffic stats of every backend. Unlike the route stats,
+// these count every attempt of a retried request.
+func (lb *LoadBalancerHandler) BackendStats() map[string]TrafficStats {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	res := make(map[string]TrafficStats, len(lb.backends))
+	for k, v := range lb.backends {
+		res[k] = v.stats.snapshot()
+	}
+	return res
+}
+
+func (lb *LoadBalancerHandler) ResetStats() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.routeStats = map[string]*trafficCounter{}
+	for _, v := range lb.backends {
+		v.stats = trafficCounter{}
+	}
+}
+
+// count adds po to the stats of the route, if it isn't empty, and of the backend
+// that was tried, if any.
+func (lb *LoadBalancerHandler) count(route string, po *primaryOutcome) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if route != "" {
+		tc, found := lb.routeStats[route]
+		if !found {
+			tc = &trafficCounter{}
+			lb.routeStats[route] = tc
+		}
+		tc.add(po)
+	}
+	if po.Backend != "" {
+		if b, found := lb.backends[po.Backend]; found {
+			b.stats.add(po)
+		}
+	}
+}
+
+// countingWriter counts the bytes written to an http.ResponseWriter, including
+// those written to the connection after it has been hijacked.
+type countingWriter struct {
+	http.ResponseWriter
+	n        int64
+	hijacked bool
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+// written returns the number of bytes written so far.
+func (cw *countingWriter) written() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", cw.ResponseWriter)
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	cw.hijacked = true
+	if err = brw.Flush(); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	cc := &countingConn{Conn: c, n: &cw.n}
+	return cc, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(cc)), nil
+}
+
+// countingConn adds the bytes written to a hijacked connection to n.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddInt64(cc.n, int64(n))
+	return n, err
+}
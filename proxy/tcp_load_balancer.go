@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTCPDialTimeout = 10 * time.Second
+)
+
+// A TCPLoadBalancer accepts TCP connections and splices each of them to one of the
+// backends of a route of a LoadBalancerHandler, which provides the strategy,
+// weights, health checks and outlier detection. Backends that can't be connected
+// to are skipped, and the next one is tried. Strategies that look at HTTP requests
+// fall back to hashing on nothing (StrategyHash) or round robin (StrategyStickyCookie).
+// Health checks with an empty Path only check that a connection can be made, and
+// StrategyLatency uses the time it takes to connect.
+type TCPLoadBalancer struct {
+	Host        string
+	Port        uint16
+	Balancer    *LoadBalancerHandler
+	Route       string // Key in Balancer.Routes of the backends to use
+	DialTimeout time.Duration
+	OnClose     func(*TCPConnStats) // Called when a connection has been closed
+	stats       TCPStats
+	l           net.Listener
+	mu          *sync.Mutex
+}
+
+// TCPConnStats describes a connection handled by a TCPLoadBalancer.
+type TCPConnStats struct {
+	Client   string
+	Backend  string // Empty if no backend could be connected to
+	Start    time.Time
+	Duration time.Duration
+	BytesIn  int64 // From the client to the backend
+	BytesOut int64 // From the backend to the client
+	Error    string
+}
+
+// TCPStats counts the connections handled by a TCPLoadBalancer.
+type TCPStats struct {
+	Connections int64
+	Active      int64
+	Failed      int64 // Connections that couldn't be sent to any backend
+	BytesIn     int64
+	BytesOut    int64
+}
+
+func (tl *TCPLoadBalancer) ListenAndServe() error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", tl.Host, tl.Port))
+	if err != nil {
+		return err
+	}
+	return tl.Serve(l)
+}
+
+// Serve accepts connections on l until it is closed.
+func (tl *TCPLoadBalancer) Serve(l net.Listener) error {
+	tl.mu.Lock()
+	tl.l = l
+	tl.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go tl.handle(c)
+	}
+}
+
+// Close stops accepting new connections. Established connections are left open.
+func (tl *TCPLoadBalancer) Close() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.l == nil {
+		return nil
+	}
+	return tl.l.Close()
+}
+
+// Stats returns the connection counters.
+func (tl *TCPLoadBalancer) Stats() TCPStats {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.stats
+}
+
+// dial connects to a backend, trying every available one until a connection is
+// made. The returned backend must be released.
+func (tl *TCPLoadBalancer) dial(client string) (net.Conn, string, error) {
+	var (
+		lb    = tl.Balancer
+		tried []string
+		// Only RemoteAddr matters to the strategies
+		req = &http.Request{
+			Method:     "CONNECT",
+			URL:        &url.URL{},
+			Header:     http.Header{},
+			RemoteAddr: client,
+		}
+		timeout = tl.DialTimeout
+	)
+	if timeout <= 0 {
+		timeout = DefaultTCPDialTimeout
+	}
+	for {
+		lb.mu.Lock()
+		dest, err := lb.pick(tl.Route, req, tried)
+		var addr string
+		if err == nil {
+			addr = lb.backendURL(dest).Host
+		}
+		lb.mu.Unlock()
+		if err != nil {
+			return nil, "", err
+		}
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		lb.recordResult(dest, err != nil)
+		if err == nil {
+			lb.recordLatency(dest, time.Since(start))
+			return conn, dest, nil
+		}
+		lb.release(dest)
+		tried = append(tried, dest)
+	}
+}
+
+func (tl *TCPLoadBalancer) handle(c net.Conn) {
+	cs := &TCPConnStats{
+		Client: c.RemoteAddr().String(),
+		Start:  time.Now(),
+	}
+	tl.mu.Lock()
+	tl.stats.Connections++
+	tl.stats.Active++
+	tl.mu.Unlock()
+	defer tl.closed(cs)
+
+	dest, backend, err := tl.dial(cs.Client)
+	if err != nil {
+		c.Close()
+		cs.Error = err.Error()
+		return
+	}
+	cs.Backend = backend
+	defer tl.Balancer.release(backend)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cs.BytesOut, _ = io.Copy(c, dest)
+		closeWrite(c)
+	}()
+	go func() {
+		defer wg.Done()
+		cs.BytesIn, _ = io.Copy(dest, c)
+		closeWrite(dest)
+	}()
+	wg.Wait()
+	c.Close()
+	dest.Close()
+}
+
+func (tl *TCPLoadBalancer) closed(cs *TCPConnStats) {
+	cs.Duration = time.Since(cs.Start)
+	tl.mu.Lock()
+	tl.stats.Active--
+	if cs.Backend == "" {
+		tl.stats.Failed++
+	}
+	tl.stats.BytesIn += cs.BytesIn
+	tl.stats.BytesOut += cs.BytesOut
+	tl.mu.Unlock()
+	if tl.OnClose != nil {
+		tl.OnClose(cs)
+	}
+}
+
+// closeWrite signals EOF to the other end of c while still allowing it to send
+// data, so that each direction of a spliced connection can finish on its own.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+func NewTCPLoadBalancer(lb *LoadBalancerHandler, route string) *TCPLoadBalancer {
+	tl := TCPLoadBalancer{
+		Balancer: lb,
+		Route:    route,
+		mu:       &sync.Mutex{},
+	}
+	return &tl
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// UpstreamTLS holds the TLS settings a LoadBalancerHandler uses to connect to the
+// https backends of a route.
+type UpstreamTLS struct {
+	RootCAs            *x509.CertPool    // CAs to trust. nil means the system's
+	ServerName         string            // Overrides the SNI and the name the certificate is verified against
+	Certificates       []tls.Certificate // Client certificates
+	InsecureSkipVerify bool              // Don't verify certificates at all. For lab setups only
+}
+
+// NewUpstreamTLS loads a CA bundle and a client key pair from PEM files. Any of
+// them may be empty.
+func NewUpstreamTLS(caFile, certFile, keyFile string) (*UpstreamTLS, error) {
+	ut := &UpstreamTLS{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA bundle: %s", err)
+		}
+		ut.RootCAs = x509.NewCertPool()
+		if !ut.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		keypair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load client key pair: %s", err)
+		}
+		ut.Certificates = []tls.Certificate{keypair}
+	}
+	return ut, nil
+}
+
+func (ut *UpstreamTLS) config() *tls.Config {
+	return &tls.Config{
+		RootCAs:            ut.RootCAs,
+		ServerName:         ut.ServerName,
+		Certificates:       ut.Certificates,
+		InsecureSkipVerify: ut.InsecureSkipVerify,
+	}
+}
+
+// ParseBackend parses a backend, which is either an address like "10.0.0.1:80",
+// or a URL like "https://10.0.0.1:8443/app/". The path of a URL is prepended to
+// the paths of the requests sent to the backend.
+func ParseBackend(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		if addr == "" || strings.ContainsAny(addr, "/?#") {
+			return nil, fmt.Errorf("Invalid backend address %q", addr)
+		}
+		return &url.URL{Scheme: "http", Host: addr}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backend URL %s: %s", addr, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported backend scheme in %s", addr)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Backend URL %s has no host", addr)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("Backend URL %s may not have a query or fragment", addr)
+	}
+	return u, nil
+}
+
+// SetTLS sets the TLS settings for the https backends of the route. A nil ut
+// restores the defaults.
+func (lb *LoadBalancerHandler) SetTLS(route string, ut *UpstreamTLS) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if ut == nil {
+		delete(lb.TLS, route)
+	} else {
+		lb.TLS[route] = ut
+	}
+	if t, found := lb.transports[route]; found {
+		t.CloseIdleConnections()
+		delete(lb.transports, route)
+	}
+	// Restart the health checks so they pick up the new settings
+	for _, v := range lb.Routes[route] {
+		if b, found := lb.backends[v]; found && b.stop != nil {
+			stopHealthCheck(b)
+			lb.startHealthCheck(b)
+		}
+	}
+}
+
+// transport returns the transport for requests to the route's backends, or nil if
+// the route uses the default TLS settings. lb.mu must be held.
+func (lb *LoadBalancerHandler) transport(route string) *http.Transport {
+	ut, found := lb.TLS[route]
+	if !found {
+		return nil
+	}
+	t, found := lb.transports[route]
+	if !found {
+		t = &http.Transport{
+			Proxy:             nil,
+			TLSClientConfig:   ut.config(),
+			ForceAttemptHTTP2: true,
+		}
+		lb.transports[route] = t
+	}
+	return t
+}
+
+// backendTLS returns the TLS settings to use when health checking addr: those of
+// the first route, in alphabetical order, that has addr as a backend and TLS
+// settings. lb.mu must be held.
+func (lb *LoadBalancerHandler) backendTLS(addr string) *tls.Config {
+	keys := make([]string, 0, len(lb.TLS))
+	for k := range lb.TLS {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if contains(lb.Routes[k], addr) {
+			return lb.TLS[k].config()
+		}
+	}
+	return nil
+}
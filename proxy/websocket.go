@@ -0,0 +1,487 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xa
+
+	// The number of bytes of each message that is captured. Longer messages are
+	// relayed in full.
+	MaxWebSocketCapture = 1 << 20
+)
+
+// A WebSocketMessage is a message relayed between a WebSocket client and server.
+// Fragmented messages are reassembled, and control frames are messages of their
+// own.
+type WebSocketMessage struct {
+	Time       time.Time
+	FromClient bool
+	Opcode     byte
+	Payload    []byte // Unmasked, and truncated to MaxWebSocketCapture bytes
+	Length     int64  // The length of the whole payload
+	Compressed bool   // The payload is compressed by an extension, e.g. permessage-deflate
+	Modified   bool   // Replaced by ProxySession.WebSocketFilter
+	Dropped    bool   // Dropped by ProxySession.WebSocketFilter
+	Injected   bool   // Sent with ProxySession.SendWebSocketMessage
+}
+
+// OpcodeName returns the name of the message's opcode, e.g. "text".
+func (m *WebSocketMessage) OpcodeName() string {
+	switch m.Opcode {
+	case WebSocketText:
+		return "text"
+	case WebSocketBinary:
+		return "binary"
+	case WebSocketClose:
+		return "close"
+	case WebSocketPing:
+		return "ping"
+	case WebSocketPong:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", m.Opcode)
+}
+
+// IsWebSocketUpgrade reports whether req asks to upgrade the connection to the
+// WebSocket protocol.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayUpgrade sends an upgrade response to the client and relays the upgraded
+// connection in both directions until either side closes it. WebSocket messages
+// are passed through s.WebSocketFilter and to s.WebSocketHandler.
+func (s *ProxySession) relayUpgrade() error {
+	if s.ws == nil {
+		s.ws = newWebSocketRelay()
+	}
+	r := s.ws
+	defer r.close()
+	upstream, ok := s.Response.Body.(io.ReadWriteCloser)
+	if !ok {
+		return fmt.Errorf("Upgrade response from %s has no connection", s.Request.URL.Host)
+	}
+	defer upstream.Close()
+	hj, ok := s.W.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("Can't upgrade a %s connection", s.Request.Proto)
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return fmt.Errorf("Error hijacking HTTP request: %s", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", s.Response.Status)
+	s.Response.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err = brw.Flush(); err != nil {
+		return err
+	}
+
+	r.client = &webSocketConn{w: c, mu: &sync.Mutex{}}
+	r.server = &webSocketConn{w: upstream, mask: true, mu: &sync.Mutex{}}
+	if IsWebSocketUpgrade(s.Request) {
+		r.filter = s.WebSocketFilter
+		if s.WebSocketHandler != nil {
+			mu := &sync.Mutex{}
+			r.handle = func(m *WebSocketMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				s.WebSocketHandler(m)
+			}
+		}
+		close(r.ready)
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- r.relay(r.server, brw.Reader, true)
+	}()
+	go func() {
+		errs <- r.relay(r.client, upstream, false)
+	}()
+	err = <-errs
+	c.Close()
+	upstream.Close()
+	r.close() // Lets a filter that is waiting give up
+	<-errs
+	return err
+}
+
+// SendWebSocketMessage injects a message into the WebSocket connection Do relays,
+// to the client if toClient, or else to the server. It waits for Do to start
+// relaying, and fails if the connection isn't a WebSocket, or has been closed.
+func (s *ProxySession) SendWebSocketMessage(toClient bool, opcode byte, payload []byte) error {
+	r := s.ws
+	if r == nil {
+		return errors.New("Not a WebSocket connection")
+	}
+	select {
+	case <-r.ready:
+	case <-r.done:
+	}
+	select {
+	case <-r.done:
+		return errors.New("The WebSocket connection is closed")
+	default:
+	}
+	conn := r.server
+	if toClient {
+		conn = r.client
+	}
+	conn.mu.Lock()
+	err := conn.writeFrame(opcode, payload)
+	conn.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The handler may not be called once Do has returned
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	if r.handle != nil {
+		r.handle(&WebSocketMessage{
+			Time:       time.Now(),
+			FromClient: !toClient,
+			Opcode:     opcode,
+			Payload:    payload,
+			Length:     int64(len(payload)),
+			Injected:   true,
+		})
+	}
+	return nil
+}
+
+// WebSocketDone returns a channel that is closed when Do stops relaying a
+// WebSocket connection, or nil if the server didn't switch protocols.
+func (s *ProxySession) WebSocketDone() <-chan bool {
+	if s.ws == nil {
+		return nil
+	}
+	return s.ws.done
+}
+
+// A webSocketRelay relays an upgraded connection. Frames written to either side
+// are serialized, so messages can be injected between relayed ones.
+type webSocketRelay struct {
+	client *webSocketConn
+	server *webSocketConn
+	filter func(*WebSocketMessage) *WebSocketMessage
+	handle func(*WebSocketMessage)
+	ready  chan bool // Closed when the connection is relayed as a WebSocket
+	done   chan bool // Closed when the connection is closed
+	once   *sync.Once
+	mu     *sync.Mutex // Held while an injected message is handled
+}
+
+func (r *webSocketRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+func newWebSocketRelay() *webSocketRelay {
+	r := webSocketRelay{
+		ready: make(chan bool),
+		done:  make(chan bool),
+		once:  &sync.Once{},
+		mu:    &sync.Mutex{},
+	}
+	return &r
+}
+
+type webSocketConn struct {
+	w    io.Writer
+	mask bool // Frames sent to servers must be masked
+	mu   *sync.Mutex
+}
+
+// writeFrame sends a single frame message. conn.mu must be held.
+func (conn *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+	var m byte
+	if conn.mask {
+		m = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		buf = append(buf, m|byte(l))
+	case l < 1<<16:
+		buf = append(buf, m|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(l))
+	default:
+		buf = append(buf, m|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(l))
+	}
+	if conn.mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		for i, v := range payload {
+			buf = append(buf, v^key[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := conn.w.Write(buf)
+	return err
+}
+
+type wsFrameHeader struct {
+	raw    []byte
+	fin    bool
+	rsv1   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func readWebSocketFrameHeader(r *bufio.Reader) (*wsFrameHeader, error) {
+	h := &wsFrameHeader{
+		raw: make([]byte, 2, 14),
+	}
+	if _, err := io.ReadFull(r, h.raw); err != nil {
+		return nil, err
+	}
+	h.fin = h.raw[0]&0x80 != 0
+	h.rsv1 = h.raw[0]&0x40 != 0
+	h.opcode = h.raw[0] & 0x0f
+	h.masked = h.raw[1]&0x80 != 0
+	n := 0
+	switch l := h.raw[1] & 0x7f; l {
+	case 126:
+		n = 2
+	case 127:
+		n = 8
+	default:
+		h.length = int64(l)
+	}
+	if h.masked {
+		n += 4
+	}
+	if n > 0 {
+		ext := h.raw[2 : 2+n]
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		h.raw = h.raw[:2+n]
+		switch h.raw[1] & 0x7f {
+		case 126:
+			h.length = int64(binary.BigEndian.Uint16(ext))
+			ext = ext[2:]
+		case 127:
+			h.length = int64(binary.BigEndian.Uint64(ext) & (1<<63 - 1))
+			ext = ext[8:]
+		}
+		copy(h.mask[:], ext)
+	}
+	return h, nil
+}
+
+// relay copies WebSocket frames from src to dst until src is closed, returning
+// nil if it was closed cleanly. Unless there is a filter, frames are copied
+// unchanged as they arrive, and each message is passed to the handler once its
+// last frame has been. Otherwise, each message is held until it is complete and
+// the filter has decided what to send, except messages longer than
+// MaxWebSocketCapture, which are copied unfiltered.
+func (r *webSocketRelay) relay(dst *webSocketConn, src io.Reader, fromClient bool) error {
+	if r.handle == nil && r.filter == nil {
+		_, err := io.Copy(dst.w, src)
+		return err
+	}
+	br, ok := src.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(src)
+	}
+	var (
+		msg     *WebSocketMessage // The data message being reassembled
+		held    []byte            // The raw frames of msg, if it is held
+		holding bool
+		locked  bool // dst.mu is held while a message that isn't is copied
+	)
+	defer func() {
+		if locked {
+			dst.mu.Unlock()
+		}
+	}()
+	for {
+		h, err := readWebSocketFrameHeader(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		control := h.opcode >= WebSocketClose
+		m := msg
+		if control || m == nil {
+			m = &WebSocketMessage{
+				Time:       time.Now(),
+				FromClient: fromClient,
+				Opcode:     h.opcode,
+				Compressed: h.rsv1,
+			}
+		}
+		// Control frames sent between the frames of a message that isn't held
+		// can't wait for the filter, since the message holds dst. A frame can
+		// claim up to 2^63-1 bytes, so m.Length+h.length could overflow.
+		hold := r.filter != nil && h.length <= MaxWebSocketCapture-m.Length && !locked
+		if !control {
+			if msg == nil {
+				holding = hold
+			} else if holding && !hold {
+				// Too long to hold, so copy what has been held and the rest as is
+				dst.mu.Lock()
+				locked = true
+				if _, err = dst.w.Write(held); err != nil {
+					return err
+				}
+				held, holding = nil, false
+			}
+			hold = holding
+		}
+		if hold {
+			frame := make([]byte, len(h.raw)+int(h.length))
+			copy(frame, h.raw)
+			if _, err = io.ReadFull(br, frame[len(h.raw):]); err != nil {
+				return err
+			}
+			m.Payload = append(m.Payload, unmask(h, frame[len(h.raw):])...)
+			m.Length += h.length
+			if control {
+				err = r.moderate(dst, m, frame)
+			} else if held = append(held, frame...); h.fin {
+				err = r.moderate(dst, m, held)
+				held = nil
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			if !locked {
+				dst.mu.Lock()
+				locked = true
+			}
+			if err = copyWebSocketFrame(dst.w, br, h, m); err != nil {
+				return err
+			}
+			if control || h.fin {
+				if r.handle != nil {
+					r.handle(m)
+				}
+			}
+			// Nothing may be sent between the frames of a message that isn't held
+			if control && msg == nil || !control && h.fin {
+				dst.mu.Unlock()
+				locked = false
+			}
+		}
+		switch {
+		case control:
+		case h.fin:
+			msg = nil
+		default:
+			msg = m
+		}
+	}
+}
+
+// copyWebSocketFrame copies the payload of a frame from src to dst after its
+// header, capturing up to MaxWebSocketCapture bytes of m.
+func copyWebSocketFrame(dst io.Writer, src *bufio.Reader, h *wsFrameHeader, m *WebSocketMessage) error {
+	if _, err := dst.Write(h.raw); err != nil {
+		return err
+	}
+	var n int64
+	if room := int64(MaxWebSocketCapture - len(m.Payload)); room > 0 {
+		buf := make([]byte, min(h.length, room))
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf); err != nil {
+			return err
+		}
+		m.Payload = append(m.Payload, unmask(h, buf)...)
+		n = int64(len(buf))
+	}
+	if h.length > n {
+		if _, err := io.CopyN(dst, src, h.length-n); err != nil {
+			return err
+		}
+	}
+	m.Length += h.length
+	return nil
+}
+
+// unmask returns an unmasked copy of the beginning of a frame's payload.
+func unmask(h *wsFrameHeader, payload []byte) []byte {
+	res := append([]byte(nil), payload...)
+	if h.masked {
+		for i := range res {
+			res[i] ^= h.mask[i%4]
+		}
+	}
+	return res
+}
+
+// moderate passes a held message to the filter, and sends the frames it was
+// received in, the message the filter returned instead, or nothing.
+func (r *webSocketRelay) moderate(dst *webSocketConn, m *WebSocketMessage, frames []byte) error {
+	out := r.filter(m)
+	dst.mu.Lock()
+	var err error
+	switch {
+	case out == nil:
+		m.Dropped = true
+		out = m
+	case out == m:
+		_, err = dst.w.Write(frames)
+	default:
+		out.Time = m.Time
+		out.FromClient = m.FromClient
+		out.Modified = true
+		out.Compressed = false // Edited messages are sent uncompressed
+		out.Length = int64(len(out.Payload))
+		err = dst.writeFrame(out.Opcode, out.Payload)
+	}
+	dst.mu.Unlock()
+	if err == nil && r.handle != nil {
+		r.handle(out)
+	}
+	return err
+}
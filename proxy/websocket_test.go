@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Echoes everything the client sends after the upgrade
+type echoUpgradeServer struct{}
+
+func (e echoUpgradeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !IsWebSocketUpgrade(req) {
+		http.Error(w, "Not a WebSocket request", http.StatusBadRequest)
+		return
+	}
+	c, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	brw.Flush()
+	io.Copy(c, brw)
+}
+
+type wsRecorder struct {
+	messages []*WebSocketMessage
+	done     chan bool
+	mu       *sync.Mutex
+}
+
+func (r *wsRecorder) HandleProxy(s *ProxySession) {
+	s.WebSocketHandler = func(m *WebSocketMessage) {
+		r.mu.Lock()
+		r.messages = append(r.messages, m)
+		r.mu.Unlock()
+	}
+	s.Do()
+	r.done <- true
+}
+
+func webSocketFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	var b bytes.Buffer
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b.WriteByte(first)
+	var m byte
+	if mask != nil {
+		m = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		b.WriteByte(m | byte(l))
+	case l < 1<<16:
+		b.Write([]byte{m | 126, byte(l >> 8), byte(l)})
+	default:
+		b.Write([]byte{m | 127, 0, 0, 0, 0, byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)})
+	}
+	if mask != nil {
+		b.Write(mask)
+		for i, v := range payload {
+			b.WriteByte(v ^ mask[i%4])
+		}
+	} else {
+		b.Write(payload)
+	}
+	return b.Bytes()
+}
+
+// dialWebSocket opens a WebSocket to an echo server through a proxy using h.
+func dialWebSocket(t *testing.T, h ProxyHandler) (net.Conn, *bufio.Reader) {
+	addr := listenEchoUpgradeServer(t)
+	return upgradeWebSocket(t, listenProxy(t, h), "http://"+addr+"/ws", addr)
+}
+
+func listenEchoUpgradeServer(t *testing.T) string {
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ol.Close() })
+	go (&http.Server{Handler: echoUpgradeServer{}}).Serve(ol)
+	return ol.Addr().String()
+}
+
+func listenProxy(t *testing.T, h ProxyHandler) string {
+	ps := &ProxyServer{
+		Handler: h,
+	}
+	srv, _ := ps.getServer()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pl.Close() })
+	go srv.Serve(pl)
+	return pl.Addr().String()
+}
+
+// upgradeWebSocket sends a WebSocket upgrade request for uri to the proxy at addr.
+func upgradeWebSocket(t *testing.T, addr, uri, host string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write([]byte("GET " + uri + " HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Got status %d; want 101", res.StatusCode)
+	}
+	return c, br
+}
+
+func TestWebSocket(t *testing.T) {
+	rec := &wsRecorder{
+		done: make(chan bool, 1),
+		mu:   &sync.Mutex{},
+	}
+	c, br := dialWebSocket(t, rec)
+
+	mask := []byte{1, 2, 3, 4}
+	big := bytes.Repeat([]byte("x"), MaxWebSocketCapture+10)
+	var sent []byte
+	for _, f := range [][]byte{
+		webSocketFrame(false, WebSocketText, []byte("hel"), mask),
+		webSocketFrame(true, WebSocketPing, []byte("p"), mask),
+		webSocketFrame(true, WebSocketContinuation, []byte("lo"), mask),
+		webSocketFrame(true, WebSocketBinary, big, nil),
+		webSocketFrame(true, WebSocketClose, []byte{0x03, 0xe8}, mask),
+	} {
+		c.Write(f)
+		sent = append(sent, f...)
+	}
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Error("The echoed frames differ from the sent ones")
+	}
+	c.Close()
+	<-rec.done
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := []struct {
+		opcode  byte
+		payload string
+		length  int64
+	}{
+		{WebSocketPing, "p", 1},
+		{WebSocketText, "hello", 5},
+		{WebSocketBinary, string(big[:MaxWebSocketCapture]), int64(len(big))},
+		{WebSocketClose, "\x03\xe8", 2},
+	}
+	for _, fromClient := range []bool{true, false} {
+		var msgs []*WebSocketMessage
+		for _, m := range rec.messages {
+			if m.FromClient == fromClient {
+				msgs = append(msgs, m)
+			}
+		}
+		if len(msgs) != len(want) {
+			t.Fatalf("Got %d messages from client %v; want %d", len(msgs), fromClient, len(want))
+		}
+		for i, w := range want {
+			m := msgs[i]
+			if m.Opcode != w.opcode || string(m.Payload) != w.payload || m.Length != w.length {
+				t.Errorf("Message %d from client %v is %s with %d of %d bytes; want %d bytes", i, fromClient, m.OpcodeName(), len(m.Payload), m.Length, w.length)
+			}
+		}
+	}
+}
+
+type wsFilter struct {
+	wsRecorder
+	sessions chan *ProxySession
+}
+
+// Drops "drop" messages and replaces "edit" messages with "edited" ones
+func (f *wsFilter) HandleProxy(s *ProxySession) {
+	s.WebSocketFilter = func(m *WebSocketMessage) *WebSocketMessage {
+		switch string(m.Payload) {
+		case "drop":
+			return nil
+		case "edit":
+			return &WebSocketMessage{
+				Opcode:  WebSocketText,
+				Payload: []byte("edited"),
+			}
+		}
+		return m
+	}
+	if err := s.GetResponse(); err != nil {
+		return
+	}
+	f.sessions <- s
+	f.wsRecorder.HandleProxy(s)
+}
+
+func readWebSocketMessage(t *testing.T, br *bufio.Reader) (byte, string) {
+	var (
+		opcode  byte
+		payload []byte
+	)
+	for {
+		h, err := readWebSocketFrameHeader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, h.length)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			t.Fatal(err)
+		}
+		if h.opcode != WebSocketContinuation {
+			opcode = h.opcode
+		}
+		payload = append(payload, unmask(h, buf)...)
+		if h.fin {
+			return opcode, string(payload)
+		}
+	}
+}
+
+func TestWebSocketFilter(t *testing.T) {
+	f := &wsFilter{
+		wsRecorder: wsRecorder{
+			done: make(chan bool, 1),
+			mu:   &sync.Mutex{},
+		},
+		sessions: make(chan *ProxySession, 1),
+	}
+	c, br := dialWebSocket(t, f)
+	s := <-f.sessions
+
+	mask := []byte{1, 2, 3, 4}
+	c.Write(webSocketFrame(true, WebSocketText, []byte("drop"), mask))
+	c.Write(webSocketFrame(false, WebSocketText, []byte("ed"), mask))
+	c.Write(webSocketFrame(true, WebSocketContinuation, []byte("it"), mask))
+	c.Write(webSocketFrame(true, WebSocketText, []byte("keep"), mask))
+	for _, want := range []string{"edited", "keep"} {
+		if opcode, payload := readWebSocketMessage(t, br); opcode != WebSocketText || payload != want {
+			t.Errorf("Got message %q with opcode %d; want text %q", payload, opcode, want)
+		}
+	}
+	if err := s.SendWebSocketMessage(true, WebSocketBinary, []byte("to client")); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload := readWebSocketMessage(t, br); opcode != WebSocketBinary || payload != "to client" {
+		t.Errorf("Got injected message %q with opcode %d; want binary %q", payload, opcode, "to client")
+	}
+	// Echoed back to the client by the server
+	if err := s.SendWebSocketMessage(false, WebSocketText, []byte("to server")); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload := readWebSocketMessage(t, br); opcode != WebSocketText || payload != "to server" {
+		t.Errorf("Got injected message %q with opcode %d; want text %q", payload, opcode, "to server")
+	}
+	c.Close()
+	<-f.done
+	if err := s.SendWebSocketMessage(true, WebSocketText, nil); err == nil {
+		t.Error("Sent a message on a closed WebSocket")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	got := map[bool][]string{}
+	for _, m := range f.messages {
+		var what string
+		switch {
+		case m.Dropped:
+			what = "dropped"
+		case m.Modified:
+			what = "modified"
+		case m.Injected:
+			what = "injected"
+		default:
+			what = "relayed"
+		}
+		got[m.FromClient] = append(got[m.FromClient], fmt.Sprintf("%s %s", what, m.Payload))
+	}
+	want := map[bool][]string{
+		true:  {"dropped drop", "modified edited", "relayed keep", "injected to server"},
+		false: {"relayed edited", "relayed keep", "injected to client", "relayed to server"},
+	}
+	for _, fromClient := range []bool{true, false} {
+		if g, w := strings.Join(got[fromClient], ", "), strings.Join(want[fromClient], ", "); g != w {
+			t.Errorf("Got messages from client %v: %s; want %s", fromClient, g, w)
+		}
+	}
+}
+
+// A continuation frame claiming a length close to 2^63 mustn't be held
+func TestWebSocketFilterHugeContinuation(t *testing.T) {
+	f := &wsFilter{
+		wsRecorder: wsRecorder{
+			done: make(chan bool, 1),
+			mu:   &sync.Mutex{},
+		},
+		sessions: make(chan *ProxySession, 1),
+	}
+	c, br := dialWebSocket(t, f)
+	<-f.sessions
+
+	mask := []byte{1, 2, 3, 4}
+	c.Write(webSocketFrame(false, WebSocketText, []byte("he"), mask))
+	huge := []byte{0x80 | WebSocketContinuation, 0x80 | 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	c.Write(append(append(huge, mask...), "llo"...))
+	// The held first frame is sent on once the message turns out to be too long
+	h, err := readWebSocketFrameHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, h.length)
+	if _, err = io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if h.opcode != WebSocketText || h.fin || string(unmask(h, buf)) != "he" {
+		t.Errorf("Got frame %q with opcode %d; want the first text fragment %q", unmask(h, buf), h.opcode, "he")
+	}
+	c.Close()
+	<-f.done
+}
+
+func TestLoadBalancerWebSocket(t *testing.T) {
+	backend := listenEchoUpgradeServer(t)
+	lb := NewHTTPLoadBalancer(map[string][]string{"ws.test": {backend}}, StrategyFirst)
+	c, br := upgradeWebSocket(t, listenProxy(t, lb), "/ws", "ws.test")
+
+	sent := webSocketFrame(true, WebSocketText, []byte("hello"), []byte{1, 2, 3, 4})
+	c.Write(sent)
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Error("The echoed frame differs from the sent one")
+	}
+	c.Close()
+
+	// The connection is counted once the relay has finished
+	var ts TrafficStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ts = lb.BackendStats()[backend]
+		if ts.Requests > 0 {
+			break
+		}
+	}
+	if ts.Requests != 1 || ts.StatusClasses[1] != 1 || ts.Errors != 0 {
+		t.Fatalf("Backend stats are %+v; want one 101 response", ts)
+	}
+	if ts.BytesOut < int64(len(sent)) {
+		t.Errorf("Counted %d bytes out; want at least %d", ts.BytesOut, len(sent))
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Weights are scaled by this internally so that slow start can ramp up
+	// backends with small weights gradually
+	weightScale = 100
+)
+
+// SetWeight sets the relative share of requests the backend addr receives. The
+// default weight is 1, and a weight of 0 takes the backend out of rotation.
+func (lb *LoadBalancerHandler) SetWeight(addr string, weight int) error {
+	if weight < 0 {
+		weight = 0
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b := lb.getBackend(addr)
+	if b == nil {
+		return fmt.Errorf("Unknown backend %s", addr)
+	}
+	b.weight = weight
+	return nil
+}
+
+// effectiveWeight returns the scaled weight of b, reduced proportionally while b is
+// within lb.SlowStart of being added or recovering. It is only 0 if b's weight is
+// 0. lb.mu must be held.
+func (lb *LoadBalancerHandler) effectiveWeight(b *backend, now time.Time) int {
+	w := b.weight * weightScale
+	if lb.SlowStart <= 0 || w == 0 {
+		return w
+	}
+	since := now.Sub(b.start)
+	if since >= lb.SlowStart {
+		return w
+	}
+	if since < 0 {
+		since = 0
+	}
+	ew := int(int64(w) * int64(since) / int64(lb.SlowStart))
+	if ew < 1 {
+		ew = 1 // let a trickle of requests through from the start
+	}
+	return ew
+}
+
+// weightedRandom picks a backend from ds with a probability proportional to its
+// effective weight. lb.mu must be held.
+func (lb *LoadBalancerHandler) weightedRandom(ds []string, now time.Time) string {
+	total := 0
+	ws := make([]int, len(ds))
+	for i, v := range ds {
+		ws[i] = lb.effectiveWeight(lb.getBackend(v), now)
+		total += ws[i]
+	}
+	n := rand.Intn(total)
+	for i, w := range ws {
+		if n < w {
+			return ds[i]
+		}
+		n -= w
+	}
+	return ds[len(ds)-1]
+}
+
+// smoothRoundRobin picks a backend from ds using the smooth weighted round-robin
+// algorithm from nginx, which interleaves heavier backends with lighter ones
+// instead of sending them bursts of requests. The state is kept per route k.
+// lb.mu must be held.
+func (lb *LoadBalancerHandler) smoothRoundRobin(k string, ds []string, now time.Time) string {
+	cur, found := lb.rrWeights[k]
+	if !found {
+		cur = map[string]int{}
+		lb.rrWeights[k] = cur
+	}
+	var (
+		total = 0
+		best  string
+	)
+	for _, v := range ds {
+		w := lb.effectiveWeight(lb.getBackend(v), now)
+		cur[v] += w
+		total += w
+		if best == "" || cur[v] > cur[best] {
+			best = v
+		}
+	}
+	cur[best] -= total
+	return best
+}
@@ -0,0 +1,191 @@
+package sniff
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Bypass is a host pattern whose CONNECT requests are tunneled rather than
+// intercepted. Patterns are host names, "*.example.com", which matches any
+// subdomain of example.com, or "*", which matches every host.
+type Bypass struct {
+	Pattern string
+	Learned bool   // Added because clients rejected intercepted handshakes
+	Reason  string // Why the bypass was learned
+	Time    time.Time
+	Expires time.Time // When a learned bypass stops applying. Zero if never
+}
+
+// Expired reports whether b no longer applies at now.
+func (b *Bypass) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// A BypassList holds bypasses that were added by hand apart from learned ones,
+// so learning a bypass never replaces or expires one that was added by hand.
+type BypassList struct {
+	bypasses map[string]*Bypass
+	learned  map[string]*Bypass
+	failures map[string][]time.Time // Recent rejected handshakes per host
+	mu       *sync.RWMutex
+}
+
+// Add adds b to the list. A bypass added by hand replaces any bypass with the
+// same pattern, but a learned one only replaces other learned ones.
+func (bl *BypassList) Add(b *Bypass) {
+	b.Pattern = strings.ToLower(b.Pattern)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if b.Learned {
+		bl.learned[b.Pattern] = b
+		delete(bl.failures, b.Pattern)
+	} else {
+		bl.bypasses[b.Pattern] = b
+		delete(bl.learned, b.Pattern)
+	}
+}
+
+// Remove removes the bypasses with the given pattern, and reports whether there
+// were any.
+func (bl *BypassList) Remove(pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	_, found := bl.bypasses[pattern]
+	_, foundLearned := bl.learned[pattern]
+	delete(bl.bypasses, pattern)
+	delete(bl.learned, pattern)
+	return found || foundLearned
+}
+
+// ClearLearned removes all learned bypasses, and returns how many there were.
+func (bl *BypassList) ClearLearned() int {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	n := len(bl.learned)
+	bl.learned = map[string]*Bypass{}
+	return n
+}
+
+// RecordFailure records that a client rejected an intercepted handshake for
+// host, and returns how many times that has happened within window.
+func (bl *BypassList) RecordFailure(host string, window time.Duration) int {
+	host = strings.ToLower(host)
+	now := time.Now()
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	for k, v := range bl.failures {
+		if now.Sub(v[len(v)-1]) >= window {
+			delete(bl.failures, k)
+		}
+	}
+	var recent []time.Time
+	for _, v := range bl.failures[host] {
+		if now.Sub(v) < window {
+			recent = append(recent, v)
+		}
+	}
+	recent = append(recent, now)
+	bl.failures[host] = recent
+	return len(recent)
+}
+
+// Match returns the most specific bypass that matches host, which may include a
+// port, or nil if there is none. Bypasses added by hand take precedence over
+// learned ones with the same pattern, and expired ones are ignored.
+func (bl *BypassList) Match(host string) *Bypass {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	if b := bl.get(host, now); b != nil {
+		return b
+	}
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		if b := bl.get("*."+host, now); b != nil {
+			return b
+		}
+	}
+	return bl.get("*", now)
+}
+
+// get returns the bypass with the given pattern that applies at now, or nil.
+// bl.mu must be held.
+func (bl *BypassList) get(pattern string, now time.Time) *Bypass {
+	if b, found := bl.bypasses[pattern]; found {
+		return b
+	}
+	if b, found := bl.learned[pattern]; found && !b.Expired(now) {
+		return b
+	}
+	return nil
+}
+
+// List returns the bypasses that apply, sorted by pattern, with those added by
+// hand before learned ones with the same pattern.
+func (bl *BypassList) List() []*Bypass {
+	now := time.Now()
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	res := make([]*Bypass, 0, len(bl.bypasses)+len(bl.learned))
+	for _, v := range bl.bypasses {
+		res = append(res, v)
+	}
+	for _, v := range bl.learned {
+		if !v.Expired(now) {
+			res = append(res, v)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Pattern != res[j].Pattern {
+			return res[i].Pattern < res[j].Pattern
+		}
+		return !res[i].Learned && res[j].Learned
+	})
+	return res
+}
+
+func NewBypassList() *BypassList {
+	bl := BypassList{
+		bypasses: map[string]*Bypass{},
+		learned:  map[string]*Bypass{},
+		failures: map[string][]time.Time{},
+		mu:       &sync.RWMutex{},
+	}
+	return &bl
+}
+
+// ValidBypassPattern reports whether p is a host name, optionally prefixed with
+// "*.", or "*".
+func ValidBypassPattern(p string) bool {
+	if p == "*" {
+		return true
+	}
+	p = strings.TrimPrefix(p, "*.")
+	if p == "" || strings.Contains(p, "*") {
+		return false
+	}
+	if net.ParseIP(p) != nil {
+		return true
+	}
+	for _, label := range strings.Split(p, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
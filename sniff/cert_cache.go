@@ -0,0 +1,161 @@
+package sniff
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCertCacheSize = 1000
+	DefaultCertCacheTTL  = 24 * time.Hour
+)
+
+// A CertCache holds up to MaxSize key pairs, evicting the least recently used
+// when it is full. Key pairs expire TTL after they were added, or when their
+// certificates do if that's sooner. Key pairs whose certificates have already
+// expired, e.g. mimics of expired upstream certificates, are kept for the TTL,
+// since generating them again wouldn't help. Concurrent requests for a key pair that isn't cached share one
+// call to generate it. A MaxSize or TTL of 0 means no limit.
+type CertCache struct {
+	MaxSize int
+	TTL     time.Duration
+	items   map[string]*list.Element
+	lru     *list.List // most recently used first
+	calls   map[string]*certCall
+	stats   CertCacheStats
+	mu      *sync.Mutex
+}
+
+type CertCacheStats struct {
+	Size        int
+	Hits        int64 // Key pairs that were cached
+	Misses      int64 // Key pairs that had to be generated
+	Shared      int64 // Requests that waited for a key pair another was generating
+	Evictions   int64
+	Expirations int64
+}
+
+// HitRate returns the percentage of requests that didn't generate a key pair.
+func (s CertCacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses + s.Shared
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.Shared) / float64(total) * 100
+}
+
+type certCacheItem struct {
+	key     string
+	keypair *tls.Certificate
+	expires time.Time
+}
+
+type certCall struct {
+	done    chan bool
+	keypair *tls.Certificate
+	err     error
+}
+
+// Get returns the key pair cached under key, or, if there is none, the one
+// returned by generate, caching it if err is nil.
+func (cc *CertCache) Get(key string, generate func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	cc.mu.Lock()
+	if e, found := cc.items[key]; found {
+		item := e.Value.(*certCacheItem)
+		if time.Now().Before(item.expires) {
+			cc.lru.MoveToFront(e)
+			cc.stats.Hits++
+			cc.mu.Unlock()
+			return item.keypair, nil
+		}
+		cc.remove(e)
+		cc.stats.Expirations++
+	}
+	if call, found := cc.calls[key]; found {
+		cc.stats.Shared++
+		cc.mu.Unlock()
+		<-call.done
+		return call.keypair, call.err
+	}
+	call := &certCall{
+		done: make(chan bool),
+	}
+	cc.calls[key] = call
+	cc.stats.Misses++
+	cc.mu.Unlock()
+
+	call.keypair, call.err = generate()
+	cc.mu.Lock()
+	delete(cc.calls, key)
+	if call.err == nil {
+		cc.add(key, call.keypair)
+	}
+	cc.mu.Unlock()
+	close(call.done)
+	return call.keypair, call.err
+}
+
+// Add caches keypair under key, replacing any key pair already cached under it.
+func (cc *CertCache) Add(key string, keypair *tls.Certificate) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.add(key, keypair)
+}
+
+func (cc *CertCache) add(key string, keypair *tls.Certificate) {
+	if e, found := cc.items[key]; found {
+		cc.remove(e)
+	}
+	now := time.Now()
+	item := &certCacheItem{
+		key:     key,
+		keypair: keypair,
+		expires: now.Add(cc.TTL),
+	}
+	if cc.TTL <= 0 {
+		item.expires = now.Add(100 * 365 * 24 * time.Hour)
+	}
+	if l := keypair.Leaf; l != nil && l.NotAfter.After(now) && l.NotAfter.Before(item.expires) {
+		item.expires = keypair.Leaf.NotAfter
+	}
+	cc.items[key] = cc.lru.PushFront(item)
+	for cc.MaxSize > 0 && cc.lru.Len() > cc.MaxSize {
+		cc.remove(cc.lru.Back())
+		cc.stats.Evictions++
+	}
+}
+
+func (cc *CertCache) remove(e *list.Element) {
+	cc.lru.Remove(e)
+	delete(cc.items, e.Value.(*certCacheItem).key)
+}
+
+// Flush removes every key pair from the cache.
+func (cc *CertCache) Flush() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.items = map[string]*list.Element{}
+	cc.lru.Init()
+}
+
+func (cc *CertCache) Stats() CertCacheStats {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	s := cc.stats
+	s.Size = cc.lru.Len()
+	return s
+}
+
+func NewCertCache(maxSize int, ttl time.Duration) *CertCache {
+	cc := CertCache{
+		MaxSize: maxSize,
+		TTL:     ttl,
+		items:   map[string]*list.Element{},
+		lru:     list.New(),
+		calls:   map[string]*certCall{},
+		mu:      &sync.Mutex{},
+	}
+	return &cc
+}
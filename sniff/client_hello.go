@@ -0,0 +1,212 @@
+package sniff
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A ClientHello describes the TLS handshake of an intercepted connection: what
+// the client offered, what was negotiated, and fingerprints of the client's TLS
+// stack.
+type ClientHello struct {
+	ServerName         string
+	Versions           []uint16 // Offered, in the client's order
+	CipherSuites       []uint16
+	Extensions         []uint16
+	Curves             []tls.CurveID
+	Points             []uint8
+	SignatureSchemes   []tls.SignatureScheme
+	ALPN               []string
+	Version            uint16 // Negotiated
+	CipherSuite        uint16
+	NegotiatedProtocol string
+	JA3                string // The JA3 fingerprint string
+	JA3Hash            string // The MD5 hash of JA3, which is what JA3 fingerprints usually are
+	JA4                string
+}
+
+type clientHelloKey struct{}
+
+// ClientHelloFromRequest returns the ClientHello of the intercepted connection req
+// was read from, or nil if it wasn't.
+func ClientHelloFromRequest(req *http.Request) *ClientHello {
+	ch, _ := req.Context().Value(clientHelloKey{}).(*ClientHello)
+	return ch
+}
+
+func newClientHello(hello *tls.ClientHelloInfo) *ClientHello {
+	ch := &ClientHello{
+		ServerName:       hello.ServerName,
+		Versions:         hello.SupportedVersions,
+		CipherSuites:     hello.CipherSuites,
+		Extensions:       hello.Extensions,
+		Curves:           hello.SupportedCurves,
+		Points:           hello.SupportedPoints,
+		SignatureSchemes: hello.SignatureSchemes,
+		ALPN:             hello.SupportedProtos,
+	}
+	ch.JA3 = ch.ja3()
+	sum := md5.Sum([]byte(ch.JA3))
+	ch.JA3Hash = hex.EncodeToString(sum[:])
+	ch.JA4 = ch.ja4()
+	return ch
+}
+
+// MaxVersion returns the highest TLS version the client offered.
+func (ch *ClientHello) MaxVersion() uint16 {
+	var max uint16
+	for _, v := range ch.Versions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// VersionName returns the name of the negotiated TLS version.
+func (ch *ClientHello) VersionName() string {
+	return tls.VersionName(ch.Version)
+}
+
+// CipherSuiteName returns the name of the negotiated cipher suite.
+func (ch *ClientHello) CipherSuiteName() string {
+	return tls.CipherSuiteName(ch.CipherSuite)
+}
+
+// ja3 returns the JA3 string: the ClientHello version, cipher suites, extensions,
+// curves and point formats, in decimal, ignoring GREASE values. The ClientHello
+// version isn't exposed by crypto/tls; it is the highest offered version, but no
+// higher than TLS 1.2, which is what clients that support TLS 1.3 send.
+func (ch *ClientHello) ja3() string {
+	version := ch.MaxVersion()
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	curves := make([]uint16, len(ch.Curves))
+	for i, v := range ch.Curves {
+		curves[i] = uint16(v)
+	}
+	points := make([]uint16, len(ch.Points))
+	for i, v := range ch.Points {
+		points[i] = uint16(v)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinDecimal(ch.CipherSuites),
+		joinDecimal(ch.Extensions),
+		joinDecimal(curves),
+		joinDecimal(points),
+	}, ",")
+}
+
+// ja4 returns the JA4 fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1: the
+// protocol, highest version, whether there is an SNI, the number of cipher suites
+// and extensions and the first ALPN, followed by truncated hashes of the sorted
+// cipher suites, and of the sorted extensions and signature algorithms.
+func (ch *ClientHello) ja4() string {
+	var versionCode string
+	switch ch.MaxVersion() {
+	case tls.VersionTLS13:
+		versionCode = "13"
+	case tls.VersionTLS12:
+		versionCode = "12"
+	case tls.VersionTLS11:
+		versionCode = "11"
+	case tls.VersionTLS10:
+		versionCode = "10"
+	case tls.VersionSSL30:
+		versionCode = "s3"
+	default:
+		versionCode = "00"
+	}
+	sni := "i"
+	if ch.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(ch.CipherSuites)
+	exts := withoutGREASE(ch.Extensions)
+	alpn := "00"
+	if len(ch.ALPN) > 0 && ch.ALPN[0] != "" {
+		p := ch.ALPN[0]
+		if isAlphanumeric(p[0]) && isAlphanumeric(p[len(p)-1]) {
+			alpn = p[:1] + p[len(p)-1:]
+		} else {
+			h := hex.EncodeToString([]byte(p))
+			alpn = h[:1] + h[len(h)-1:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(ciphers), 99), min(len(exts), 99), alpn)
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := truncatedHash(joinHex(ciphers))
+
+	var sorted []uint16
+	for _, v := range exts {
+		if v != 0x0000 && v != 0x0010 { // SNI and ALPN are part of a
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c := joinHex(sorted)
+	if len(ch.SignatureSchemes) > 0 {
+		schemes := make([]uint16, len(ch.SignatureSchemes))
+		for i, v := range ch.SignatureSchemes {
+			schemes[i] = uint16(v)
+		}
+		c += "_" + joinHex(schemes)
+	}
+	if len(sorted) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+// GREASE values (RFC 8701) are random, so they are left out of fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vals []uint16) []uint16 {
+	res := make([]uint16, 0, len(vals))
+	for _, v := range vals {
+		if !isGREASE(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func joinDecimal(vals []uint16) string {
+	var s []string
+	for _, v := range withoutGREASE(vals) {
+		s = append(s, strconv.Itoa(int(v)))
+	}
+	return strings.Join(s, "-")
+}
+
+func joinHex(vals []uint16) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
@@ -0,0 +1,66 @@
+package sniff
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("Listener closed")
+
+// A connListener is a net.Listener that accepts connections handed to it with add
+// rather than ones dialed over the network, letting one http.Server serve
+// connections hijacked from another.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan bool
+	once   *sync.Once
+}
+
+func (l *connListener) add(c net.Conn) error {
+	select {
+	case <-l.closed:
+		return errListenerClosed
+	case l.conns <- c:
+		return nil
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, errListenerClosed
+	case c := <-l.conns:
+		return c, nil
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return connListenerAddr{}
+}
+
+type connListenerAddr struct{}
+
+func (connListenerAddr) Network() string {
+	return "intercept"
+}
+
+func (connListenerAddr) String() string {
+	return "intercept"
+}
+
+func newConnListener() *connListener {
+	l := connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+		once:   &sync.Once{},
+	}
+	return &l
+}
@@ -0,0 +1,79 @@
+package sniff
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+type streamIDKey struct{}
+
+// StreamIDFromRequest returns the HTTP/2 stream an intercepted request was
+// received on, or 0 if it wasn't received over HTTP/2.
+func StreamIDFromRequest(req *http.Request) uint32 {
+	id, _ := req.Context().Value(streamIDKey{}).(uint32)
+	return id
+}
+
+// streamID returns the stream w writes an HTTP/2 response to. net/http doesn't
+// expose stream IDs, so it is read from the HTTP/2 server's response writer, and
+// is 0 if its layout changes.
+func streamID(w http.ResponseWriter) uint32 {
+	v := reflect.ValueOf(w)
+	for _, name := range []string{"rws", "stream", "id"} {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return 0
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return 0
+		}
+		f, found := v.Type().FieldByName(name)
+		if !found {
+			return 0
+		}
+		var err error
+		v, err = v.FieldByIndexErr(f.Index)
+		if err != nil {
+			return 0
+		}
+	}
+	if v.Kind() != reflect.Uint32 {
+		return 0
+	}
+	return uint32(v.Uint())
+}
+
+// RequestPseudoHeader returns the pseudo-header fields of a request received over
+// HTTP/2, which net/http maps to req's Method, Host and RequestURI, or nil if it
+// wasn't.
+func RequestPseudoHeader(req *http.Request) map[string]string {
+	if req.ProtoMajor != 2 {
+		return nil
+	}
+	ph := map[string]string{
+		":method":    req.Method,
+		":authority": req.Host,
+	}
+	if req.Method != "CONNECT" {
+		ph[":scheme"] = "http"
+		if req.TLS != nil {
+			ph[":scheme"] = "https"
+		}
+		ph[":path"] = req.RequestURI
+	}
+	return ph
+}
+
+// ResponsePseudoHeader returns the pseudo-header fields of a response received
+// over HTTP/2, or nil if it wasn't.
+func ResponsePseudoHeader(res *http.Response) map[string]string {
+	if res.ProtoMajor != 2 {
+		return nil
+	}
+	return map[string]string{
+		":status": strconv.Itoa(res.StatusCode),
+	}
+}
@@ -0,0 +1,327 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SeverityHigh   = "high"
+	SeverityMedium = "medium"
+	SeverityLow    = "low"
+)
+
+// A ServerTLS describes the TLS connection to an upstream server, and what is
+// wrong with it.
+type ServerTLS struct {
+	Host        string
+	Time        time.Time
+	Version     uint16 // 0 if the handshake failed
+	CipherSuite uint16
+	Chain       []*CertificateInfo // As presented by the server, leaf first
+	Verified    bool               // The chain is valid for Host and trusted
+	OCSPStapled bool
+	OCSPStatus  string // "good", "revoked" or "unknown" if OCSPStapled
+	HSTS        string // The Strict-Transport-Security header
+	Findings    []*Finding
+}
+
+type CertificateInfo struct {
+	Subject   string
+	Issuer    string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	SHA256    string
+}
+
+type Finding struct {
+	Severity string
+	Code     string // e.g. "expired" or "outdated-version"
+	Message  string
+}
+
+func (st *ServerTLS) add(severity, code, format string, args ...interface{}) {
+	st.Findings = append(st.Findings, &Finding{
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Severity returns the highest severity of st's findings, or "" if there are
+// none.
+func (st *ServerTLS) Severity() string {
+	res := ""
+	for _, v := range st.Findings {
+		switch {
+		case v.Severity == SeverityHigh:
+			return SeverityHigh
+		case v.Severity == SeverityMedium, res == "":
+			res = v.Severity
+		}
+	}
+	return res
+}
+
+// VersionName returns the name of the negotiated TLS version.
+func (st *ServerTLS) VersionName() string {
+	if st.Version == 0 {
+		return ""
+	}
+	return tls.VersionName(st.Version)
+}
+
+// CipherSuiteName returns the name of the negotiated cipher suite.
+func (st *ServerTLS) CipherSuiteName() string {
+	if st.Version == 0 {
+		return ""
+	}
+	return tls.CipherSuiteName(st.CipherSuite)
+}
+
+// AuditServerTLS records the connection to host, which may include a port, and
+// the response header it sent, and flags problems with them. The chain is checked
+// against roots, or the system's CAs if roots is nil, regardless of whether the
+// connection verified it.
+func AuditServerTLS(host string, cs *tls.ConnectionState, header http.Header, roots *x509.CertPool) *ServerTLS {
+	st := newServerTLS(host, cs.PeerCertificates, roots)
+	st.Version = cs.Version
+	st.CipherSuite = cs.CipherSuite
+	st.auditVersion()
+	if len(cs.OCSPResponse) > 0 && len(cs.PeerCertificates) > 0 {
+		st.OCSPStapled = true
+		st.auditOCSP(cs.OCSPResponse, cs.PeerCertificates[0])
+	}
+	st.HSTS = header.Get("Strict-Transport-Security")
+	if maxAge, found := hstsMaxAge(st.HSTS); !found {
+		st.add(SeverityMedium, "missing-hsts", "No Strict-Transport-Security header")
+	} else if maxAge == 0 {
+		st.add(SeverityMedium, "missing-hsts", "Strict-Transport-Security has max-age=0, which removes HSTS")
+	}
+	return st
+}
+
+// AuditServerTLSError records a connection to host that failed because its
+// certificate couldn't be verified, and returns nil if err is another error.
+func AuditServerTLSError(host string, err error, roots *x509.CertPool) *ServerTLS {
+	var cve *tls.CertificateVerificationError
+	if !errors.As(err, &cve) {
+		return nil
+	}
+	return newServerTLS(host, cve.UnverifiedCertificates, roots)
+}
+
+func newServerTLS(host string, chain []*x509.Certificate, roots *x509.CertPool) *ServerTLS {
+	st := &ServerTLS{
+		Host: host,
+		Time: time.Now(),
+	}
+	for _, v := range chain {
+		sum := sha256.Sum256(v.Raw)
+		st.Chain = append(st.Chain, &CertificateInfo{
+			Subject:   v.Subject.String(),
+			Issuer:    v.Issuer.String(),
+			DNSNames:  v.DNSNames,
+			NotBefore: v.NotBefore,
+			NotAfter:  v.NotAfter,
+			SHA256:    hex.EncodeToString(sum[:]),
+		})
+	}
+	st.auditChain(chain, roots)
+	return st
+}
+
+func (st *ServerTLS) auditChain(chain []*x509.Certificate, roots *x509.CertPool) {
+	if len(chain) == 0 {
+		st.add(SeverityHigh, "invalid-chain", "The server presented no certificate")
+		return
+	}
+	n := len(st.Findings)
+	for _, v := range chain {
+		switch {
+		case st.Time.After(v.NotAfter):
+			st.add(SeverityHigh, "expired", "%s expired on %s", v.Subject, v.NotAfter.Format(time.RFC1123))
+		case st.Time.Before(v.NotBefore):
+			st.add(SeverityHigh, "not-yet-valid", "%s isn't valid until %s", v.Subject, v.NotBefore.Format(time.RFC1123))
+		}
+	}
+	leaf := chain[0]
+	name := st.Host
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	if err := leaf.VerifyHostname(name); err != nil {
+		st.add(SeverityHigh, "hostname-mismatch", "%s", err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		// Expiry has been checked, so verify as of a time when the leaf was valid
+		CurrentTime: leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2),
+	}
+	for _, v := range chain[1:] {
+		opts.Intermediates.AddCert(v)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		var uae x509.UnknownAuthorityError
+		switch {
+		case len(chain) == 1 && bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignatureFrom(leaf) == nil:
+			st.add(SeverityHigh, "self-signed", "%s is self-signed", leaf.Subject)
+		case errors.As(err, &uae):
+			st.add(SeverityHigh, "untrusted", "%s", err)
+		default:
+			st.add(SeverityHigh, "invalid-chain", "%s", err)
+		}
+	}
+	st.Verified = len(st.Findings) == n
+}
+
+func (st *ServerTLS) auditVersion() {
+	if st.Version < tls.VersionTLS12 {
+		st.add(SeverityHigh, "outdated-version", "%s is deprecated", tls.VersionName(st.Version))
+	}
+	name := tls.CipherSuiteName(st.CipherSuite)
+	for _, v := range tls.InsecureCipherSuites() {
+		if v.ID == st.CipherSuite {
+			st.add(SeverityHigh, "weak-cipher", "%s is insecure", name)
+			return
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "TLS_RSA_"):
+		st.add(SeverityMedium, "weak-cipher", "%s doesn't provide forward secrecy", name)
+	case strings.Contains(name, "_CBC_"):
+		st.add(SeverityLow, "weak-cipher", "%s uses CBC mode", name)
+	}
+}
+
+// auditOCSP records the status of leaf in a stapled OCSP response. The
+// response's signature isn't verified.
+func (st *ServerTLS) auditOCSP(der []byte, leaf *x509.Certificate) {
+	status, nextUpdate, err := parseOCSPStatus(der, leaf.SerialNumber)
+	if err != nil {
+		st.add(SeverityMedium, "invalid-ocsp", "Couldn't parse the stapled OCSP response: %s", err)
+		return
+	}
+	st.OCSPStatus = status
+	switch {
+	case status == "revoked":
+		st.add(SeverityHigh, "revoked", "%s has been revoked", leaf.Subject)
+	case !nextUpdate.IsZero() && st.Time.After(nextUpdate):
+		st.add(SeverityLow, "stale-ocsp", "The stapled OCSP response expired on %s", nextUpdate.Format(time.RFC1123))
+	}
+}
+
+// hstsMaxAge returns the max-age directive of a Strict-Transport-Security header,
+// and whether it has a valid one.
+func hstsMaxAge(v string) (int64, bool) {
+	for _, d := range strings.Split(v, ";") {
+		d = strings.TrimSpace(d)
+		if len(d) < 8 || !strings.EqualFold(d[:8], "max-age=") {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.Trim(d[8:], `"`), 10, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// The OCSP response structures from RFC 6960, as far as they are needed to find
+// a certificate's status.
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// parseOCSPStatus returns the status of the certificate with the given serial
+// number in an OCSP response, and when the response expires, if it says.
+func parseOCSPStatus(der []byte, serial *big.Int) (string, time.Time, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.Status != 0 {
+		return "", time.Time{}, fmt.Errorf("Response status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return "", time.Time{}, fmt.Errorf("Unsupported response type %s", resp.Response.ResponseType)
+	}
+	var basic basicOCSPResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return "", time.Time{}, err
+	}
+	for _, v := range basic.TBSResponseData.Responses {
+		if v.CertID.SerialNumber == nil || v.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		switch {
+		case bool(v.Good):
+			return "good", v.NextUpdate, nil
+		case !v.Revoked.RevocationTime.IsZero():
+			return "revoked", v.NextUpdate, nil
+		default:
+			return "unknown", v.NextUpdate, nil
+		}
+	}
+	return "", time.Time{}, fmt.Errorf("No response for serial number %s", serial)
+}
@@ -4,16 +4,18 @@ import (
 	"github.com/pmylund/sniffy/cert"
 	"github.com/pmylund/sniffy/proxy"
 
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 // TODO: Expand so it can connect with anything; not just ProxyServer
@@ -27,80 +29,198 @@ type SSLInterceptor struct {
 	GenerateHostCerts     bool
 	HostCertFolder        string
 	ConnectResponseHeader []byte
+	MimicUpstream         bool          // Copy the certificates of the real servers
+	UpstreamTimeout       time.Duration // How long to wait for a real server's certificate
+	HandshakeTimeout      time.Duration // How long a client has to complete the handshake
+	KeyType               cert.KeyType  // The key type of generated host certificates
+	Diskless              bool          // Keep host key pairs in memory only
+	HTTP2                 bool          // Offer HTTP/2 to clients that support it
+	Cache                 *CertCache
 	caKeyPair             *tls.Certificate
 	caParentCert          *x509.Certificate
-	keyPairCache          map[string]*tls.Certificate
-	mu                    *sync.Mutex
+	config                *tls.Config
+	server                *http.Server
+	l                     *connListener
 }
 
-type requestInterceptor struct {
-	Addr    string
-	OrigReq *http.Request
-	si      *SSLInterceptor
-	server  *http.Server
+type connectKey struct{}
+
+// An interceptedConn is a hijacked client connection and the CONNECT request it
+// was hijacked from.
+type interceptedConn struct {
+	net.Conn
+	req        *http.Request
+	serverName string // sent by the client
+	presented  bool   // whether the client was sent a certificate
+	hello      *ClientHello
+	done       chan bool
+	once       *sync.Once
+}
+
+func (c *interceptedConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// A HandshakeError is returned by Intercept when a client aborts the TLS handshake
+// after it was sent the interceptor's certificate, e.g. because it doesn't trust
+// the CA, or it pins the real certificate.
+type HandshakeError struct {
+	Host       string // The CONNECT host, without the port
+	ServerName string
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("Client rejected intercepted handshake for %s: %s", e.Host, e.Err)
 }
 
+// Intercept hijacks the client connection of a CONNECT request and serves the
+// requests sent through the tunnel with the interceptor's http.Server, presenting
+// a certificate for the server name the client asks for, or, if it doesn't send
+// one, the CONNECT host. Intercept returns when the connection is closed, and a
+// *HandshakeError if the client rejected the certificate.
 func (si *SSLInterceptor) Intercept(w http.ResponseWriter, req *http.Request) error {
-	addr := req.URL.String()
 	c, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		return fmt.Errorf("Error hijacking CONNECT request: %s", err)
 	}
-	ri := &requestInterceptor{
-		OrigReq: req,
-		Addr:    addr,
-		si:      si,
+	if si.ConnectResponseHeader != nil {
+		c.Write(si.ConnectResponseHeader)
+	} else {
+		c.Write(proxy.DefaultConnectResponseHeader)
 	}
-	srv := &http.Server{
-		Handler: ri,
+	ic := &interceptedConn{
+		Conn: c,
+		req:  req,
+		done: make(chan bool),
+		once: &sync.Once{},
 	}
-	// TODO: Use tls.Config.NameToCertificate to map domain:cert, and run only one intercept srv
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		NextProtos: []string{"http/1.1"},
+	config := si.config
+	if !si.HTTP2 {
+		config = si.config.Clone()
+		config.NextProtos = []string{"http/1.1"}
 	}
-	split := strings.Split(addr, ":")
-	keypair, err := si.GetHostKeyPair(split[0])
+	tc := tls.Server(ic, config)
+	ctx, cancel := context.WithTimeout(context.Background(), si.HandshakeTimeout)
+	err = tc.HandshakeContext(ctx)
+	timedOut := ctx.Err() != nil
+	cancel()
 	if err != nil {
-		return fmt.Errorf("Couldn't generate interceptor key pair for %s: %s", split[0], err)
-	}
-	keypair.Certificate = append(keypair.Certificate, si.caKeyPair.Certificate...)
-	// TODO: 1. the complete issuer chain isn't included?
-	//       2. tls.Certificate can just contain the certs for all domains?
-	//       3. emulate the SSL certificate of the destination? Expiry, etc.
-	//       4. impossible to avoid e.g. Firefox built-in certs for mail.google.com, etc.?
-	config.Certificates = []tls.Certificate{
-		*keypair,
-		// *si.caKeyPair,
-	}
-	// TODO: 1. Change this so we don't initiate another connection
-	//          We should be able to accomplish the same without it
-	//       2. Intercepted connections have 127.0.0.1 RemoteAddr
-	//          because of this
-	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+		c.Close()
+		if ne, ok := err.(net.Error); ic.presented && !timedOut && !(ok && ne.Timeout()) {
+			host := req.URL.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return &HandshakeError{
+				Host:       host,
+				ServerName: ic.serverName,
+				Err:        err,
+			}
+		}
+		return fmt.Errorf("Intercepted handshake failed: %s", err)
+	}
+	if ic.hello != nil {
+		cs := tc.ConnectionState()
+		ic.hello.Version = cs.Version
+		ic.hello.CipherSuite = cs.CipherSuite
+		ic.hello.NegotiatedProtocol = cs.NegotiatedProtocol
+	}
+	err = si.l.add(tc)
 	if err != nil {
-		return fmt.Errorf("Couldn't create SSL interceptor TLS listener: %s", err)
+		c.Close()
+		return fmt.Errorf("Couldn't intercept connection: %s", err)
+	}
+	<-ic.done
+	return nil
+}
+
+// Close stops serving intercepted connections.
+func (si *SSLInterceptor) Close() error {
+	return si.server.Close()
+}
+
+func (si *SSLInterceptor) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ic, _ := hello.Conn.(*interceptedConn)
+	c, err := si.hostCertificate(hello, ic)
+	if ic != nil {
+		ic.serverName = hello.ServerName
+		ic.presented = err == nil
+		ic.hello = newClientHello(hello)
+	}
+	return c, err
+}
+
+func (si *SSLInterceptor) hostCertificate(hello *tls.ClientHelloInfo, ic *interceptedConn) (*tls.Certificate, error) {
+	var addr string
+	if ic != nil {
+		addr = ic.req.URL.Host
+	}
+	cn := hello.ServerName
+	if cn == "" {
+		if addr == "" {
+			return nil, fmt.Errorf("No server name for connection from %s", hello.Conn.RemoteAddr())
+		}
+		cn = addr
+		if host, _, err := net.SplitHostPort(cn); err == nil {
+			cn = host
+		}
+	}
+	cn = strings.ToLower(cn)
+	if !proxy.ValidServerName(cn) {
+		return nil, fmt.Errorf("Invalid server name %q", cn)
+	}
+	var (
+		keypair *tls.Certificate
+		err     error
+	)
+	if si.MimicUpstream && addr != "" {
+		keypair, err = si.GetMimicKeyPair(cn, addr)
+	}
+	if keypair == nil {
+		keypair, err = si.GetHostKeyPair(cn)
 	}
-	oc, err := net.Dial("tcp", l.Addr().String())
 	if err != nil {
-		return fmt.Errorf("Couldn't create SSL interceptor connection: %s", err)
+		return nil, fmt.Errorf("Couldn't generate interceptor key pair for %s: %s", cn, err)
 	}
-	if si.ConnectResponseHeader != nil {
-		c.Write(si.ConnectResponseHeader)
-	} else {
-		c.Write(proxy.DefaultConnectResponseHeader)
+	chain := *keypair
+	chain.Certificate = append(keypair.Certificate[:len(keypair.Certificate):len(keypair.Certificate)], si.caKeyPair.Certificate...)
+	return &chain, nil
+}
+
+func (si *SSLInterceptor) connContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		if ic, ok := tc.NetConn().(*interceptedConn); ok {
+			ctx = context.WithValue(ctx, connectKey{}, ic.req)
+			if ic.hello != nil {
+				ctx = context.WithValue(ctx, clientHelloKey{}, ic.hello)
+			}
+			return ctx
+		}
 	}
-	go func() {
-		defer c.Close()
-		defer l.Close() // this kills the HTTP server (srv)
-		io.Copy(c, oc)
-	}()
-	go func() {
-		defer oc.Close()
-		io.Copy(oc, c)
-	}()
-	srv.Serve(l)
-	return nil
+	return ctx
+}
+
+// ServeHTTP passes a request read from an intercepted connection, and the CONNECT
+// request the connection was opened with, to si.Handler. req.RemoteAddr is the
+// address of the client that sent the CONNECT request, ClientHelloFromRequest
+// describes the connection's handshake, and StreamIDFromRequest returns the
+// stream of an HTTP/2 request.
+func (si *SSLInterceptor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origReq, _ := req.Context().Value(connectKey{}).(*http.Request)
+	if origReq == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if req.ProtoMajor == 2 {
+		req = req.WithContext(context.WithValue(req.Context(), streamIDKey{}, streamID(w)))
+	}
+	req.URL.Scheme = "https"
+	req.URL.Host = origReq.URL.Host
+	si.Handler.HandleIntercept(w, req, origReq)
 }
 
 // This is a question of removing the middleware from the ps
@@ -110,35 +230,104 @@ func (si *SSLInterceptor) Intercept(w http.ResponseWriter, req *http.Request) er
 // 	si.InterceptSSL = !ps.InterceptSSL
 // }
 
+// GetHostKeyPair returns a key pair for cn signed by the interceptor CA.
 func (si *SSLInterceptor) GetHostKeyPair(cn string) (*tls.Certificate, error) {
-	si.mu.Lock()
-	defer si.mu.Unlock()
-	keypair, found := si.keyPairCache[cn]
-	if found {
-		return keypair, nil
+	return si.Cache.Get(cn, func() (*tls.Certificate, error) {
+		if si.Diskless {
+			return cert.NewKeyPair(si.KeyType, cn, []string{"Sniffy"}, false, si.caKeyPair)
+		}
+		return cert.GetOrGenerateKeyPair(path.Join(si.HostCertFolder, cn+"_cert.pem"), path.Join(si.HostCertFolder, cn+"_key.pem"), cn, []string{"Sniffy"}, false, si.caKeyPair, si.KeyType)
+	})
+}
+
+// GetMimicKeyPair returns a key pair for cn that copies the certificate the server
+// at addr presents for it. If the server can't be reached, GetMimicKeyPair returns
+// nil and the error.
+func (si *SSLInterceptor) GetMimicKeyPair(cn, addr string) (*tls.Certificate, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %s", addr, err)
 	}
-	keypair, err := cert.GetOrGenerateKeyPair(path.Join(si.HostCertFolder, cn+"_cert.pem"), path.Join(si.HostCertFolder, cn+"_key.pem"), cn, []string{"Sniffy"}, false, si.caParentCert)
-	if err == nil {
-		si.keyPairCache[cn] = keypair
+	return si.Cache.Get(cn+"@"+addr, func() (*tls.Certificate, error) {
+		var c, k string
+		if !si.Diskless {
+			name := cn + "_" + port + "_mimic"
+			c, k = path.Join(si.HostCertFolder, name+"_cert.pem"), path.Join(si.HostCertFolder, name+"_key.pem")
+			if kp, err := tls.LoadX509KeyPair(c, k); err == nil && kp.Leaf != nil && si.reusable(&kp, c) {
+				return &kp, nil
+			}
+		}
+		upstream, err := si.upstreamCertificate(cn, addr)
+		if err != nil {
+			return nil, err
+		}
+		return cert.MimicKeyPair(c, k, si.KeyType, upstream, si.caKeyPair)
+	})
+}
+
+// reusable reports whether the mimic key pair kp that was saved to c may be used
+// instead of mimicking the upstream certificate again. A mimic of an expired
+// certificate is reused for as long as it would have been cached.
+func (si *SSLInterceptor) reusable(kp *tls.Certificate, c string) bool {
+	now := time.Now()
+	if now.Before(kp.Leaf.NotAfter) || si.Cache.TTL <= 0 {
+		return true
 	}
-	return keypair, err
+	fi, err := os.Stat(c)
+	return err == nil && now.Before(fi.ModTime().Add(si.Cache.TTL))
 }
 
-func (ri *requestInterceptor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	req.URL.Scheme = "https"
-	req.URL.Host = ri.Addr
-	ri.si.Handler.(InterceptHandler).HandleIntercept(w, req, ri.OrigReq)
+// upstreamCertificate returns the leaf certificate the server at addr presents
+// for serverName. It isn't verified; an invalid certificate is mimicked as is.
+func (si *SSLInterceptor) upstreamCertificate(serverName, addr string) (*x509.Certificate, error) {
+	d := &net.Dialer{
+		Timeout: si.UpstreamTimeout,
+	}
+	c, err := tls.DialWithDialer(d, "tcp", addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get certificate of %s: %s", addr, err)
+	}
+	defer c.Close()
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+	return certs[0], nil
 }
 
-func NewSSLInterceptor(handler InterceptHandler, caCertFile, caKeyFile string) (*SSLInterceptor, error) {
+// NewSSLInterceptor returns an SSLInterceptor that signs host certificates with the
+// CA key pair in caCertFile and caKeyFile, generating it with a key of type
+// caKeyType if it doesn't exist.
+func NewSSLInterceptor(handler InterceptHandler, caCertFile, caKeyFile string, caKeyType cert.KeyType) (*SSLInterceptor, error) {
 	si := SSLInterceptor{
 		Handler:           handler,
 		GenerateHostCerts: true,               // TODO: TEMP
 		HostCertFolder:    "cert/interceptor", // TODO: TEMP
-		keyPairCache:      map[string]*tls.Certificate{},
-		mu:                &sync.Mutex{},
+		MimicUpstream:     true,
+		UpstreamTimeout:   10 * time.Second,
+		HandshakeTimeout:  30 * time.Second,
+		KeyType:           cert.DefaultKeyType,
+		Cache:             NewCertCache(DefaultCertCacheSize, DefaultCertCacheTTL),
+		HTTP2:             true,
+		l:                 newConnListener(),
+	}
+	si.config = &tls.Config{
+		Rand:           rand.Reader,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: si.getCertificate,
 	}
-	_, err := cert.GetOrGenerateKeyPair(caCertFile, caKeyFile, "interceptor.sniffy.local", []string{"Sniffy"}, true, nil)
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	si.server = &http.Server{
+		Handler:     &si,
+		ConnContext: si.connContext,
+		Protocols:   protocols,
+	}
+	_, err := cert.GetOrGenerateKeyPair(caCertFile, caKeyFile, "interceptor.sniffy.local", []string{"Sniffy"}, true, nil, caKeyType)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get or generate interceptor CA key pair: %s", err)
 	}
@@ -146,10 +335,12 @@ func NewSSLInterceptor(handler InterceptHandler, caCertFile, caKeyFile string) (
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't load interceptor CA key pair: %s", err)
 	}
-	si.caKeyPair = &caKeyPair
 	si.caParentCert, err = x509.ParseCertificate(caKeyPair.Certificate[0])
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't parse interceptor CA key pair: %s", err)
 	}
+	caKeyPair.Leaf = si.caParentCert
+	si.caKeyPair = &caKeyPair
+	go si.server.Serve(si.l)
 	return &si, nil
 }
@@ -1,8 +1,745 @@
 package sniff
 
 import (
+	"github.com/pmylund/sniffy/cert"
+
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSomething(t *testing.T) {
 }
+
+type interceptRecorder struct {
+	remoteAddrs []string
+	connects    []*http.Request
+	hellos      []*ClientHello
+	requests    []*http.Request
+	mu          *sync.Mutex
+}
+
+func (ir *interceptRecorder) HandleIntercept(w http.ResponseWriter, req *http.Request, origReq *http.Request) {
+	ir.mu.Lock()
+	ir.remoteAddrs = append(ir.remoteAddrs, req.RemoteAddr)
+	ir.connects = append(ir.connects, origReq)
+	ir.hellos = append(ir.hellos, ClientHelloFromRequest(req))
+	ir.requests = append(ir.requests, req)
+	ir.mu.Unlock()
+	w.Write([]byte(req.URL.String()))
+}
+
+func TestIntercept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-intercept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ir := &interceptRecorder{
+		mu: &sync.Mutex{},
+	}
+	si, err := NewSSLInterceptor(ir, path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), cert.RSA2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.Close()
+	si.HostCertFolder = dir
+	si.MimicUpstream = false
+	// Seed the key pair cache so the test doesn't depend on how leaves are minted
+	for _, cn := range []string{"example.com", "www.example.net", "example.org"} {
+		sn, _ := cert.GetSN()
+		c, k := path.Join(dir, cn+"_cert.pem"), path.Join(dir, cn+"_key.pem")
+		if err = cert.GenerateKeyPair(c, k, cert.ECDSAP256, cn, []string{"Sniffy"}, sn, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		kp, err := tls.LoadX509KeyPair(c, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		si.Cache.Add(cn, &kp)
+	}
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		si.Intercept(w, req)
+	}))
+	defer ps.Close()
+
+	for _, v := range []struct {
+		connect    string
+		serverName string
+		cn         string
+	}{
+		{"example.com:443", "example.com", "example.com"},
+		{"example.net:443", "www.example.net", "www.example.net"},
+		{"example.org:8443", "", "example.org"},
+	} {
+		c, err := net.Dial("tcp", ps.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("CONNECT " + v.connect + " HTTP/1.1\r\nHost: " + v.connect + "\r\n\r\n"))
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT %s: got status %d", v.connect, res.StatusCode)
+		}
+		tc := tls.Client(c, &tls.Config{
+			ServerName:         v.serverName,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		})
+		if err = tc.Handshake(); err != nil {
+			t.Fatalf("CONNECT %s: %s", v.connect, err)
+		}
+		if cn := tc.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != v.cn {
+			t.Errorf("CONNECT %s: got certificate for %q; want %q", v.connect, cn, v.cn)
+		}
+		tr := bufio.NewReader(tc)
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "/path", nil)
+			req.Host = v.connect
+			if err = req.Write(tc); err != nil {
+				t.Fatal(err)
+			}
+			res, err = http.ReadResponse(tr, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if want := "https://" + v.connect + "/path"; string(body) != want {
+				t.Errorf("CONNECT %s: got URL %q; want %q", v.connect, body, want)
+			}
+		}
+		ir.mu.Lock()
+		for i, addr := range ir.remoteAddrs {
+			if addr != c.LocalAddr().String() {
+				t.Errorf("Request %d had RemoteAddr %s; want %s", i, addr, c.LocalAddr())
+			}
+			if ir.connects[i].Method != "CONNECT" || ir.connects[i].URL.Host != v.connect {
+				t.Errorf("Request %d has wrong CONNECT request %s %s", i, ir.connects[i].Method, ir.connects[i].URL.Host)
+			}
+			ch := ir.hellos[i]
+			if ch == nil {
+				t.Fatalf("Request %d has no ClientHello", i)
+			}
+			if ch.ServerName != v.serverName || ch.Version != tls.VersionTLS13 || ch.NegotiatedProtocol != "http/1.1" {
+				t.Errorf("Request %d has ClientHello for %q, version %s, protocol %q", i, ch.ServerName, ch.VersionName(), ch.NegotiatedProtocol)
+			}
+			sni := "d"
+			if v.serverName == "" {
+				sni = "i"
+			}
+			if !strings.HasPrefix(ch.JA4, "t13"+sni) || len(ch.JA3Hash) != 32 {
+				t.Errorf("Request %d has fingerprints %s, %s", i, ch.JA3Hash, ch.JA4)
+			}
+		}
+		ir.remoteAddrs, ir.connects, ir.hellos, ir.requests = nil, nil, nil, nil
+		ir.mu.Unlock()
+		tc.Close()
+	}
+}
+
+func TestInterceptHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ir := &interceptRecorder{
+		mu: &sync.Mutex{},
+	}
+	si, err := NewSSLInterceptor(ir, path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), cert.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.Close()
+	si.HostCertFolder = dir
+	si.MimicUpstream = false
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		si.Intercept(w, req)
+	}))
+	defer ps.Close()
+	psURL, _ := url.Parse(ps.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(si.caParentCert)
+
+	for _, h2 := range []bool{true, false} {
+		si.HTTP2 = h2
+		c := &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyURL(psURL),
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				ForceAttemptHTTP2: true,
+			},
+		}
+		for i := 0; i < 2; i++ {
+			res, err := c.Get("https://example.com/path?q=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if want := map[bool]int{true: 2, false: 1}[h2]; res.ProtoMajor != want {
+				t.Errorf("Got response over %s with HTTP2 %v", res.Proto, h2)
+			}
+		}
+		c.Transport.(*http.Transport).CloseIdleConnections()
+
+		ir.mu.Lock()
+		if len(ir.requests) != 2 {
+			t.Fatalf("Got %d requests; want 2", len(ir.requests))
+		}
+		for i, req := range ir.requests {
+			if req.URL.String() != "https://example.com:443/path?q=1" {
+				t.Errorf("Request %d has URL %s", i, req.URL)
+			}
+			ph := RequestPseudoHeader(req)
+			if !h2 {
+				if req.ProtoMajor != 1 || StreamIDFromRequest(req) != 0 || ph != nil {
+					t.Errorf("Request %d over %s has stream %d, pseudo-header %v", i, req.Proto, StreamIDFromRequest(req), ph)
+				}
+				continue
+			}
+			if id := StreamIDFromRequest(req); id != uint32(2*i+1) {
+				t.Errorf("Request %d has stream ID %d; want %d", i, id, 2*i+1)
+			}
+			if ph[":method"] != "GET" || ph[":scheme"] != "https" || ph[":authority"] != "example.com" || ph[":path"] != "/path?q=1" {
+				t.Errorf("Request %d has pseudo-header %v", i, ph)
+			}
+			if ch := ir.hellos[i]; ch == nil || ch.NegotiatedProtocol != "h2" {
+				t.Errorf("Request %d has ClientHello %v", i, ch)
+			}
+		}
+		ir.remoteAddrs, ir.connects, ir.hellos, ir.requests = nil, nil, nil, nil
+		ir.mu.Unlock()
+	}
+}
+
+func TestMimicUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-mimic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ir := &interceptRecorder{
+		mu: &sync.Mutex{},
+	}
+	si, err := NewSSLInterceptor(ir, path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), cert.RSA2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.Close()
+	si.HostCertFolder = dir
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		si.Intercept(w, req)
+	}))
+	defer ps.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(si.caParentCert)
+	addr := upstream.Listener.Addr().String()
+
+	for _, serverName := range []string{"example.com", "127.0.0.1", "example.com"} {
+		c, err := net.Dial("tcp", ps.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got status %d", res.StatusCode)
+		}
+		// The certificate must verify against our CA for the names the real one is for
+		tc := tls.Client(c, &tls.Config{
+			ServerName: serverName,
+			RootCAs:    roots,
+		})
+		if err = tc.Handshake(); err != nil {
+			t.Fatalf("%s: %s", serverName, err)
+		}
+		got := tc.ConnectionState().PeerCertificates[0]
+		want := upstream.Certificate()
+		tc.Close()
+		if got.Subject.String() != want.Subject.String() {
+			t.Errorf("Got subject %s; want %s", got.Subject, want.Subject)
+		}
+		if strings.Join(got.DNSNames, ",") != strings.Join(want.DNSNames, ",") {
+			t.Errorf("Got DNS names %v; want %v", got.DNSNames, want.DNSNames)
+		}
+		if len(got.IPAddresses) != len(want.IPAddresses) {
+			t.Errorf("Got IP addresses %v; want %v", got.IPAddresses, want.IPAddresses)
+		}
+		if got.ExtKeyUsage[0] != want.ExtKeyUsage[0] || got.IsCA {
+			t.Errorf("Got key usages %v (CA: %v); want %v", got.ExtKeyUsage, got.IsCA, want.ExtKeyUsage)
+		}
+		if bytes.Equal(got.Raw, want.Raw) {
+			t.Error("Got the upstream certificate itself")
+		}
+	}
+	if st := si.Cache.Stats(); st.Size != 2 || st.Misses != 2 || st.Hits != 1 {
+		t.Errorf("Got cache stats %+v; want 2 key pairs, 2 misses and 1 hit", st)
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	cc := NewCertCache(2, time.Hour)
+	var (
+		generated int
+		mu        sync.Mutex
+	)
+	generate := func() (*tls.Certificate, error) {
+		mu.Lock()
+		generated++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return &tls.Certificate{}, nil
+	}
+
+	// Simultaneous requests for one key pair generate it once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cc.Get("a", generate); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if generated != 1 {
+		t.Errorf("Generated %d key pairs for concurrent requests; want 1", generated)
+	}
+	if st := cc.Stats(); st.Misses != 1 || st.Hits+st.Shared != 9 {
+		t.Errorf("Got stats %+v", st)
+	}
+
+	// The least recently used key pair is evicted
+	cc.Get("b", generate)
+	cc.Get("a", generate)
+	cc.Get("c", generate)
+	generated = 0
+	cc.Get("a", generate)
+	cc.Get("b", generate)
+	if generated != 1 {
+		t.Errorf("Generated %d key pairs; want 1 (b)", generated)
+	}
+	if st := cc.Stats(); st.Size != 2 || st.Evictions != 2 {
+		t.Errorf("Got stats %+v; want 2 key pairs and 2 evictions", st)
+	}
+
+	// Errors aren't cached
+	_, err := cc.Get("d", func() (*tls.Certificate, error) {
+		return nil, errors.New("Failed")
+	})
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	generated = 0
+	cc.Get("d", generate)
+	if generated != 1 {
+		t.Error("Cached a failed generation")
+	}
+
+	// Key pairs expire
+	cc.TTL = time.Millisecond
+	cc.Flush()
+	cc.Get("e", generate)
+	time.Sleep(5 * time.Millisecond)
+	generated = 0
+	cc.Get("e", generate)
+	if st := cc.Stats(); generated != 1 || st.Expirations != 1 {
+		t.Errorf("Got stats %+v after expiry", st)
+	}
+
+	// ...but not just because their certificates have already expired
+	cc.TTL = time.Hour
+	cc.Flush()
+	generated = 0
+	expired := func() (*tls.Certificate, error) {
+		generate()
+		return &tls.Certificate{
+			Leaf: &x509.Certificate{NotAfter: time.Now().Add(-time.Hour)},
+		}, nil
+	}
+	cc.Get("f", expired)
+	cc.Get("f", expired)
+	if generated != 1 {
+		t.Errorf("Generated %d key pairs with expired certificates; want 1", generated)
+	}
+}
+
+func TestDiskless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-diskless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	si, err := NewSSLInterceptor(&interceptRecorder{mu: &sync.Mutex{}}, path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), cert.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.Close()
+	si.HostCertFolder = dir
+	si.Diskless = true
+	kp, err := si.GetHostKeyPair("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kp.Leaf.Subject.CommonName != "example.com" {
+		t.Errorf("Got certificate for %s", kp.Leaf.Subject.CommonName)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Got %d files; want only the CA's 2", len(files))
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniffy-rejected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	si, err := NewSSLInterceptor(&interceptRecorder{mu: &sync.Mutex{}}, path.Join(dir, "ca_cert.pem"), path.Join(dir, "ca_key.pem"), cert.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.Close()
+	si.HostCertFolder = dir
+	si.MimicUpstream = false
+	errs := make(chan error, 1)
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		errs <- si.Intercept(w, req)
+	}))
+	defer ps.Close()
+
+	for _, trusted := range []bool{false, true} {
+		c, err := net.Dial("tcp", ps.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("CONNECT pinned.example.com:443 HTTP/1.1\r\nHost: pinned.example.com:443\r\n\r\n"))
+		if _, err = http.ReadResponse(bufio.NewReader(c), nil); err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		if trusted {
+			roots.AddCert(si.caParentCert)
+		}
+		tc := tls.Client(c, &tls.Config{
+			ServerName: "pinned.example.com",
+			RootCAs:    roots,
+		})
+		hsErr := tc.Handshake()
+		tc.Close()
+		err = <-errs
+		if trusted {
+			if hsErr != nil || err != nil {
+				t.Errorf("Trusted handshake failed: %v, %v", hsErr, err)
+			}
+			continue
+		}
+		he, ok := err.(*HandshakeError)
+		if !ok {
+			t.Fatalf("Got %v; want a HandshakeError", err)
+		}
+		if he.Host != "pinned.example.com" || he.ServerName != "pinned.example.com" {
+			t.Errorf("Got HandshakeError for %s (%s)", he.Host, he.ServerName)
+		}
+	}
+}
+
+func TestBypassList(t *testing.T) {
+	bl := NewBypassList()
+	bl.Add(&Bypass{Pattern: "Mail.Google.com"})
+	bl.Add(&Bypass{Pattern: "*.apple.com", Learned: true})
+	for host, want := range map[string]string{
+		"mail.google.com:443":     "mail.google.com",
+		"mail.google.com.":        "mail.google.com",
+		"www.google.com:443":      "",
+		"itunes.apple.com:443":    "*.apple.com",
+		"a.b.apple.com":           "*.apple.com",
+		"apple.com:443":           "",
+		"notapple.com:443":        "",
+		"[2001:db8::1]:443":       "",
+		"mail.google.com.evil.io": "",
+	} {
+		b := bl.Match(host)
+		if got := ""; b != nil {
+			got = b.Pattern
+			if got != want {
+				t.Errorf("%s matched %q; want %q", host, got, want)
+			}
+		} else if want != "" {
+			t.Errorf("%s matched nothing; want %q", host, want)
+		}
+	}
+	bl.Add(&Bypass{Pattern: "*"})
+	if b := bl.Match("www.google.com:443"); b == nil || b.Pattern != "*" {
+		t.Errorf("* didn't match")
+	}
+	if !bl.Remove("*") || bl.Remove("*") {
+		t.Error("Remove didn't report whether the bypass existed")
+	}
+	if l := bl.List(); len(l) != 2 || l[0].Pattern != "*.apple.com" {
+		t.Errorf("Got list %v", l)
+	}
+
+	// Learned bypasses don't replace ones added by hand, and expire
+	bl.Add(&Bypass{Pattern: "mail.google.com", Learned: true, Expires: time.Now().Add(-time.Second)})
+	bl.Add(&Bypass{Pattern: "www.google.com", Learned: true, Expires: time.Now().Add(-time.Second)})
+	if b := bl.Match("mail.google.com"); b == nil || b.Learned {
+		t.Errorf("mail.google.com matched %+v; want the bypass added by hand", b)
+	}
+	if b := bl.Match("www.google.com"); b != nil {
+		t.Errorf("Expired bypass %+v matched", b)
+	}
+	if l := bl.List(); len(l) != 2 {
+		t.Errorf("Got list with expired bypasses %v", l)
+	}
+	bl.Add(&Bypass{Pattern: "www.google.com"})
+	if b := bl.Match("www.google.com"); b == nil || b.Learned {
+		t.Errorf("www.google.com matched %+v; want the bypass added by hand", b)
+	}
+	bl.Remove("www.google.com")
+	if n := bl.ClearLearned(); n != 2 {
+		t.Errorf("Cleared %d learned bypasses; want 2", n)
+	}
+	if l := bl.List(); len(l) != 1 || l[0].Pattern != "mail.google.com" {
+		t.Errorf("Got list %v after clearing learned bypasses", l)
+	}
+	for i := 1; i <= 3; i++ {
+		if n := bl.RecordFailure("Example.com", time.Minute); n != i {
+			t.Errorf("Failure %d was counted as %d", i, n)
+		}
+	}
+	if n := bl.RecordFailure("example.com", 0); n != 1 {
+		t.Errorf("Failures outside the window were counted: %d", n)
+	}
+	for p, want := range map[string]bool{
+		"example.com":   true,
+		"*.example.com": true,
+		"*":             true,
+		"10.0.0.1":      true,
+		"a.*.com":       false,
+		"":              false,
+		"exa mple.com":  false,
+		"example..com":  false,
+	} {
+		if ValidBypassPattern(p) != want {
+			t.Errorf("ValidBypassPattern(%q) != %v", p, want)
+		}
+	}
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	// The Chrome example from the JA4 specification, with GREASE values added
+	ch := newClientHello(&tls.ClientHelloInfo{
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites: []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010,
+			0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x3a3a},
+		SupportedCurves:  []tls.CurveID{0x4a4a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:  []uint8{0},
+		SignatureSchemes: []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		SupportedProtos:  []string{"h2", "http/1.1"},
+	})
+	if want := "t13d1516h2_8daaf6152771_e5627efa2ab1"; ch.JA4 != want {
+		t.Errorf("Got JA4 %s; want %s", ch.JA4, want)
+	}
+	want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	if ch.JA3 != want {
+		t.Errorf("Got JA3 %s; want %s", ch.JA3, want)
+	}
+
+	// An old client without SNI, ALPN or extensions
+	ch = newClientHello(&tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS10},
+		CipherSuites:      []uint16{0x0005, 0x000a},
+	})
+	if want := "t10i020000_ecbe99380d04_000000000000"; ch.JA4 != want {
+		t.Errorf("Got JA4 %s; want %s", ch.JA4, want)
+	}
+	if !strings.HasPrefix(ch.JA3, "769,5-10,,,") {
+		t.Errorf("Got JA3 %s", ch.JA3)
+	}
+}
+
+func findingCodes(st *ServerTLS) string {
+	var codes []string
+	for _, v := range st.Findings {
+		codes = append(codes, v.Code)
+	}
+	return strings.Join(codes, ",")
+}
+
+func TestAuditServerTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/hsts" {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		}
+	}))
+	srv.StartTLS()
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(srv.Certificate())
+
+	get := func(path string) *http.Response {
+		res, err := srv.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := get("/hsts")
+	tests := []struct {
+		host  string
+		roots *x509.CertPool
+		codes string
+	}{
+		{host, trusted, ""},
+		{host, x509.NewCertPool(), "self-signed"},
+		{"example.org:443", trusted, "hostname-mismatch"},
+	}
+	for _, v := range tests {
+		st := AuditServerTLS(v.host, res.TLS, res.Header, v.roots)
+		if got := findingCodes(st); got != v.codes {
+			t.Errorf("Findings for %s: got %q; want %q", v.host, got, v.codes)
+		}
+		if st.Verified != (v.codes == "") {
+			t.Errorf("Verified for %s is %v", v.host, st.Verified)
+		}
+		if len(st.Chain) != 1 || st.Chain[0].Subject != srv.Certificate().Subject.String() {
+			t.Errorf("Unexpected chain %v", st.Chain)
+		}
+	}
+	st := AuditServerTLS(host, res.TLS, res.Header, trusted)
+	if st.VersionName() != "TLS 1.3" || st.HSTS == "" || st.Severity() != "" {
+		t.Errorf("Got version %s, HSTS %q, severity %q", st.VersionName(), st.HSTS, st.Severity())
+	}
+
+	// An outdated server without HSTS
+	old := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	old.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS10,
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	}
+	old.StartTLS()
+	defer old.Close()
+	c := old.Client()
+	tr := c.Transport.(*http.Transport)
+	tr.TLSClientConfig.MinVersion = tls.VersionTLS10
+	tr.TLSClientConfig.CipherSuites = old.TLS.CipherSuites
+	res, err := c.Get(old.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(old.Certificate())
+	st = AuditServerTLS(old.Listener.Addr().String(), res.TLS, res.Header, roots)
+	if got, want := findingCodes(st), "outdated-version,weak-cipher,missing-hsts"; got != want {
+		t.Errorf("Findings for outdated server: got %q; want %q", got, want)
+	}
+	if st.Severity() != SeverityHigh {
+		t.Errorf("Severity is %q", st.Severity())
+	}
+
+	// A connection that failed verification
+	_, err = http.Get(srv.URL)
+	if err == nil {
+		t.Fatal("Untrusted server was verified")
+	}
+	st = AuditServerTLSError(host, err, nil)
+	if st == nil {
+		t.Fatalf("No ServerTLS for %v", err)
+	}
+	if got := findingCodes(st); got != "self-signed" || st.Version != 0 {
+		t.Errorf("Findings for failed connection: got %q, version %d", got, st.Version)
+	}
+	if AuditServerTLSError(host, errors.New("connection refused"), nil) != nil {
+		t.Error("Got ServerTLS for an unrelated error")
+	}
+}
+
+func TestParseOCSPStatus(t *testing.T) {
+	sha1 := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}}
+	responderID, _ := asn1.Marshal([]byte{1})
+	now := time.Now().UTC().Truncate(time.Second)
+	response := func(single ocspSingleResponse) []byte {
+		basic, err := asn1.Marshal(basicOCSPResponse{
+			TBSResponseData: ocspResponseData{
+				RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+				ProducedAt:     now,
+				Responses:      []ocspSingleResponse{single},
+			},
+			SignatureAlgorithm: sha1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := asn1.Marshal(ocspResponse{
+			Response: ocspResponseBytes{
+				ResponseType: oidOCSPBasic,
+				Response:     basic,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	certID := ocspCertID{
+		HashAlgorithm: sha1,
+		NameHash:      []byte{1},
+		IssuerKeyHash: []byte{2},
+		SerialNumber:  big.NewInt(42),
+	}
+	good := response(ocspSingleResponse{CertID: certID, Good: true, ThisUpdate: now, NextUpdate: now.Add(time.Hour)})
+	revoked := response(ocspSingleResponse{CertID: certID, Revoked: ocspRevokedInfo{RevocationTime: now}, ThisUpdate: now})
+
+	status, next, err := parseOCSPStatus(good, big.NewInt(42))
+	if err != nil || status != "good" || !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Got %s, %s, %v; want good", status, next, err)
+	}
+	status, _, err = parseOCSPStatus(revoked, big.NewInt(42))
+	if err != nil || status != "revoked" {
+		t.Errorf("Got %s, %v; want revoked", status, err)
+	}
+	if _, _, err = parseOCSPStatus(good, big.NewInt(43)); err == nil {
+		t.Error("Got a status for another serial number")
+	}
+	if _, _, err = parseOCSPStatus([]byte("junk"), big.NewInt(42)); err == nil {
+		t.Error("Parsed junk")
+	}
+}
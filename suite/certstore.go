@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/pmylund/sniffy/proxy"
+
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+const (
+	certStoreDB       = "db"       // Key pairs listed in the certs table
+	certStoreGenerate = "generate" // Key pairs generated on the fly
+
+	// How long key pairs from the certs table are cached, so that replaced or
+	// revoked certificates stop being served without a restart
+	certCacheTTL = 5 * time.Minute
+)
+
+// dbCertStore serves the certificates listed in the certs table to TLS-terminating
+// proxy servers. Exact common names are preferred over wildcards.
+type dbCertStore struct{}
+
+func (cs *dbCertStore) GetCertificate(serverName string) (*tls.Certificate, error) {
+	names := proxy.CertificateNames(serverName)
+	for _, v := range names {
+		if c, found := dbCache.Get("cert|" + v); found {
+			return c.(*tls.Certificate), nil
+		}
+	}
+	if len(names) == 1 {
+		names = append(names, names[0])
+	}
+	var cn, certfile, keyfile string
+	row := db.QueryRow(`
+SELECT   cn, certfile, keyfile
+FROM     certs
+WHERE    (cn = $1 OR cn = $2) AND certfile <> '' AND keyfile <> ''
+ORDER BY cn = $1 DESC
+LIMIT    1`, names[0], names[1])
+	err := row.Scan(&cn, &certfile, &keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("No certificate for %s: %s", serverName, err)
+	}
+	keypair, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load key pair for %s: %s", cn, err)
+	}
+	dbCache.Set("cert|"+cn, &keypair, certCacheTTL)
+	return &keypair, nil
+}
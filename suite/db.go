@@ -6,8 +6,10 @@ import (
 	"github.com/pmylund/sniffy/common/queue"
 	"github.com/pmylund/sniffy/dummy"
 	"github.com/pmylund/sniffy/proxy"
+	"github.com/pmylund/sniffy/sniff"
 
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,13 +18,15 @@ import (
 	"github.com/pmylund/go-cache"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 var (
-	CurrentSchemaVersion    = uint64(1)
+	CurrentSchemaVersion    = uint64(21)
 	ErrInvalidSchemaVersion = errors.New("Invalid DB schema version--corrupt database?")
 	defaultDBSchema         = `
 CREATE TABLE version(
@@ -113,6 +117,265 @@ VALUES      ('default', 8002, '', '');
 
 INSERT INTO dummyservers(name, port, certfile, keyfile)
 VALUES      ('default', 8003, 'cert/dummy_cert.pem', 'cert/dummy_key.pem');
+`
+	dbMigrate002 = `
+ALTER TABLE proxyservers ADD COLUMN reverseproxy BOOL NOT NULL DEFAULT false;
+
+CREATE TABLE reverseroutes(
+    id           SERIAL PRIMARY KEY NOT NULL,
+    host         VARCHAR(255) NOT NULL,
+    pathprefix   VARCHAR(255) NOT NULL,
+    origin       TEXT NOT NULL,
+    stripprefix  BOOL NOT NULL,
+    preservehost BOOL NOT NULL,
+    ps_id        INTEGER NOT NULL REFERENCES proxyservers(id) ON DELETE CASCADE
+);
+`
+	dbMigrate003 = `
+ALTER TABLE proxyservers ADD COLUMN certstore VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE certs ADD COLUMN certfile VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE certs ADD COLUMN keyfile VARCHAR(255) NOT NULL DEFAULT '';
+`
+	dbMigrate004 = `
+CREATE TABLE loadbalancers(
+    id                  SERIAL PRIMARY KEY NOT NULL,
+    name                VARCHAR(64) NOT NULL,
+    port                INTEGER NOT NULL,
+    strategy            INTEGER NOT NULL,
+    healthcheckpath     VARCHAR(255) NOT NULL, -- empty disables health checks
+    healthcheckhost     VARCHAR(255) NOT NULL,
+    healthcheckinterval INTEGER NOT NULL,      -- milliseconds
+    healthchecktimeout  INTEGER NOT NULL,      -- milliseconds
+    healthcheckstatus   INTEGER NOT NULL,      -- 0 accepts any 2xx or 3xx
+    healthcheckrise     INTEGER NOT NULL,
+    healthcheckfall     INTEGER NOT NULL
+);
+
+CREATE TABLE lbroutes(
+    id      SERIAL PRIMARY KEY NOT NULL,
+    host    VARCHAR(255) NOT NULL,
+    backend VARCHAR(255) NOT NULL,
+    lb_id   INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+`
+	dbMigrate005 = `
+-- outlierfailures of 0 disables outlier detection, and outlierejection is in
+-- milliseconds. retrybudget is a percentage of requests, and minretries the
+-- number of retries allowed per 10 seconds regardless of the budget.
+ALTER TABLE loadbalancers ADD COLUMN outlierfailures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE loadbalancers ADD COLUMN outlierejection INTEGER NOT NULL DEFAULT 30000;
+ALTER TABLE loadbalancers ADD COLUMN retries INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE loadbalancers ADD COLUMN retrybudget INTEGER NOT NULL DEFAULT 20;
+ALTER TABLE loadbalancers ADD COLUMN minretries INTEGER NOT NULL DEFAULT 10;
+`
+	dbMigrate006 = `
+ALTER TABLE loadbalancers ADD COLUMN slowstart INTEGER NOT NULL DEFAULT 0; -- milliseconds
+
+CREATE TABLE lbbackends(
+    id     SERIAL PRIMARY KEY NOT NULL,
+    addr   VARCHAR(255) NOT NULL,
+    weight INTEGER NOT NULL,
+    lb_id  INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+`
+	dbMigrate007 = `
+ALTER TABLE loadbalancers ADD COLUMN stickycookie VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE loadbalancers ADD COLUMN hashheader VARCHAR(255) NOT NULL DEFAULT '';
+`
+	dbMigrate008 = `
+CREATE TABLE lbmatches(
+    id          SERIAL PRIMARY KEY NOT NULL,
+    route       VARCHAR(255) NOT NULL, -- lbroutes.host
+    priority    INTEGER NOT NULL DEFAULT 0,
+    host        VARCHAR(255) NOT NULL, -- empty matches any host
+    pathprefix  VARCHAR(255) NOT NULL,
+    pathregexp  VARCHAR(255) NOT NULL,
+    header      VARCHAR(255) NOT NULL,
+    headervalue VARCHAR(255) NOT NULL,
+    lb_id       INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+`
+	dbMigrate009 = `
+ALTER TABLE lbroutes ALTER COLUMN backend TYPE VARCHAR(2048); -- address or URL
+
+CREATE TABLE lbtls(
+    id                 SERIAL PRIMARY KEY NOT NULL,
+    route              VARCHAR(255) NOT NULL, -- lbroutes.host
+    cafile             VARCHAR(1024) NOT NULL, -- empty trusts the system CAs
+    certfile           VARCHAR(1024) NOT NULL, -- client certificate, if any
+    keyfile            VARCHAR(1024) NOT NULL,
+    servername         VARCHAR(255) NOT NULL,
+    insecureskipverify BOOLEAN NOT NULL DEFAULT FALSE,
+    lb_id              INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+ALTER TABLE lbbackends ALTER COLUMN addr TYPE VARCHAR(2048);
+`
+	dbMigrate010 = `
+CREATE TABLE lbmirrors(
+    id          SERIAL PRIMARY KEY NOT NULL,
+    route       VARCHAR(255) NOT NULL, -- lbroutes.host
+    shadowroute VARCHAR(255) NOT NULL, -- lbroutes.host of the shadow pool
+    maxbodysize INTEGER NOT NULL DEFAULT 1048576,
+    maxinflight INTEGER NOT NULL DEFAULT 100, -- 0 means no limit
+    timeout     INTEGER NOT NULL DEFAULT 30000, -- milliseconds
+    lb_id       INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+
+CREATE TABLE mirrorresults(
+    id             BIGSERIAL PRIMARY KEY NOT NULL,
+    time           INTEGER NOT NULL,
+    route          VARCHAR(255) NOT NULL,
+    shadowroute    VARCHAR(255) NOT NULL,
+    method         VARCHAR(10) NOT NULL,
+    url            TEXT NOT NULL,
+    primarybackend VARCHAR(2048) NOT NULL,
+    primarystatus  INTEGER NOT NULL, -- 0 if there was no response
+    primarylatency BIGINT NOT NULL, -- microseconds
+    primaryerror   TEXT NOT NULL,
+    shadowbackend  VARCHAR(2048) NOT NULL,
+    shadowstatus   INTEGER NOT NULL,
+    shadowlatency  BIGINT NOT NULL,
+    shadowerror    TEXT NOT NULL,
+    lb_id          INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+CREATE INDEX mirrorresults_lb_id_idx ON mirrorresults(lb_id, id);
+`
+	dbMigrate011 = `
+CREATE TABLE lbsplits(
+    id          SERIAL PRIMARY KEY NOT NULL,
+    route       VARCHAR(255) NOT NULL, -- lbroutes.host
+    canaryroute VARCHAR(255) NOT NULL, -- lbroutes.host of the canary group
+    percent     REAL NOT NULL DEFAULT 0,
+    header      VARCHAR(255) NOT NULL DEFAULT '',
+    headervalue VARCHAR(255) NOT NULL DEFAULT '', -- empty matches any value
+    cookie      VARCHAR(255) NOT NULL DEFAULT '',
+    cookievalue VARCHAR(255) NOT NULL DEFAULT '',
+    lb_id       INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+`
+	dbMigrate012 = `
+-- 'http' or 'tcp'. TCP load balancers use the backends of the route '*', and
+-- an empty healthcheckpath makes them check that a connection can be made
+ALTER TABLE loadbalancers ADD COLUMN protocol VARCHAR(8) NOT NULL DEFAULT 'http';
+
+CREATE TABLE lbconnections(
+    id       BIGSERIAL PRIMARY KEY NOT NULL,
+    time     INTEGER NOT NULL,
+    client   VARCHAR(255) NOT NULL,
+    backend  VARCHAR(2048) NOT NULL, -- empty if no backend could be reached
+    duration BIGINT NOT NULL, -- microseconds
+    bytesin  BIGINT NOT NULL, -- from the client
+    bytesout BIGINT NOT NULL, -- to the client
+    error    TEXT NOT NULL,
+    lb_id    INTEGER NOT NULL REFERENCES loadbalancers(id) ON DELETE CASCADE
+);
+CREATE INDEX lbconnections_lb_id_idx ON lbconnections(lb_id, id);
+`
+	dbMigrate013 = `
+-- Key types of generated certificates: rsa2048, rsa3072, rsa4096, ecdsa-p256,
+-- ecdsa-p384 or ed25519. Existing certificates are not regenerated.
+INSERT INTO settings(name, value) VALUES('WebKeyType', 'rsa2048');
+INSERT INTO settings(name, value) VALUES('DummyKeyType', 'rsa2048');
+INSERT INTO settings(name, value) VALUES('InterceptorCAKeyType', 'rsa2048');
+INSERT INTO settings(name, value) VALUES('InterceptorKeyType', 'ecdsa-p256');
+`
+	dbMigrate014 = `
+-- The number of interception key pairs kept in memory, and for how many seconds
+-- (0 for no limit). If InterceptorDiskless is 1, they aren't written to
+-- InterceptorCertFolder.
+INSERT INTO settings(name, value) VALUES('InterceptorCacheSize', '1000');
+INSERT INTO settings(name, value) VALUES('InterceptorCacheTTL', '86400');
+INSERT INTO settings(name, value) VALUES('InterceptorDiskless', '0');
+`
+	dbMigrate015 = `
+-- Hosts whose CONNECT requests are tunneled even if the proxy server intercepts
+-- SSL. Learned bypasses were added when a client rejected an intercepted
+-- handshake.
+CREATE TABLE interceptbypasses(
+    id      SERIAL PRIMARY KEY NOT NULL,
+    pattern VARCHAR(255) NOT NULL,
+    learned BOOL NOT NULL,
+    reason  TEXT NOT NULL,
+    time    INTEGER NOT NULL,
+    ps_id   INTEGER NOT NULL REFERENCES proxyservers(id) ON DELETE CASCADE,
+    UNIQUE(ps_id, pattern)
+);
+`
+	dbMigrate016 = `
+-- The TLS handshakes of intercepted requests. tlsmaxversion is the highest
+-- version the client offered, and tlsclienthello the JSON-encoded
+-- sniff.ClientHello.
+ALTER TABLE requests ADD COLUMN sni VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE requests ADD COLUMN tlsversion INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE requests ADD COLUMN tlsmaxversion INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE requests ADD COLUMN tlsciphersuite INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE requests ADD COLUMN alpn VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE requests ADD COLUMN ja3 VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE requests ADD COLUMN ja4 VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE requests ADD COLUMN tlsclienthello TEXT NOT NULL DEFAULT '';
+`
+	dbMigrate017 = `
+-- The most recent TLS connection to each upstream server, with its findings.
+-- severity is that of the worst finding, and servertls the JSON-encoded
+-- sniff.ServerTLS.
+CREATE TABLE servertls(
+    host      VARCHAR(255) PRIMARY KEY NOT NULL,
+    time      INTEGER NOT NULL,
+    severity  VARCHAR(16) NOT NULL,
+    findings  INTEGER NOT NULL,
+    servertls TEXT NOT NULL
+);
+`
+	dbMigrate018 = `
+-- If InterceptorHTTP2 is 1, intercepted clients may use HTTP/2. streamid is
+-- the HTTP/2 stream a request was received on, and pseudoheader the
+-- JSON-encoded pseudo-header fields of HTTP/2 requests and responses.
+INSERT INTO settings(name, value) VALUES('InterceptorHTTP2', '1');
+ALTER TABLE requests ADD COLUMN streamid BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE requests ADD COLUMN pseudoheader TEXT NOT NULL DEFAULT '';
+ALTER TABLE responses ADD COLUMN pseudoheader TEXT NOT NULL DEFAULT '';
+`
+	dbMigrate019 = `
+-- The messages relayed over WebSocket connections. payload is base64-encoded,
+-- and at most the first proxy.MaxWebSocketCapture bytes of the message, which
+-- were length bytes long.
+CREATE TABLE websocketmessages(
+    id         BIGSERIAL PRIMARY KEY NOT NULL,
+    time       INTEGER NOT NULL,
+    fromclient BOOL NOT NULL,
+    opcode     INTEGER NOT NULL,
+    payload    TEXT NOT NULL,
+    length     BIGINT NOT NULL,
+    compressed BOOL NOT NULL,
+    req_id     BIGINT NOT NULL REFERENCES requests(id) ON DELETE CASCADE
+);
+`
+	dbMigrate020 = `
+-- If moderatewebsockets is true, WebSocket messages are held until they are
+-- forwarded, edited or dropped. Messages that were edited are saved as sent,
+-- and dropped ones as received.
+ALTER TABLE proxyservers ADD COLUMN moderatewebsockets BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE websocketmessages ADD COLUMN modified BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE websocketmessages ADD COLUMN dropped BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE websocketmessages ADD COLUMN injected BOOL NOT NULL DEFAULT FALSE;
+`
+	dbMigrate021 = `
+-- Learned intercept bypasses are kept apart from the ones added by hand, and
+-- stop applying at expires. Bypasses learned before are kept for a day.
+CREATE TABLE learnedbypasses(
+    id      SERIAL PRIMARY KEY NOT NULL,
+    pattern VARCHAR(255) NOT NULL,
+    reason  TEXT NOT NULL,
+    time    INTEGER NOT NULL,
+    expires INTEGER NOT NULL,
+    ps_id   INTEGER NOT NULL REFERENCES proxyservers(id) ON DELETE CASCADE,
+    UNIQUE(ps_id, pattern)
+);
+INSERT INTO learnedbypasses(pattern, reason, time, expires, ps_id)
+SELECT pattern, reason, time, time + 86400, ps_id
+FROM   interceptbypasses
+WHERE  learned;
+DELETE FROM interceptbypasses WHERE learned;
 `
 	dbCache *cache.Cache
 )
@@ -130,6 +393,9 @@ type requestEntry struct {
 	Host             string
 	RemoteAddr       string
 	TLSHandshakeDone bool
+	ClientHello      *sniff.ClientHello // Set if the request was intercepted
+	StreamId         uint32             // Set if the request was received over HTTP/2
+	PseudoHeader     map[string]string
 	Response         *responseEntry
 }
 
@@ -143,6 +409,21 @@ type responseEntry struct {
 	ContentLength    int64
 	TransferEncoding []string
 	Close            bool
+	PseudoHeader     map[string]string
+}
+
+type webSocketMessageEntry struct {
+	Id         int64
+	Time       int64
+	FromClient bool
+	Opcode     byte
+	OpcodeName string
+	Payload    []byte
+	Length     int64
+	Compressed bool
+	Modified   bool
+	Dropped    bool
+	Injected   bool
 }
 
 // Splits a string containing SQL at each semicolon, runs each statement in
@@ -209,8 +490,27 @@ func initDB() error {
 func migrateDBFrom(v uint64) error {
 	var err error
 	migrations := map[uint64][]string{
-	// Version 1 is defaultDBSchema/defaultDBData
-	// 2: {dbMigrate002data},
+		// Version 1 is defaultDBSchema/defaultDBData
+		2:  {dbMigrate002},
+		3:  {dbMigrate003},
+		4:  {dbMigrate004},
+		5:  {dbMigrate005},
+		6:  {dbMigrate006},
+		7:  {dbMigrate007},
+		8:  {dbMigrate008},
+		9:  {dbMigrate009},
+		10: {dbMigrate010},
+		11: {dbMigrate011},
+		12: {dbMigrate012},
+		13: {dbMigrate013},
+		14: {dbMigrate014},
+		15: {dbMigrate015},
+		16: {dbMigrate016},
+		17: {dbMigrate017},
+		18: {dbMigrate018},
+		19: {dbMigrate019},
+		20: {dbMigrate020},
+		21: {dbMigrate021},
 	}
 	if v == 0 || v >= CurrentSchemaVersion {
 		return ErrInvalidSchemaVersion
@@ -305,12 +605,32 @@ func saveRequest(ps *proxyServer, req *http.Request) (int64, error) {
 	if req.TLS != nil {
 		handshakecomplete = req.TLS.HandshakeComplete
 	}
+	ch := sniff.ClientHelloFromRequest(req)
+	if ch == nil {
+		ch = &sniff.ClientHello{}
+	}
+	var clienthellojson []byte
+	if ch.JA4 != "" {
+		clienthellojson, err = json.Marshal(ch)
+		if err != nil {
+			log.Println("Failed to marshal ClientHello", ch)
+		}
+	}
+	pseudoheaderjson, err := marshalPseudoHeader(sniff.RequestPseudoHeader(req))
+	if err != nil {
+		log.Println("Failed to marshal request pseudo-header:", err)
+	}
 	now := time.Now().Unix()
 	row := db.QueryRow(`
 INSERT INTO requests(time, method, url, proto, header, contentlength,
-                     transferencoding, host, remoteaddr, tls, ps_id)
-VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-RETURNING   id`, now, req.Method, req.URL.String(), req.Proto, string(headerjson), req.ContentLength, string(transferencodingjson), req.Host, req.RemoteAddr, handshakecomplete, ps.Id)
+                     transferencoding, host, remoteaddr, tls, sni, tlsversion,
+                     tlsmaxversion, tlsciphersuite, alpn, ja3, ja4,
+                     tlsclienthello, streamid, pseudoheader, ps_id)
+VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+             $16, $17, $18, $19, $20, $21)
+RETURNING   id`, now, req.Method, req.URL.String(), req.Proto, string(headerjson), req.ContentLength, string(transferencodingjson), req.Host, req.RemoteAddr, handshakecomplete,
+		ch.ServerName, ch.Version, ch.MaxVersion(), ch.CipherSuite, ch.NegotiatedProtocol, ch.JA3Hash, ch.JA4, string(clienthellojson),
+		sniff.StreamIDFromRequest(req), pseudoheaderjson, ps.Id)
 	if err != nil {
 		log.Println("Failed to save request:", req, "- Error:", err)
 		return 0, err
@@ -337,11 +657,15 @@ func saveResponse(reqId int64, res *http.Response) (int64, error) {
 	if err != nil {
 		log.Println("Failed to marshal res.TransferEncoding", res.TransferEncoding)
 	}
+	pseudoheaderjson, err := marshalPseudoHeader(sniff.ResponsePseudoHeader(res))
+	if err != nil {
+		log.Println("Failed to marshal response pseudo-header:", err)
+	}
 	row := db.QueryRow(`
 INSERT INTO responses(time, status, statuscode, proto, header, contentlength,
-                      transferencoding, close, req_id)
-VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-RETURNING   id`, time.Now().Unix(), res.Status, res.StatusCode, res.Proto, string(headerjson), res.ContentLength, string(transferencodingjson), res.Close, reqId)
+                      transferencoding, close, pseudoheader, req_id)
+VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING   id`, time.Now().Unix(), res.Status, res.StatusCode, res.Proto, string(headerjson), res.ContentLength, string(transferencodingjson), res.Close, pseudoheaderjson, reqId)
 	var lid int64
 	err = row.Scan(&lid)
 	if err != nil {
@@ -351,6 +675,54 @@ RETURNING   id`, time.Now().Unix(), res.Status, res.StatusCode, res.Proto, strin
 	return lid, nil
 }
 
+func saveWebSocketMessage(reqId int64, m *proxy.WebSocketMessage) error {
+	_, err := db.Exec(`
+INSERT INTO websocketmessages(time, fromclient, opcode, payload, length,
+                              compressed, modified, dropped, injected, req_id)
+VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, m.Time.Unix(), m.FromClient, m.Opcode, base64.StdEncoding.EncodeToString(m.Payload), m.Length, m.Compressed, m.Modified, m.Dropped, m.Injected, reqId)
+	return err
+}
+
+func getWebSocketMessages(reqId int64) ([]webSocketMessageEntry, error) {
+	var res []webSocketMessageEntry
+	rows, err := db.Query(`
+SELECT   id, time, fromclient, opcode, payload, length, compressed,
+         modified, dropped, injected
+FROM     websocketmessages
+WHERE    req_id = $1
+ORDER BY id ASC`, reqId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			m       webSocketMessageEntry
+			payload string
+		)
+		err = rows.Scan(&m.Id, &m.Time, &m.FromClient, &m.Opcode, &payload, &m.Length, &m.Compressed, &m.Modified, &m.Dropped, &m.Injected)
+		if err != nil {
+			log.Println("Error scanning WebSocket message SQL:", err)
+			continue
+		}
+		m.Payload, err = base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			log.Println("Couldn't decode WebSocket message payload:", err)
+		}
+		m.OpcodeName = (&proxy.WebSocketMessage{Opcode: m.Opcode}).OpcodeName()
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// Returns the JSON-encoded pseudo-header fields, or "" if there are none
+func marshalPseudoHeader(ph map[string]string) (string, error) {
+	if ph == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ph)
+	return string(data), err
+}
+
 func getRequests(joinRes bool, constraint string, vals ...interface{}) ([]requestEntry, error) {
 	var (
 		rows *sql.Rows
@@ -362,18 +734,19 @@ func getRequests(joinRes bool, constraint string, vals ...interface{}) ([]reques
 SELECT     requests.id, requests.time, requests.method, requests.url,
            requests.proto, requests.header, requests.contentlength,
            requests.transferencoding, requests.host, requests.remoteaddr,
-           requests.tls,
+           requests.tls, requests.tlsclienthello, requests.streamid,
+           requests.pseudoheader,
 
            responses.id, responses.time, responses.status, responses.statuscode,
            responses.proto, responses.header, responses.contentlength,
-           responses.transferencoding, responses.close
+           responses.transferencoding, responses.close, responses.pseudoheader
 FROM       requests
 LEFT JOIN  responses
 ON         requests.id = responses.req_id `+constraint, vals...)
 	} else {
 		rows, err = db.Query(`
 SELECT id, time, method, url, proto, header, contentlength, transferencoding,
-       host, remoteaddr, tls
+       host, remoteaddr, tls, tlsclienthello, streamid, pseudoheader
 FROM   requests `+constraint, vals...)
 	}
 	if err != nil {
@@ -381,12 +754,12 @@ FROM   requests `+constraint, vals...)
 		return res, err
 	}
 	for rows.Next() {
-		var headerjson, transferencodingjson, rawurl string
+		var headerjson, transferencodingjson, clienthellojson, pseudoheaderjson, rawurl string
 		r := requestEntry{}
 		if joinRes {
-			var rehjson, retejson string
+			var rehjson, retejson, rephjson string
 			re := responseEntry{}
-			err = rows.Scan(&r.Id, &r.Time, &r.Method, &rawurl, &r.Proto, &headerjson, &r.ContentLength, &transferencodingjson, &r.Host, &r.RemoteAddr, &r.TLSHandshakeDone, &re.Id, &re.Time, &re.Status, &re.StatusCode, &re.Proto, &rehjson, &re.ContentLength, &retejson, &re.Close)
+			err = rows.Scan(&r.Id, &r.Time, &r.Method, &rawurl, &r.Proto, &headerjson, &r.ContentLength, &transferencodingjson, &r.Host, &r.RemoteAddr, &r.TLSHandshakeDone, &clienthellojson, &r.StreamId, &pseudoheaderjson, &re.Id, &re.Time, &re.Status, &re.StatusCode, &re.Proto, &rehjson, &re.ContentLength, &retejson, &re.Close, &rephjson)
 			if err == nil { // There is an error if the (joined) result can't be scanned
 				err = json.Unmarshal([]byte(rehjson), &re.Header)
 				if err != nil {
@@ -396,10 +769,16 @@ FROM   requests `+constraint, vals...)
 				if err != nil {
 					log.Println("Couldn't unmarshal transferencodingjson for request response:", err)
 				}
+				if rephjson != "" {
+					err = json.Unmarshal([]byte(rephjson), &re.PseudoHeader)
+					if err != nil {
+						log.Println("Couldn't unmarshal pseudoheaderjson for request response:", err)
+					}
+				}
 				r.Response = &re
 			}
 		} else {
-			err = rows.Scan(&r.Id, &r.Time, &r.Method, &rawurl, &r.Proto, &headerjson, &r.ContentLength, &transferencodingjson, &r.Host, &r.RemoteAddr, &r.TLSHandshakeDone)
+			err = rows.Scan(&r.Id, &r.Time, &r.Method, &rawurl, &r.Proto, &headerjson, &r.ContentLength, &transferencodingjson, &r.Host, &r.RemoteAddr, &r.TLSHandshakeDone, &clienthellojson, &r.StreamId, &pseudoheaderjson)
 			if err != nil {
 				log.Println("Error scanning SQL:", err, "Responses joined:", joinRes)
 				continue
@@ -417,6 +796,19 @@ FROM   requests `+constraint, vals...)
 		if err != nil {
 			log.Println("Couldn't parse URL for request:", err)
 		}
+		if clienthellojson != "" {
+			r.ClientHello = &sniff.ClientHello{}
+			err = json.Unmarshal([]byte(clienthellojson), r.ClientHello)
+			if err != nil {
+				log.Println("Couldn't unmarshal clienthellojson for request:", err)
+			}
+		}
+		if pseudoheaderjson != "" {
+			err = json.Unmarshal([]byte(pseudoheaderjson), &r.PseudoHeader)
+			if err != nil {
+				log.Println("Couldn't unmarshal pseudoheaderjson for request:", err)
+			}
+		}
 		res = append(res, r)
 	}
 	return res, nil
@@ -434,7 +826,8 @@ func getProxyServers(constraint string, vals ...interface{}) ([]*proxyServer, er
 	var res []*proxyServer
 	rows, err := db.Query(`
 SELECT id, name, port, certfile, keyfile, moderaterequests,
-       interceptssl, logrequests
+       interceptssl, logrequests, reverseproxy, certstore,
+       moderatewebsockets
 FROM   proxyservers `+constraint, vals...)
 	if err != nil {
 		log.Println("Error fetching requests (constraint "+constraint+"):", err)
@@ -443,13 +836,237 @@ FROM   proxyservers `+constraint, vals...)
 	for rows.Next() {
 		ps := &proxyServer{ps: &proxy.ProxyServer{}}
 		ps.ps.Handler = ps
-		err = rows.Scan(&ps.Id, &ps.Name, &ps.ps.Port, &ps.CertFile, &ps.KeyFile, &ps.ModerateRequests, &ps.InterceptSSL, &ps.LogRequests)
+		err = rows.Scan(&ps.Id, &ps.Name, &ps.ps.Port, &ps.CertFile, &ps.KeyFile, &ps.ModerateRequests, &ps.InterceptSSL, &ps.LogRequests, &ps.ps.ReverseProxy, &ps.CertStore, &ps.ModerateWebSockets)
 		if err != nil {
 			log.Println("Error scanning proxy server SQL:", err)
 		}
+		switch ps.CertStore {
+		case certStoreDB:
+			ps.ps.CertStore = &dbCertStore{}
+		case certStoreGenerate:
+			ps.ps.CertStore = proxy.NewGeneratedCertStore(config.terminatorCertFolder, nil)
+		}
 		ps.queue = queue.New()
+		ps.websockets = newWebSocketModerator()
+		ps.bypass = sniff.NewBypassList()
+		ps.audits = newServerTLSAudits()
 		res = append(res, ps)
 	}
+	for _, ps := range res {
+		if ps.ps.ReverseProxy {
+			ps.ps.ReverseRoutes, err = getReverseRoutes(ps.Id)
+			if err != nil {
+				log.Println("Error fetching reverse routes for proxy server", ps.Id, "-", err)
+			}
+		}
+		bypasses, err := getInterceptBypasses(ps.Id)
+		if err != nil {
+			log.Println("Error fetching intercept bypasses for proxy server", ps.Id, "-", err)
+		}
+		for _, v := range bypasses {
+			ps.bypass.Add(v)
+		}
+	}
+	return res, nil
+}
+
+// Returns the intercept bypasses added by hand, and the learned ones that
+// haven't expired
+func getInterceptBypasses(psId uint64) ([]*sniff.Bypass, error) {
+	var res []*sniff.Bypass
+	rows, err := db.Query(`
+SELECT pattern, false, reason, time, 0
+FROM   interceptbypasses
+WHERE  ps_id = $1
+UNION ALL
+SELECT pattern, true, reason, time, expires
+FROM   learnedbypasses
+WHERE  ps_id = $1 AND expires > $2`, psId, time.Now().Unix())
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			b          = &sniff.Bypass{}
+			t, expires int64
+		)
+		err = rows.Scan(&b.Pattern, &b.Learned, &b.Reason, &t, &expires)
+		if err != nil {
+			log.Println("Error scanning intercept bypass SQL:", err)
+			continue
+		}
+		b.Time = time.Unix(t, 0)
+		if b.Learned {
+			b.Expires = time.Unix(expires, 0)
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+func saveInterceptBypass(psId uint64, b *sniff.Bypass) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if b.Learned {
+		_, err = tx.Exec("DELETE FROM learnedbypasses WHERE ps_id = $1 AND pattern = $2", psId, b.Pattern)
+		if err == nil {
+			_, err = tx.Exec(`
+INSERT INTO learnedbypasses(pattern, reason, time, expires, ps_id)
+VALUES      ($1, $2, $3, $4, $5)`, b.Pattern, b.Reason, b.Time.Unix(), b.Expires.Unix(), psId)
+		}
+	} else {
+		// A bypass added by hand replaces a learned one
+		_, err = tx.Exec("DELETE FROM learnedbypasses WHERE ps_id = $1 AND pattern = $2", psId, b.Pattern)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM interceptbypasses WHERE ps_id = $1 AND pattern = $2", psId, b.Pattern)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+INSERT INTO interceptbypasses(pattern, learned, reason, time, ps_id)
+VALUES      ($1, $2, $3, $4, $5)`, b.Pattern, false, b.Reason, b.Time.Unix(), psId)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Deletes the intercept bypasses with the given pattern, whether they were added
+// by hand or learned
+func deleteInterceptBypass(psId uint64, pattern string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM interceptbypasses WHERE ps_id = $1 AND pattern = $2", psId, pattern)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM learnedbypasses WHERE ps_id = $1 AND pattern = $2", psId, pattern)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteLearnedBypasses(psId uint64) error {
+	_, err := db.Exec("DELETE FROM learnedbypasses WHERE ps_id = $1", psId)
+	return err
+}
+
+// Returns the recorded upstream servers, those with the most severe findings
+// first
+func getServerTLSs() ([]*sniff.ServerTLS, error) {
+	var res []*sniff.ServerTLS
+	rows, err := db.Query("SELECT servertls FROM servertls ORDER BY host ASC")
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			log.Println("Error scanning server TLS SQL:", err)
+			continue
+		}
+		st := &sniff.ServerTLS{}
+		err = json.Unmarshal([]byte(data), st)
+		if err != nil {
+			log.Println("Error unmarshaling server TLS:", err)
+			continue
+		}
+		res = append(res, st)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return severityRank[res[i].Severity()] > severityRank[res[j].Severity()]
+	})
+	return res, nil
+}
+
+func getServerTLS(host string) (*sniff.ServerTLS, error) {
+	var data string
+	row := db.QueryRow("SELECT servertls FROM servertls WHERE host = $1", host)
+	err := row.Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	st := &sniff.ServerTLS{}
+	err = json.Unmarshal([]byte(data), st)
+	return st, err
+}
+
+// Saves st, unless an identical connection to the host was saved in the last few
+// minutes
+func saveServerTLS(st *sniff.ServerTLS) error {
+	sig := st.VersionName() + "|" + st.CipherSuiteName() + "|" + st.HSTS + "|" + st.OCSPStatus
+	for _, v := range st.Chain {
+		sig += "|" + v.SHA256
+	}
+	for _, v := range st.Findings {
+		sig += "|" + v.Code
+	}
+	key := "servertls|" + st.Host
+	if last, found := dbCache.Get(key); found && last.(string) == sig {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM servertls WHERE host = $1", st.Host)
+	if err == nil {
+		_, err = tx.Exec(`
+INSERT INTO servertls(host, time, severity, findings, servertls)
+VALUES      ($1, $2, $3, $4, $5)`, st.Host, st.Time.Unix(), st.Severity(), len(st.Findings), string(data))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		dbCache.Set(key, sig, 0)
+	}
+	return err
+}
+
+func getReverseRoutes(psId uint64) ([]*proxy.ReverseRoute, error) {
+	var res []*proxy.ReverseRoute
+	rows, err := db.Query(`
+SELECT   host, pathprefix, origin, stripprefix, preservehost
+FROM     reverseroutes
+WHERE    ps_id = $1
+ORDER BY id ASC`, psId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			host, pathprefix, origin  string
+			stripprefix, preservehost bool
+		)
+		err = rows.Scan(&host, &pathprefix, &origin, &stripprefix, &preservehost)
+		if err != nil {
+			log.Println("Error scanning reverse route SQL:", err)
+			continue
+		}
+		rr, err := proxy.NewReverseRoute(host, pathprefix, origin)
+		if err != nil {
+			log.Println("Skipping invalid reverse route for proxy server", psId, "-", err)
+			continue
+		}
+		rr.StripPrefix = stripprefix
+		rr.PreserveHost = preservehost
+		res = append(res, rr)
+	}
 	return res, nil
 }
 
@@ -495,3 +1112,405 @@ FROM   dummyservers `+constraint, vals...)
 	}
 	return res, nil
 }
+
+func getLoadBalancers(constraint string, vals ...interface{}) ([]*loadBalancer, error) {
+	var res []*loadBalancer
+	rows, err := db.Query(`
+SELECT id, name, port, strategy, healthcheckpath, healthcheckhost,
+       healthcheckinterval, healthchecktimeout, healthcheckstatus,
+       healthcheckrise, healthcheckfall, outlierfailures, outlierejection,
+       retries, retrybudget, minretries, slowstart, stickycookie,
+       hashheader, protocol
+FROM   loadbalancers `+constraint, vals...)
+	if err != nil {
+		log.Println("Error fetching load balancers (constraint "+constraint+"):", err)
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			lb                = &loadBalancer{}
+			hc                = &proxy.HealthCheck{}
+			od                = &proxy.OutlierDetection{}
+			rp                = &proxy.RetryPolicy{}
+			interval, timeout int64
+			ejection          int64
+			budget            int
+			slowstart         int64
+		)
+		err = rows.Scan(&lb.Id, &lb.Name, &lb.Port, &lb.Strategy, &hc.Path, &hc.Host, &interval, &timeout, &hc.ExpectedStatus, &hc.Rise, &hc.Fall, &od.ConsecutiveFailures, &ejection, &rp.Attempts, &budget, &rp.MinRetries, &slowstart, &lb.stickyCookie, &lb.hashHeader, &lb.Protocol)
+		if err != nil {
+			log.Println("Error scanning load balancer SQL:", err)
+			continue
+		}
+		if od.ConsecutiveFailures > 0 {
+			od.EjectionTime = time.Duration(ejection) * time.Millisecond
+			lb.outlierDetection = od
+		}
+		if rp.Attempts > 0 {
+			rp.Budget = float64(budget) / 100
+			lb.retry = rp
+		}
+		lb.slowStart = time.Duration(slowstart) * time.Millisecond
+		if (hc.Path != "" || lb.Protocol == lbProtocolTCP) && interval > 0 {
+			hc.Interval = time.Duration(interval) * time.Millisecond
+			hc.Timeout = time.Duration(timeout) * time.Millisecond
+			lb.healthCheck = hc
+		}
+		res = append(res, lb)
+	}
+	for _, lb := range res {
+		routes, err := getLoadBalancerRoutes(lb.Id)
+		if err != nil {
+			log.Println("Error fetching routes for load balancer", lb.Id, "-", err)
+		}
+		lb.lb = proxy.NewHTTPLoadBalancer(routes, lb.Strategy)
+		lb.lb.Matches, err = getLoadBalancerMatches(lb.Id)
+		if err != nil {
+			log.Println("Error fetching route matches for load balancer", lb.Id, "-", err)
+		}
+		lb.lb.HealthCheck = lb.healthCheck
+		lb.lb.OutlierDetection = lb.outlierDetection
+		lb.lb.Retry = lb.retry
+		lb.lb.SlowStart = lb.slowStart
+		lb.lb.StickyCookie = lb.stickyCookie
+		lb.lb.HashHeader = lb.hashHeader
+		lb.tls, err = getLoadBalancerTLS(lb.Id)
+		if err != nil {
+			log.Println("Error fetching upstream TLS settings for load balancer", lb.Id, "-", err)
+		}
+		for k, v := range lb.tls {
+			ut, err := v.upstreamTLS()
+			if err != nil {
+				log.Println("Error loading upstream TLS settings for route", k, "of load balancer", lb.Id, "-", err)
+				continue
+			}
+			lb.lb.SetTLS(k, ut)
+		}
+		mirrors, err := getLoadBalancerMirrors(lb.Id)
+		if err != nil {
+			log.Println("Error fetching mirrors for load balancer", lb.Id, "-", err)
+		}
+		for k, v := range mirrors {
+			v.OnResult = lb.saveMirrorResult
+			lb.lb.SetMirror(k, v)
+		}
+		splits, err := getLoadBalancerSplits(lb.Id)
+		if err != nil {
+			log.Println("Error fetching canary splits for load balancer", lb.Id, "-", err)
+		}
+		for k, v := range splits {
+			lb.lb.SetSplit(k, v)
+		}
+		weights, err := getLoadBalancerWeights(lb.Id)
+		if err != nil {
+			log.Println("Error fetching backend weights for load balancer", lb.Id, "-", err)
+		}
+		for k, v := range weights {
+			// Weights of backends that aren't in any route are kept for when
+			// they are added back
+			lb.lb.SetWeight(k, v)
+		}
+		if lb.Protocol == lbProtocolTCP {
+			lb.tcp = proxy.NewTCPLoadBalancer(lb.lb, lbTCPRoute)
+			lb.tcp.Port = lb.Port
+			lb.tcp.OnClose = lb.saveConnection
+			continue
+		}
+		lb.ps = &proxy.ProxyServer{
+			Port:    lb.Port,
+			Handler: lb.lb,
+		}
+	}
+	return res, nil
+}
+
+func getLoadBalancerRoutes(lbId uint64) (map[string][]string, error) {
+	routes := map[string][]string{}
+	rows, err := db.Query(`
+SELECT   host, backend
+FROM     lbroutes
+WHERE    lb_id = $1
+ORDER BY id ASC`, lbId)
+	if err != nil {
+		return routes, err
+	}
+	for rows.Next() {
+		var host, backend string
+		err = rows.Scan(&host, &backend)
+		if err != nil {
+			log.Println("Error scanning load balancer route SQL:", err)
+			continue
+		}
+		routes[host] = append(routes[host], backend)
+	}
+	return routes, nil
+}
+
+func getLoadBalancerMatches(lbId uint64) ([]*proxy.RouteMatch, error) {
+	var res []*proxy.RouteMatch
+	rows, err := db.Query(`
+SELECT   route, priority, host, pathprefix, pathregexp, header, headervalue
+FROM     lbmatches
+WHERE    lb_id = $1
+ORDER BY id ASC`, lbId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			m  = &proxy.RouteMatch{}
+			re string
+		)
+		err = rows.Scan(&m.Route, &m.Priority, &m.Host, &m.PathPrefix, &re, &m.Header, &m.HeaderValue)
+		if err != nil {
+			log.Println("Error scanning load balancer route match SQL:", err)
+			continue
+		}
+		if re != "" {
+			m.PathRegexp, err = regexp.Compile(re)
+			if err != nil {
+				log.Println("Invalid path regexp for load balancer route", m.Route, "-", err)
+				continue
+			}
+		}
+		m.Host = strings.ToLower(m.Host)
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func getLoadBalancerTLS(lbId uint64) (map[string]*lbTLS, error) {
+	res := map[string]*lbTLS{}
+	rows, err := db.Query(`
+SELECT route, cafile, certfile, keyfile, servername, insecureskipverify
+FROM   lbtls
+WHERE  lb_id = $1`, lbId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			route string
+			t     = &lbTLS{}
+		)
+		err = rows.Scan(&route, &t.CAFile, &t.CertFile, &t.KeyFile, &t.ServerName, &t.InsecureSkipVerify)
+		if err != nil {
+			log.Println("Error scanning load balancer TLS SQL:", err)
+			continue
+		}
+		res[route] = t
+	}
+	return res, nil
+}
+
+func getLoadBalancerMirrors(lbId uint64) (map[string]*proxy.Mirror, error) {
+	res := map[string]*proxy.Mirror{}
+	rows, err := db.Query(`
+SELECT route, shadowroute, maxbodysize, maxinflight, timeout
+FROM   lbmirrors
+WHERE  lb_id = $1`, lbId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			route   string
+			m       = &proxy.Mirror{}
+			timeout int64
+		)
+		err = rows.Scan(&route, &m.Route, &m.MaxBodySize, &m.MaxInFlight, &timeout)
+		if err != nil {
+			log.Println("Error scanning load balancer mirror SQL:", err)
+			continue
+		}
+		m.Timeout = time.Duration(timeout) * time.Millisecond
+		res[route] = m
+	}
+	return res, nil
+}
+
+func getLoadBalancerSplits(lbId uint64) (map[string]*proxy.Split, error) {
+	res := map[string]*proxy.Split{}
+	rows, err := db.Query(`
+SELECT route, canaryroute, percent, header, headervalue, cookie, cookievalue
+FROM   lbsplits
+WHERE  lb_id = $1`, lbId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			route string
+			sp    = &proxy.Split{}
+		)
+		err = rows.Scan(&route, &sp.Route, &sp.Percent, &sp.Header, &sp.HeaderValue, &sp.Cookie, &sp.CookieValue)
+		if err != nil {
+			log.Println("Error scanning load balancer split SQL:", err)
+			continue
+		}
+		res[route] = sp
+	}
+	return res, nil
+}
+
+func saveLoadBalancerConnection(lbId uint64, cs *proxy.TCPConnStats) error {
+	_, err := db.Exec(`
+INSERT INTO lbconnections(time, client, backend, duration, bytesin, bytesout,
+                          error, lb_id)
+VALUES      ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		cs.Start.Unix(), cs.Client, cs.Backend, int64(cs.Duration/time.Microsecond),
+		cs.BytesIn, cs.BytesOut, cs.Error, lbId)
+	return err
+}
+
+func getLoadBalancerConnections(lbId uint64, limit int) ([]*proxy.TCPConnStats, error) {
+	var res []*proxy.TCPConnStats
+	rows, err := db.Query(`
+SELECT   time, client, backend, duration, bytesin, bytesout, error
+FROM     lbconnections
+WHERE    lb_id = $1
+ORDER BY id DESC
+LIMIT    $2`, lbId, limit)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			cs          = &proxy.TCPConnStats{}
+			t, duration int64
+		)
+		err = rows.Scan(&t, &cs.Client, &cs.Backend, &duration, &cs.BytesIn, &cs.BytesOut, &cs.Error)
+		if err != nil {
+			log.Println("Error scanning load balancer connection SQL:", err)
+			continue
+		}
+		cs.Start = time.Unix(t, 0)
+		cs.Duration = time.Duration(duration) * time.Microsecond
+		res = append(res, cs)
+	}
+	return res, nil
+}
+
+func saveMirrorResult(lbId uint64, r *proxy.MirrorResult) error {
+	_, err := db.Exec(`
+INSERT INTO mirrorresults(time, route, shadowroute, method, url,
+                          primarybackend, primarystatus, primarylatency,
+                          primaryerror, shadowbackend, shadowstatus,
+                          shadowlatency, shadowerror, lb_id)
+VALUES      ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		r.Time.Unix(), r.Route, r.ShadowRoute, r.Method, r.URL,
+		r.PrimaryBackend, r.PrimaryStatus, int64(r.PrimaryLatency/time.Microsecond),
+		r.PrimaryError, r.ShadowBackend, r.ShadowStatus,
+		int64(r.ShadowLatency/time.Microsecond), r.ShadowError, lbId)
+	return err
+}
+
+// mirrorSummary compares the primary and shadow responses for a mirrored route.
+type mirrorSummary struct {
+	Route          string
+	ShadowRoute    string
+	Requests       int64
+	StatusMismatch int64
+	ShadowErrors   int64
+	PrimaryLatency time.Duration // Average
+	ShadowLatency  time.Duration
+}
+
+func getMirrorSummaries(lbId uint64) ([]mirrorSummary, error) {
+	var res []mirrorSummary
+	rows, err := db.Query(`
+SELECT   route, shadowroute, COUNT(*),
+         SUM(CASE WHEN primarystatus <> shadowstatus THEN 1 ELSE 0 END),
+         SUM(CASE WHEN shadowerror <> '' THEN 1 ELSE 0 END),
+         AVG(primarylatency)::BIGINT, AVG(shadowlatency)::BIGINT
+FROM     mirrorresults
+WHERE    lb_id = $1
+GROUP BY route, shadowroute
+ORDER BY route, shadowroute`, lbId)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			ms                            mirrorSummary
+			primaryLatency, shadowLatency int64
+		)
+		err = rows.Scan(&ms.Route, &ms.ShadowRoute, &ms.Requests, &ms.StatusMismatch, &ms.ShadowErrors, &primaryLatency, &shadowLatency)
+		if err != nil {
+			log.Println("Error scanning mirror summary SQL:", err)
+			continue
+		}
+		ms.PrimaryLatency = time.Duration(primaryLatency) * time.Microsecond
+		ms.ShadowLatency = time.Duration(shadowLatency) * time.Microsecond
+		res = append(res, ms)
+	}
+	return res, nil
+}
+
+// getMirrorMismatches returns the latest mirrored requests whose primary and
+// shadow responses had different statuses.
+func getMirrorMismatches(lbId uint64, limit int) ([]*proxy.MirrorResult, error) {
+	var res []*proxy.MirrorResult
+	rows, err := db.Query(`
+SELECT   time, route, shadowroute, method, url, primarybackend, primarystatus,
+         primarylatency, primaryerror, shadowbackend, shadowstatus,
+         shadowlatency, shadowerror
+FROM     mirrorresults
+WHERE    lb_id = $1
+AND      primarystatus <> shadowstatus
+ORDER BY id DESC
+LIMIT    $2`, lbId, limit)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var (
+			r                                = &proxy.MirrorResult{}
+			t, primaryLatency, shadowLatency int64
+		)
+		err = rows.Scan(&t, &r.Route, &r.ShadowRoute, &r.Method, &r.URL, &r.PrimaryBackend, &r.PrimaryStatus, &primaryLatency, &r.PrimaryError, &r.ShadowBackend, &r.ShadowStatus, &shadowLatency, &r.ShadowError)
+		if err != nil {
+			log.Println("Error scanning mirror result SQL:", err)
+			continue
+		}
+		r.Time = time.Unix(t, 0)
+		r.PrimaryLatency = time.Duration(primaryLatency) * time.Microsecond
+		r.ShadowLatency = time.Duration(shadowLatency) * time.Microsecond
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func getLoadBalancerWeights(lbId uint64) (map[string]int, error) {
+	weights := map[string]int{}
+	rows, err := db.Query("SELECT addr, weight FROM lbbackends WHERE lb_id = $1", lbId)
+	if err != nil {
+		return weights, err
+	}
+	for rows.Next() {
+		var (
+			addr   string
+			weight int
+		)
+		err = rows.Scan(&addr, &weight)
+		if err != nil {
+			log.Println("Error scanning load balancer backend SQL:", err)
+			continue
+		}
+		weights[addr] = weight
+	}
+	return weights, nil
+}
+
+func getActiveLoadBalancer(lbIdStr string) (*loadBalancer, error) {
+	lbId, err := strconv.ParseUint(lbIdStr, 10, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid load balancer ID from client: %s", lbIdStr)
+	}
+	for _, v := range loadBalancers {
+		if v.Id == lbId {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("Load balancer does not exist, or it is not active")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"github.com/pmylund/sniffy/proxy"
+
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a removed backend may keep serving in-flight requests
+	lbDrainTimeout = 30 * time.Second
+
+	lbProtocolTCP = "tcp"
+	lbTCPRoute    = "*" // The route whose backends a TCP load balancer uses
+)
+
+var strategyNames = map[int]string{
+	proxy.StrategyFirst:        "First",
+	proxy.StrategyRandom:       "Random",
+	proxy.StrategyRoundrobin:   "Round robin",
+	proxy.StrategyFair:         "Least connections",
+	proxy.StrategyStickyCookie: "Sticky sessions",
+	proxy.StrategySourceIP:     "Source IP hash",
+	proxy.StrategyHash:         "Consistent hash",
+	proxy.StrategyLatency:      "Lowest latency",
+}
+
+type loadBalancer struct {
+	Id               uint64
+	Name             string
+	Port             uint16
+	Strategy         int
+	Protocol         string
+	healthCheck      *proxy.HealthCheck
+	outlierDetection *proxy.OutlierDetection
+	retry            *proxy.RetryPolicy
+	slowStart        time.Duration
+	stickyCookie     string
+	hashHeader       string
+	tls              map[string]*lbTLS // Upstream TLS settings per route
+	lb               *proxy.LoadBalancerHandler
+	ps               *proxy.ProxyServer
+	tcp              *proxy.TCPLoadBalancer // Used instead of ps if Protocol is tcp
+}
+
+// lbTLS holds the upstream TLS settings of a route as they are stored in the
+// database.
+type lbTLS struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (t *lbTLS) upstreamTLS() (*proxy.UpstreamTLS, error) {
+	ut, err := proxy.NewUpstreamTLS(t.CAFile, t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ut.ServerName = t.ServerName
+	ut.InsecureSkipVerify = t.InsecureSkipVerify
+	return ut, nil
+}
+
+func (lb *loadBalancer) StrategyName() string {
+	return strategyNames[lb.Strategy]
+}
+
+func (lb *loadBalancer) HealthChecked() bool {
+	return lb.lb.HealthCheck != nil
+}
+
+func (lb *loadBalancer) Backends() []proxy.BackendStatus {
+	return lb.lb.Status()
+}
+
+func (lb *loadBalancer) Routes() map[string][]string {
+	return lb.lb.ListRoutes()
+}
+
+// TLSDescription summarizes the upstream TLS settings of the route, if it has any.
+func (lb *loadBalancer) TLSDescription(route string) string {
+	t, found := lb.tls[route]
+	if !found {
+		return ""
+	}
+	var res []string
+	if t.CAFile != "" {
+		res = append(res, "CA "+t.CAFile)
+	}
+	if t.CertFile != "" {
+		res = append(res, "client certificate")
+	}
+	if t.ServerName != "" {
+		res = append(res, "SNI "+t.ServerName)
+	}
+	if t.InsecureSkipVerify {
+		res = append(res, "not verified")
+	}
+	return strings.Join(res, ", ")
+}
+
+func (lb *loadBalancer) Matches() []*proxy.RouteMatch {
+	return lb.lb.ListMatches()
+}
+
+func (lb *loadBalancer) saveMirrorResult(r *proxy.MirrorResult) {
+	err := saveMirrorResult(lb.Id, r)
+	if err != nil {
+		log.Println("Failed to save mirror result for load balancer", lb.Name, "-", err)
+	}
+}
+
+func (lb *loadBalancer) MirrorSummaries() []mirrorSummary {
+	res, err := getMirrorSummaries(lb.Id)
+	if err != nil {
+		log.Println("Error fetching mirror summaries for load balancer", lb.Name, "-", err)
+	}
+	return res
+}
+
+func (lb *loadBalancer) MirrorMismatches() []*proxy.MirrorResult {
+	res, err := getMirrorMismatches(lb.Id, 20)
+	if err != nil {
+		log.Println("Error fetching mirror mismatches for load balancer", lb.Name, "-", err)
+	}
+	return res
+}
+
+func (lb *loadBalancer) Splits() map[string]proxy.Split {
+	return lb.lb.ListSplits()
+}
+
+// setSplitPercent changes the share of the route's traffic that goes to its
+// canary group.
+func (lb *loadBalancer) setSplitPercent(route string, percent float64) error {
+	sp, found := lb.lb.ListSplits()[route]
+	if !found {
+		return fmt.Errorf("Route %s has no canary group", route)
+	}
+	_, err := db.Exec("UPDATE lbsplits SET percent = $1 WHERE route = $2 AND lb_id = $3", percent, route, lb.Id)
+	if err != nil {
+		return err
+	}
+	sp.Percent = percent
+	lb.lb.SetSplit(route, &sp)
+	return nil
+}
+
+// addBackend adds addr to the route for host, both in the database and in the
+// running load balancer.
+func (lb *loadBalancer) addBackend(host, addr string) error {
+	for _, v := range lb.lb.ListRoutes()[host] {
+		if v == addr {
+			return nil
+		}
+	}
+	_, err := db.Exec("INSERT INTO lbroutes (host, backend, lb_id) VALUES ($1, $2, $3)", host, addr, lb.Id)
+	if err != nil {
+		return err
+	}
+	lb.lb.AddBackend(host, addr)
+	weights, err := getLoadBalancerWeights(lb.Id)
+	if err != nil {
+		return err
+	}
+	if w, found := weights[addr]; found {
+		return lb.lb.SetWeight(addr, w)
+	}
+	return nil
+}
+
+// removeBackend removes addr from the route for host before returning. The
+// backend is drained in the background.
+func (lb *loadBalancer) removeBackend(host, addr string) error {
+	_, err := db.Exec("DELETE FROM lbroutes WHERE host = $1 AND backend = $2 AND lb_id = $3", host, addr, lb.Id)
+	if err != nil {
+		return err
+	}
+	drained := lb.lb.RemoveBackendAsync(host, addr, lbDrainTimeout)
+	go func() {
+		if !<-drained {
+			log.Println("Backend", addr, "of load balancer", lb.Name, "still had requests in flight after", lbDrainTimeout)
+		}
+	}()
+	return nil
+}
+
+func (lb *loadBalancer) setWeight(addr string, weight int) error {
+	known := false
+	for _, v := range lb.lb.Status() {
+		if v.Addr == addr {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("Unknown backend %s", addr)
+	}
+	res, err := db.Exec("UPDATE lbbackends SET weight = $1 WHERE addr = $2 AND lb_id = $3", weight, addr, lb.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		_, err = db.Exec("INSERT INTO lbbackends (addr, weight, lb_id) VALUES ($1, $2, $3)", addr, weight, lb.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return lb.lb.SetWeight(addr, weight)
+}
+
+func (lb *loadBalancer) IsTCP() bool {
+	return lb.tcp != nil
+}
+
+func (lb *loadBalancer) TCPStats() proxy.TCPStats {
+	return lb.tcp.Stats()
+}
+
+func (lb *loadBalancer) Connections() []*proxy.TCPConnStats {
+	res, err := getLoadBalancerConnections(lb.Id, 20)
+	if err != nil {
+		log.Println("Error fetching connections for load balancer", lb.Name, "-", err)
+	}
+	return res
+}
+
+func (lb *loadBalancer) saveConnection(cs *proxy.TCPConnStats) {
+	err := saveLoadBalancerConnection(lb.Id, cs)
+	if err != nil {
+		log.Println("Failed to save connection for load balancer", lb.Name, "-", err)
+	}
+}
+
+func (lb *loadBalancer) run() {
+	var err error
+	lb.lb.StartHealthChecks()
+	if lb.tcp != nil {
+		err = lb.tcp.ListenAndServe()
+	} else {
+		err = lb.ps.ListenAndServe()
+	}
+	if err != nil {
+		log.Println("Load balancer", lb.Name, "stopped:", err)
+	}
+	lb.lb.StopHealthChecks()
+}
@@ -13,6 +13,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"time"
 )
 
 const (
@@ -34,6 +36,7 @@ var (
 	logFile        = "sniffy.log"
 	db             *sql.DB
 	proxyServers   []*proxyServer
+	loadBalancers  []*loadBalancer
 	dummyServers   []*dummyServer
 	sslInterceptor *sniff.SSLInterceptor
 )
@@ -72,13 +75,14 @@ func boot() {
 	debug.Println("Settings loaded")
 
 	os.Mkdir(config.certFolder, 0755)
-	_, err = cert.GetOrGenerateKeyPair(config.webCertFile, config.webKeyFile, "web.sniffy.local", []string{"Sniffy"}, false, nil)
+	_, err = cert.GetOrGenerateKeyPair(config.webCertFile, config.webKeyFile, "web.sniffy.local", []string{"Sniffy"}, false, nil, config.webKeyType)
 	if err != nil {
 		log.Fatalln("Couldn't generate web interface RSA key pair:", err)
 	}
 
 	loadTemplates()
 
+	os.Mkdir(config.terminatorCertFolder, 0755)
 	pss, err := getProxyServers("")
 	if err != nil {
 		log.Println("Error starting proxy servers:", err)
@@ -88,8 +92,8 @@ func boot() {
 
 			go func(ps *proxyServer) {
 				var err error
-				if ps.CertFile != "" && ps.KeyFile != "" {
-					err = ps.ps.ListenAndServeTLS(v.CertFile, v.KeyFile)
+				if ps.CertFile != "" && ps.KeyFile != "" || ps.ps.CertStore != nil {
+					err = ps.ps.ListenAndServeTLS(ps.CertFile, ps.KeyFile)
 				} else {
 					err = ps.ps.ListenAndServe()
 				}
@@ -100,6 +104,16 @@ func boot() {
 		}
 	}
 
+	lbs, err := getLoadBalancers("")
+	if err != nil {
+		log.Println("Error starting load balancers:", err)
+	} else {
+		for _, v := range lbs {
+			loadBalancers = append(loadBalancers, v)
+			go v.run()
+		}
+	}
+
 	dss, err := getDummyServers("")
 	if err != nil {
 		log.Println("Error starting dummy servers:", err)
@@ -107,18 +121,28 @@ func boot() {
 		for _, v := range dss {
 			dummyServers = append(dummyServers, v)
 			if v.CertFile != "" && v.KeyFile != "" {
-				_, err = cert.GetOrGenerateKeyPair(v.CertFile, v.KeyFile, "dummy.sniffy.local", []string{"Sniffy"}, false, nil)
+				_, err = cert.GetOrGenerateKeyPair(v.CertFile, v.KeyFile, "dummy.sniffy.local", []string{"Sniffy"}, false, nil, config.dummyKeyType)
 			}
 			go v.ds.Run()
 		}
 	}
 
 	os.Mkdir(config.interceptorCertFolder, 0755)
-	sslInterceptor, err = sniff.NewSSLInterceptor(proxyServers[0], config.interceptorCACertFile, config.interceptorCAKeyFile)
+	sslInterceptor, err = sniff.NewSSLInterceptor(proxyServers[0], config.interceptorCACertFile, config.interceptorCAKeyFile, config.interceptorCAKeyType)
 	if err != nil {
 		log.Fatalln("Couldn't create SSL interceptor:", err)
 	}
-	if config.preloadInterceptorCerts {
+	sslInterceptor.KeyType = config.interceptorKeyType
+	sslInterceptor.Diskless = config.interceptorDiskless
+	sslInterceptor.HTTP2 = !config.interceptorNoHTTP2
+	if size, err := getIntSetting("InterceptorCacheSize"); err == nil && size >= 0 {
+		sslInterceptor.Cache.MaxSize = int(size)
+	}
+	if ttl, err := getIntSetting("InterceptorCacheTTL"); err == nil && ttl >= 0 {
+		sslInterceptor.Cache.TTL = time.Duration(ttl) * time.Second
+	}
+	// Diskless key pairs would all be generated anew
+	if config.preloadInterceptorCerts && !config.interceptorDiskless {
 		rows, err := db.Query("SELECT cn FROM certs")
 		if err == nil {
 			for rows.Next() {
@@ -193,10 +217,17 @@ type SniffyConfig struct {
 	certFolder              string
 	webCertFile             string
 	webKeyFile              string
+	terminatorCertFolder    string
 	preloadInterceptorCerts bool
+	interceptorDiskless     bool
+	interceptorNoHTTP2      bool
 	interceptorCertFolder   string
 	interceptorCACertFile   string
 	interceptorCAKeyFile    string
+	webKeyType              cert.KeyType
+	dummyKeyType            cert.KeyType
+	interceptorCAKeyType    cert.KeyType
+	interceptorKeyType      cert.KeyType
 }
 
 func loadConfig() (*SniffyConfig, error) {
@@ -234,11 +265,29 @@ func loadSettings() error {
 	config.certFolder = opts["CertFolder"]
 	config.webCertFile = opts["WebCertFile"]
 	config.webKeyFile = opts["WebKeyFile"]
+	config.terminatorCertFolder = path.Join(config.certFolder, "terminator")
 	if opts["PreloadInterceptorCerts"] == "1" {
 		config.preloadInterceptorCerts = true
 	}
+	if opts["InterceptorDiskless"] == "1" {
+		config.interceptorDiskless = true
+	}
+	if opts["InterceptorHTTP2"] == "0" {
+		config.interceptorNoHTTP2 = true
+	}
 	config.interceptorCertFolder = opts["InterceptorCertFolder"]
 	config.interceptorCACertFile = opts["InterceptorCACertFile"]
 	config.interceptorCAKeyFile = opts["InterceptorCAKeyFile"]
+	for k, v := range map[string]*cert.KeyType{
+		"WebKeyType":           &config.webKeyType,
+		"DummyKeyType":         &config.dummyKeyType,
+		"InterceptorCAKeyType": &config.interceptorCAKeyType,
+		"InterceptorKeyType":   &config.interceptorKeyType,
+	} {
+		*v, err = cert.ParseKeyType(opts[k])
+		if err != nil {
+			return fmt.Errorf("Invalid %s setting: %s", k, err)
+		}
+	}
 	return nil
 }
@@ -4,21 +4,49 @@ import (
 	"github.com/pmylund/sniffy/acl"
 	"github.com/pmylund/sniffy/common/queue"
 	"github.com/pmylund/sniffy/proxy"
+	"github.com/pmylund/sniffy/sniff"
 
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A host is bypassed once clients have rejected this many intercepted
+	// handshakes for it within learnBypassWindow, e.g. because they don't trust
+	// the CA, or pin certificates
+	learnBypassFailures = 3
+	learnBypassWindow   = 10 * time.Minute
+	learnedBypassTTL    = 24 * time.Hour
+
+	// How long an upstream server's TLS audit is reused while it keeps presenting
+	// the same certificate
+	serverTLSAuditTTL = time.Hour
 )
 
 type proxyServer struct {
-	Id               uint64
-	Name             string
-	CertFile         string
-	KeyFile          string
-	ModerateRequests bool
-	InterceptSSL     bool
-	LogRequests      bool
-	queue            *queue.Queue
-	ps               *proxy.ProxyServer
+	Id                 uint64
+	Name               string
+	CertFile           string
+	KeyFile            string
+	CertStore          string
+	ModerateRequests   bool
+	ModerateWebSockets bool
+	InterceptSSL       bool
+	LogRequests        bool
+	queue              *queue.Queue
+	websockets         *webSocketModerator
+	bypass             *sniff.BypassList // Hosts that aren't intercepted
+	audits             *serverTLSAudits
+	ps                 *proxy.ProxyServer
 }
 
 func (ps *proxyServer) HandleIntercept(w http.ResponseWriter, req *http.Request, origReq *http.Request) {
@@ -57,12 +85,41 @@ func (ps *proxyServer) HandleProxy(s *proxy.ProxySession) {
 		}
 	}
 	err := s.GetResponse()
+	if req.URL.Scheme == "https" {
+		ps.auditServerTLS(req.URL.Host, s.Response, err)
+	}
 	if err != nil {
 		log.Println("Error proxying request:", err)
 		http.Error(s.W, "This page is temporarily unavailable", http.StatusServiceUnavailable)
 		return
 	}
 	res := s.Response
+	var (
+		messages chan *proxy.WebSocketMessage
+		ws       *webSocket
+	)
+	if ps.LogRequests && res.StatusCode == http.StatusSwitchingProtocols {
+		messages = make(chan *proxy.WebSocketMessage, 1024)
+		s.WebSocketHandler = func(m *proxy.WebSocketMessage) {
+			select {
+			case messages <- m:
+			default:
+				log.Println("Not saving WebSocket message for", req.URL, "- too many are waiting to be saved")
+			}
+		}
+		ws = ps.websockets.addSocket(s, req.URL.String())
+		defer func() {
+			// Nothing can be injected, and so handled, once the socket is gone
+			ps.websockets.removeSocket(ws)
+			close(messages)
+		}()
+		s.WebSocketFilter = func(m *proxy.WebSocketMessage) *proxy.WebSocketMessage {
+			if !ps.ModerateWebSockets {
+				return m
+			}
+			return ps.websockets.hold(ws, m)
+		}
+	}
 	if ps.LogRequests {
 		go func() {
 			lid := <-ch
@@ -70,6 +127,16 @@ func (ps *proxyServer) HandleProxy(s *proxy.ProxySession) {
 			if err != nil {
 				log.Println("Failed to save request", lid, "response:", res, "- Error:", err)
 			}
+			if messages == nil {
+				return
+			}
+			ps.websockets.setReqId(ws, lid)
+			for m := range messages {
+				err = saveWebSocketMessage(lid, m)
+				if err != nil {
+					log.Println("Failed to save request", lid, "WebSocket message - Error:", err)
+				}
+			}
 		}()
 	}
 
@@ -80,13 +147,198 @@ func (ps *proxyServer) HandleProxy(s *proxy.ProxySession) {
 		fmt.Fprintf(s.W, "Access denied")
 		return
 	}
-	if req.Method == "CONNECT" && ps.InterceptSSL {
-		sslInterceptor.Intercept(s.W, req)
+	if req.Method == "CONNECT" && ps.InterceptSSL && ps.bypass.Match(req.URL.Host) == nil {
+		err = sslInterceptor.Intercept(s.W, req)
+		if he, ok := err.(*sniff.HandshakeError); ok {
+			ps.learnBypass(he)
+		}
 	} else {
 		s.Do()
 	}
 }
 
+var severityRank = map[string]int{
+	sniff.SeverityHigh:   3,
+	sniff.SeverityMedium: 2,
+	sniff.SeverityLow:    1,
+}
+
+// auditServerTLS records the TLS connection to the upstream server of an https
+// request, or the certificate the connection was refused for. A server is only
+// audited again once it presents a different certificate, or serverTLSAuditTTL
+// has passed.
+func (ps *proxyServer) auditServerTLS(host string, res *http.Response, err error) {
+	if h, port, serr := net.SplitHostPort(host); serr == nil && port == "443" {
+		host = h
+	}
+	host = strings.ToLower(host)
+	var roots *x509.CertPool
+	if t := ps.ps.Transport; t != nil && t.TLSClientConfig != nil {
+		roots = t.TLSClientConfig.RootCAs
+	}
+	leaf := serverCertificate(res, err)
+	if leaf == nil {
+		return
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	if !ps.audits.due(host, hex.EncodeToString(sum[:]), time.Now()) {
+		return
+	}
+	var st *sniff.ServerTLS
+	if err != nil {
+		st = sniff.AuditServerTLSError(host, err, roots)
+	} else if res.TLS != nil {
+		st = sniff.AuditServerTLS(host, res.TLS, res.Header, roots)
+	}
+	if st == nil {
+		return
+	}
+	go func() {
+		err := saveServerTLS(st)
+		if err != nil {
+			log.Println("Failed to save TLS connection to", host, "- Error:", err)
+		}
+	}()
+}
+
+// serverCertificate returns the leaf certificate the upstream server presented,
+// whether or not it could be verified, or nil if there is none.
+func serverCertificate(res *http.Response, err error) *x509.Certificate {
+	var certs []*x509.Certificate
+	if err != nil {
+		var cve *tls.CertificateVerificationError
+		if errors.As(err, &cve) {
+			certs = cve.UnverifiedCertificates
+		}
+	} else if res.TLS != nil {
+		certs = res.TLS.PeerCertificates
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// serverTLSAudits remembers which certificate each upstream server was last
+// audited with, so that the chain is only verified again when it changes, or
+// after serverTLSAuditTTL.
+type serverTLSAudits struct {
+	audited map[string]serverTLSAudit
+	mu      *sync.Mutex
+}
+
+type serverTLSAudit struct {
+	fingerprint string
+	expires     time.Time
+}
+
+// due reports whether host, presenting the certificate with the given
+// fingerprint, should be audited, and if so, marks it as audited.
+func (sa *serverTLSAudits) due(host, fingerprint string, now time.Time) bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if a, found := sa.audited[host]; found && a.fingerprint == fingerprint && now.Before(a.expires) {
+		return false
+	}
+	for k, v := range sa.audited {
+		if !now.Before(v.expires) {
+			delete(sa.audited, k)
+		}
+	}
+	sa.audited[host] = serverTLSAudit{
+		fingerprint: fingerprint,
+		expires:     now.Add(serverTLSAuditTTL),
+	}
+	return true
+}
+
+func newServerTLSAudits() *serverTLSAudits {
+	sa := serverTLSAudits{
+		audited: map[string]serverTLSAudit{},
+		mu:      &sync.Mutex{},
+	}
+	return &sa
+}
+
+// learnBypass tunnels the host of a rejected intercepted handshake for
+// learnedBypassTTL once clients have rejected learnBypassFailures handshakes for
+// it within learnBypassWindow.
+func (ps *proxyServer) learnBypass(he *sniff.HandshakeError) {
+	now := time.Now()
+	b := &sniff.Bypass{
+		Pattern: he.Host,
+		Learned: true,
+		Reason:  he.Err.Error(),
+		Time:    now,
+		Expires: now.Add(learnedBypassTTL),
+	}
+	if !sniff.ValidBypassPattern(b.Pattern) {
+		return
+	}
+	n := ps.bypass.RecordFailure(b.Pattern, learnBypassWindow)
+	if n < learnBypassFailures {
+		log.Println("Client rejected intercepted handshake for", b.Pattern, "on proxy server", ps.Id, fmt.Sprintf("(%d of %d before it is bypassed):", n, learnBypassFailures), he)
+		return
+	}
+	log.Println("Not intercepting", b.Pattern, "for proxy server", ps.Id, "until", b.Expires.Format(time.RFC1123), "after", he)
+	ps.bypass.Add(b)
+	err := saveInterceptBypass(ps.Id, b)
+	if err != nil {
+		log.Println("Couldn't save intercept bypass", b.Pattern, "for proxy server", ps.Id, "-", err)
+	}
+}
+
+func (ps *proxyServer) addBypass(pattern string) error {
+	pattern = strings.ToLower(pattern)
+	if !sniff.ValidBypassPattern(pattern) {
+		return fmt.Errorf("Invalid host pattern %q", pattern)
+	}
+	b := &sniff.Bypass{
+		Pattern: pattern,
+		Time:    time.Now(),
+	}
+	err := saveInterceptBypass(ps.Id, b)
+	if err != nil {
+		return err
+	}
+	ps.bypass.Add(b)
+	return nil
+}
+
+func (ps *proxyServer) removeBypass(pattern string) error {
+	err := deleteInterceptBypass(ps.Id, strings.ToLower(pattern))
+	if err != nil {
+		return err
+	}
+	ps.bypass.Remove(pattern)
+	return nil
+}
+
+// clearLearnedBypasses removes the bypasses that were learned from rejected
+// handshakes.
+func (ps *proxyServer) clearLearnedBypasses() error {
+	err := deleteLearnedBypasses(ps.Id)
+	if err != nil {
+		return err
+	}
+	ps.bypass.ClearLearned()
+	return nil
+}
+
+// Bypasses returns the hosts that aren't intercepted.
+func (ps *proxyServer) Bypasses() []*sniff.Bypass {
+	return ps.bypass.List()
+}
+
+func (ps *proxyServer) HasLearnedBypasses() bool {
+	for _, v := range ps.bypass.List() {
+		if v.Learned {
+			return true
+		}
+	}
+	return false
+}
+
 func (ps *proxyServer) toggleLogRequests() bool {
 	ps.LogRequests = !ps.LogRequests
 	_, err := db.Exec("UPDATE proxyservers SET logrequests = $1 WHERE id = $2", ps.LogRequests, ps.Id)
@@ -105,6 +357,18 @@ func (ps *proxyServer) toggleInterceptSSL() bool {
 	return ps.InterceptSSL
 }
 
+func (ps *proxyServer) toggleModerateWebSockets() bool {
+	ps.ModerateWebSockets = !ps.ModerateWebSockets
+	if !ps.ModerateWebSockets {
+		ps.websockets.flush()
+	}
+	_, err := db.Exec("UPDATE proxyservers SET moderatewebsockets = $1 WHERE id = $2", ps.ModerateWebSockets, ps.Id)
+	if err != nil {
+		log.Println("Couldn't update proxyserver", ps.Id, "status, but instance's ModerateWebSockets toggled")
+	}
+	return ps.ModerateWebSockets
+}
+
 func (ps *proxyServer) toggleModerateRequests() bool {
 	if ps.ModerateRequests {
 		ps.queue.Flush()
@@ -9,6 +9,8 @@ var PAGES = {
     "": "", // Universal constructors
     "/auditor/dashboard": "auditor_dashboard",
     "/auditor/interceptor": "auditor_interceptor",
+    "/loadbalancer": "loadbalancer_dashboard",
+    "/loadbalancer/stats": "loadbalancer_stats",
 };
 
 function getPage(url) {
@@ -120,6 +122,9 @@ addConstructor("", function() {
     getProxyServerSelector().change(function() {
         setHash(getPath() + "?ps=" + getProxyServerId());
     });
+    getLoadBalancerSelector().change(function() {
+        setHash(getPath() + "?lb=" + getLoadBalancerId());
+    });
 });
 
 ////
@@ -176,7 +181,7 @@ function fadeOut($x, dur, cb) {
 ////
 
 var escapeChars = {
-    "&": "amp;",
+    "&": "&amp;",
     "<": "&lt;",
     ">": "&gt;",
     '"': "&quot;",
@@ -187,7 +192,7 @@ var escapeChars = {
 function escape(s) {
     if (s != null) {
 	for (var k in escapeChars) {
-	    s = s.replace(k, escapeChars[k]);
+	    s = s.split(k).join(escapeChars[k]);
 	};
     };
     return s;
@@ -218,12 +223,35 @@ function sanitizeRequest(r) {
     };
     r.Host = escape(r.Host);
     r.RemoteAddr = escape(r.RemoteAddr);
+    if (r.ClientHello != null) {
+	var ch = r.ClientHello;
+	ch.ServerName = escape(ch.ServerName);
+	ch.NegotiatedProtocol = escape(ch.NegotiatedProtocol);
+	ch.JA3 = escape(ch.JA3);
+	ch.JA3Hash = escape(ch.JA3Hash);
+	ch.JA4 = escape(ch.JA4);
+	if (ch.ALPN != null) {
+	    ch.ALPN = $.map(ch.ALPN, escape);
+	};
+    };
+    r.PseudoHeader = sanitizePseudoHeader(r.PseudoHeader);
     if (r.Response != null) {
 	r.Response = sanitizeResponse(r.Response);
     };
     return r
 };
 
+function sanitizePseudoHeader(h) {
+    if (h == null) {
+	return null;
+    };
+    var newHeader = {};
+    $.each(h, function(k, v) {
+	newHeader[escape(k)] = escape(v);
+    });
+    return newHeader;
+};
+
 function sanitizeResponse(r) {
     r.Status = escape(r.Status);
     r.Proto = escape(r.Proto);
@@ -241,6 +269,7 @@ function sanitizeResponse(r) {
 	});
 	r.TransferEncoding = newTransferEncoding;
     };
+    r.PseudoHeader = sanitizePseudoHeader(r.PseudoHeader);
     return r
 };
 
@@ -277,6 +306,156 @@ function urlToTable(u) {
     };
 };
 
+var TLS_VERSIONS = {
+    768: "SSL 3.0",
+    769: "TLS 1.0",
+    770: "TLS 1.1",
+    771: "TLS 1.2",
+    772: "TLS 1.3",
+};
+
+function tlsVersionName(v) {
+    return TLS_VERSIONS[v] || "0x"+v.toString(16);
+};
+
+function hexList(l) {
+    return $.map(l || [], function(v) {
+	return "0x"+("000"+v.toString(16)).slice(-4);
+    }).join(", ");
+};
+
+// Links to the requests made by clients with the same fingerprint
+function fingerprintLink(fp) {
+    return '<a href="/auditor/interceptor?ps='+getProxyServerId()+'&fingerprint='+fp+'">'+fp+'</a>';
+};
+
+function clientHelloToTable(ch) {
+    if (ch == null) {
+	return "";
+    };
+    var rows = [
+	["Server name", ch.ServerName],
+	["Negotiated", tlsVersionName(ch.Version)+", cipher suite "+hexList([ch.CipherSuite])+(ch.NegotiatedProtocol ? ", "+ch.NegotiatedProtocol : "")],
+	["Versions", $.map(ch.Versions || [], tlsVersionName).join(", ")],
+	["Cipher suites", hexList(ch.CipherSuites)],
+	["Extensions", hexList(ch.Extensions)],
+	["Curves", hexList(ch.Curves)],
+	["ALPN", (ch.ALPN || []).join(", ")],
+	["JA3", fingerprintLink(ch.JA3Hash)+"<br />"+ch.JA3],
+	["JA4", fingerprintLink(ch.JA4)],
+    ];
+    var html = '<table class="condensed-table bordered-table" style="table-layout: fixed; word-wrap: break-word;"><thead><tr><th width="20%">Name</th><th width="80%">Value</th></tr></thead><tbody>';
+    $.each(rows, function(i, v) {
+	html += "<tr><td>"+v[0]+"</td><td>"+v[1]+"</td></tr>";
+    });
+    html += "</tbody></table>";
+    return html;
+};
+
+// Shows text messages as text, and others in hex
+function webSocketPayload(m) {
+    var raw = atob(m.Payload || "");
+    var html;
+    if (m.Opcode == 1 && !m.Compressed) {
+	try {
+	    html = escape(decodeURIComponent(percentEncode(raw)));
+	} catch (e) {
+	    html = null;
+	};
+    };
+    if (html == null) {
+	var hex = [];
+	for (var i = 0; i < raw.length && i < 256; i++) {
+	    hex.push(("0"+raw.charCodeAt(i).toString(16)).slice(-2));
+	};
+	html = "<code>"+hex.join(" ")+(raw.length > 256 ? " ..." : "")+"</code>";
+    };
+    if (m.Length > raw.length) {
+	html += "<br /><small>First "+raw.length+" of "+m.Length+" bytes</small>";
+    };
+    return html;
+};
+
+// Percent-encodes a binary string so decodeURIComponent can decode it as UTF-8
+function percentEncode(s) {
+    var res = "";
+    for (var i = 0; i < s.length; i++) {
+	res += "%"+("0"+s.charCodeAt(i).toString(16)).slice(-2);
+    };
+    return res;
+};
+
+function webSocketMessagesToTable(msgs) {
+    var html = '<p>WebSocket messages:</p><table class="condensed-table bordered-table" style="table-layout: fixed; word-wrap: break-word;"><thead><tr><th width="20%">Time</th><th width="10%">Direction</th><th width="10%">Type</th><th width="60%">Payload</th></tr></thead><tbody>';
+    $.each(msgs, function(i, m) {
+	html += "<tr><td>"+new Date(m.Time * 1000).toLocaleTimeString()+"</td><td>"+(m.FromClient ? "Client &rarr; server" : "Server &rarr; client")+"</td><td>"+escape(m.OpcodeName)+(m.Compressed ? " (compressed)" : "")+webSocketLabel(m)+"</td><td>"+webSocketPayload(m)+"</td></tr>";
+    });
+    html += "</tbody></table>";
+    return html;
+};
+
+function webSocketLabel(m) {
+    if (m.Dropped) {
+	return ' <span class="label important">Dropped</span>';
+    } else if (m.Modified) {
+	return ' <span class="label warning">Edited</span>';
+    } else if (m.Injected) {
+	return ' <span class="label notice">Injected</span>';
+    };
+    return "";
+};
+
+// Returns the payload of a message as text if it is UTF-8 text, or else base64,
+// and which it is
+function webSocketEditablePayload(m) {
+    if (m.Opcode == 1 && !m.Compressed) {
+	try {
+	    return {payload: decodeURIComponent(percentEncode(atob(m.Payload || ""))), encoding: "text"};
+	} catch (e) {
+	};
+    };
+    return {payload: m.Payload || "", encoding: "base64"};
+};
+
+function webSocketInjectForm(id) {
+    return '\
+<form id="injectwebsocket-'+id+'" class="form-stacked">\
+    <p>Send a message:</p>\
+    <select name="direction" class="small">\
+	<option value="server">To the server</option>\
+	<option value="client">To the client</option>\
+    </select>\
+    <select name="opcode" class="small">\
+	<option value="text">Text</option>\
+	<option value="binary">Binary (base64)</option>\
+    </select>\
+    <textarea name="payload" class="xxlarge" rows="3"></textarea>\
+    <input type="submit" class="btn small" value="Send" />\
+</form>';
+};
+
+function injectWebSocketMessage(id, $form) {
+    var opcode = $form.find("select[name=opcode]").val();
+    $.ajax({
+	url: "/auditor/json/injectwebsocket",
+	type: "POST",
+	data: {
+	    "ps": getProxyServerId(),
+	    "id": id,
+	    "direction": $form.find("select[name=direction]").val(),
+	    "opcode": opcode,
+	    "payload": $form.find("textarea[name=payload]").val(),
+	    "encoding": opcode == "binary" ? "base64" : "text",
+	},
+	success: function() {
+	    $form.find("textarea[name=payload]").val("");
+	},
+	error: function(xhr) {
+	    alert(xhr.responseText);
+	},
+    });
+};
+
 function encodingToList(e) {
     var html = "<ul>"
     $.each(e, function(i, v) {
@@ -329,6 +508,14 @@ function getProxyServerId() {
     return getProxyServerSelector().find("option:selected").val();
 };
 
+function getLoadBalancerSelector() {
+    return $("select#loadbalancer")
+};
+
+function getLoadBalancerId() {
+    return getLoadBalancerSelector().find("option:selected").val();
+};
+
 ////
 // Auditor/Interceptor
 ////
@@ -357,6 +544,25 @@ function getDetailRow(id, cb) {
 		} else {
 		    detailresheaderhtml = headerToTable(v.Response.Header);
 		};
+		var detailreqprotohtml = v.Proto;
+		if (v.StreamId) {
+		    detailreqprotohtml += ", stream "+v.StreamId;
+		};
+		var detailreqpseudohtml = "";
+		if (v.PseudoHeader != null) {
+		    detailreqpseudohtml = headerToTable(v.PseudoHeader);
+		};
+		var detailrespseudohtml = "";
+		if (v.Response.PseudoHeader != null) {
+		    detailrespseudohtml = headerToTable(v.Response.PseudoHeader);
+		};
+		var detailwebsockethtml = "";
+		if (data.messages != null) {
+		    detailwebsockethtml = webSocketMessagesToTable(data.messages);
+		};
+		if (v.Response.StatusCode == 101) {
+		    detailwebsockethtml += webSocketInjectForm(v.Id);
+		};
 		var detailreqencodinghtml = ""
 		if (v.TransferEncoding != null) {
 		    detailreqencodinghtml = encodingToList(v.TransferEncoding);
@@ -399,7 +605,11 @@ function getDetailRow(id, cb) {
 			</tr>\
 			<tr>\
 			    <td>Protocol</td>\
-			    <td>'+v.Proto+'</td>\
+			    <td>'+detailreqprotohtml+'</td>\
+			</tr>\
+			<tr>\
+			    <td>Pseudo-header</td>\
+			    <td>'+detailreqpseudohtml+'</td>\
 			</tr>\
 			<tr>\
 			    <td>Header</td>\
@@ -425,6 +635,10 @@ function getDetailRow(id, cb) {
 			    <td>SSL</td>\
 			    <td>'+v.TLSHandshakeDone+'</td>\
 			</tr>\
+			<tr>\
+			    <td>TLS Client</td>\
+			    <td>'+clientHelloToTable(v.ClientHello)+'</td>\
+			</tr>\
 			<tr>\
 			    <td>Actions</td>\
 			    <td>\
@@ -460,6 +674,10 @@ function getDetailRow(id, cb) {
 			    <td>Protocol</td>\
 			    <td>'+v.Response.Proto+'</td>\
 			</tr>\
+			<tr>\
+			    <td>Pseudo-header</td>\
+			    <td>'+detailrespseudohtml+'</td>\
+			</tr>\
 			<tr>\
 			    <td>Header</td>\
 			    <td>'+detailresheaderhtml+'</td>\
@@ -482,6 +700,7 @@ function getDetailRow(id, cb) {
 	    </tr>\
 	</tbody>\
 	</table>\
+	'+detailwebsockethtml+'\
     </td>\
 </tr>';
 		cb(detailhtml);
@@ -696,6 +915,10 @@ function insertRequestRow(r, after, cb) {
 		$("button#analyze-"+r.Id).click(function() {
 		    showAnalyzeModal(r);
 		});
+		$("form#injectwebsocket-"+r.Id).submit(function(e) {
+		    e.preventDefault();
+		    injectWebSocketMessage(r.Id, $(this));
+		});
 	    });
 	};
     });
@@ -703,12 +926,15 @@ function insertRequestRow(r, after, cb) {
 };
 
 function getRequests(psId, since, cb) {
+    var $filter = $("form#tlsfilter");
     $.ajax({
 	url: "/auditor/json/getrequests",
 	data: {
 	    ps: psId,
 	    since: since,
 	    type: "summary",
+	    tls: $filter.find("select[name=tls]").val() || "",
+	    fingerprint: $filter.find("input[name=fingerprint]").val() || "",
 	},
 	dataType: "json",
 	contentType: "application/json",
@@ -720,10 +946,10 @@ function getRequests(psId, since, cb) {
 		});
 	    }
 	    since = data.since;
-	    cb(since, data.rs, data.queue); // Will the sanitized ones be returned?
+	    cb(since, data.rs, data.queue, data.wsqueue); // Will the sanitized ones be returned?
 	},
 	error: function() {
-	    cb(since, null, null);
+	    cb(since, null, null, null);
 	},
     });
 };
@@ -743,7 +969,8 @@ function pollAndInsertRequests(psId, since, interval, insertAfter) {
 	POLLING_STOP = false;
 	return;
     };
-    getRequests(psId, since, function(newSince, rs, queue) {
+    getRequests(psId, since, function(newSince, rs, queue, wsqueue) {
+	updateWebSocketQueue(wsqueue);
 	if (rs != null) {
 	    $.each(rs, function(i, r) {
 		insertRequestRow(r, insertAfter, function(row) {
@@ -762,6 +989,62 @@ function pollAndInsertRequests(psId, since, interval, insertAfter) {
     });
 };
 
+// Shows the WebSocket messages that are waiting to be moderated, leaving the
+// rows of ones that are still waiting as they are, since they may be being
+// edited
+function updateWebSocketQueue(msgs) {
+    var $table = $("table#wsqueue");
+    var ids = {};
+    $.each(msgs || [], function(i, m) {
+	ids[m.Id] = true;
+	if ($table.find("tr#wsmessage-"+m.Id).length > 0) {
+	    return;
+	};
+	var p = webSocketEditablePayload(m);
+	$table.find("tbody").append('\
+<tr id="wsmessage-'+m.Id+'" data-id="'+m.Id+'" data-encoding="'+p.encoding+'">\
+    <td>'+new Date(m.Time * 1000).toLocaleTimeString()+'</td>\
+    <td>'+escape(m.URL)+'</td>\
+    <td>'+(m.FromClient ? "Client &rarr; server" : "Server &rarr; client")+'</td>\
+    <td>'+escape(m.OpcodeName)+(p.encoding == "base64" ? " (base64)" : "")+'</td>\
+    <td><textarea class="xxlarge" rows="3">'+escape(p.payload)+'</textarea></td>\
+    <td>\
+	<button class="btn small success forward">Forward</button>\
+	<button class="btn small danger drop">Drop</button>\
+    </td>\
+</tr>');
+    });
+    $table.find("tbody tr").each(function() {
+	if (!ids[$(this).data("id")]) {
+	    $(this).remove();
+	};
+    });
+    $("div#wsqueue").toggle(msgs != null && msgs.length > 0);
+};
+
+function moderateWebSocketMessage($row, action) {
+    var data = {
+	"ps": getProxyServerId(),
+	"id": $row.data("id"),
+	"action": action,
+    };
+    if (action == "forward") {
+	data.payload = $row.find("textarea").val();
+	data.encoding = $row.data("encoding");
+    };
+    $.ajax({
+	url: "/auditor/json/moderatewebsocket",
+	type: "POST",
+	data: data,
+	success: function() {
+	    $row.remove();
+	},
+	error: function(xhr) {
+	    alert(xhr.responseText);
+	},
+    });
+};
+
 addConstructor("auditor_interceptor", function() {
     addDestructor(function() {
 	POLLING_STOP = true;
@@ -856,4 +1139,307 @@ addConstructor("auditor_interceptor", function() {
     if (modbutton.hasClass("on")) {
 	modbutton.button("toggle");
     };
+
+    // Moderate WebSockets button
+    var wsmodbutton = $("button#togglewsmoderation");
+    function toggleWebSocketModeration() {
+	$.ajax({
+	    url: "/auditor/json/toggle",
+	    data: {
+		"option": "moderatewebsockets",
+	    },
+	    success: function(data) { wsmodbutton.button("toggle"); },
+	});
+    };
+    wsmodbutton.click(toggleWebSocketModeration);
+    if (wsmodbutton.hasClass("on")) {
+	wsmodbutton.button("toggle");
+    };
+
+    // Paused WebSocket messages
+    var $wsqueue = $("table#wsqueue");
+    $wsqueue.delegate("button.forward", "click", function() {
+	moderateWebSocketMessage($(this).closest("tr"), "forward");
+    });
+    $wsqueue.delegate("button.drop", "click", function() {
+	moderateWebSocketMessage($(this).closest("tr"), "drop");
+    });
+
+    // Client TLS filter
+    $("form#tlsfilter").submit(function(e) {
+	e.preventDefault();
+	setHash(getPath()+"?ps="+getProxyServerId()+"&"+$(this).serialize());
+    });
+
+    // Hosts that aren't intercepted
+    function updateBypass(action, pattern) {
+	$.ajax({
+	    url: "/auditor/json/"+action,
+	    type: "POST",
+	    data: {
+		"ps": getProxyServerId(),
+		"pattern": pattern,
+	    },
+	    dataType: "json",
+	    success: function() {
+		window.location.reload();
+	    },
+	    error: function(xhr) {
+		alert(xhr.responseText);
+	    },
+	});
+    };
+    $("form#addbypass").submit(function(e) {
+	e.preventDefault();
+	updateBypass("addbypass", $(this).find("input[name=pattern]").val());
+    });
+    $("ul#bypasses a.removebypass").click(function(e) {
+	e.preventDefault();
+	updateBypass("removebypass", $(this).closest("li").data("pattern"));
+    });
+    $("a#clearlearnedbypasses").click(function(e) {
+	e.preventDefault();
+	updateBypass("clearlearnedbypasses", "");
+    });
+});
+
+////
+// Load Balancer
+////
+
+var BACKEND_POLLING_INTERVAL = 2000;
+var BACKEND_POLLING_STOP = false;
+function pollBackends(lbId, interval) {
+    if (BACKEND_POLLING_STOP) {
+	BACKEND_POLLING_STOP = false;
+	return;
+    };
+    $.ajax({
+	url: "/loadbalancer/json/status",
+	data: {
+	    lb: lbId,
+	},
+	dataType: "json",
+	contentType: "application/json",
+	success: function(data) {
+	    if (data.backends != null) {
+		$.each(data.backends, function(i, b) {
+		    var $row = $("tr#backend-"+escapeMeta(b.Addr));
+		    var health = "Healthy";
+		    if (b.Draining) {
+			health = "Draining";
+		    } else if (!b.Healthy) {
+			health = "Unhealthy";
+		    } else if (b.Ejected) {
+			health = "Ejected";
+		    };
+		    var $health = $row.find("td.health");
+		    if ($health.text() != health) {
+			$health.text(health);
+			fadeIn($row);
+		    };
+		    var $weight = $row.find("td.weight input");
+		    if (!$weight.is(":focus")) {
+			$weight.val(b.Weight);
+		    };
+		    $row.find("td.active").text(b.Active);
+		    if (b.Latency > 0) {
+			// Nanoseconds
+			$row.find("td.latency").text((b.Latency / 1e6).toFixed(1)+"ms");
+		    };
+		    var lastcheck = new Date(b.LastCheck);
+		    if (lastcheck.getFullYear() > 1) {
+			$row.find("td.lastcheck").text(lastcheck.toLocaleTimeString());
+		    };
+		    $row.find("td.lasterror").text(b.LastError);
+		});
+	    };
+	    if (data.routes != null) {
+		$("table#routes tbody tr").each(function() {
+		    var $row = $(this);
+		    var st = data.routes[$row.data("route")];
+		    if (st == null) {
+			return;
+		    };
+		    $row.find("td.requests").text(st.Requests);
+		    var rate = st.Requests > 0 ? st.Errors / st.Requests * 100 : 0;
+		    $row.find("td.errorrate").text(rate.toFixed(1)+"%");
+		});
+	    };
+	},
+	complete: function() {
+	    setTimeout(function() {pollBackends(lbId, interval);}, interval);
+	},
+    });
+};
+
+function reconfigureLoadBalancer(action, data) {
+    data.lb = getLoadBalancerId();
+    $.ajax({
+	url: "/loadbalancer/json/"+action,
+	type: "POST",
+	data: data,
+	dataType: "json",
+	success: function() {
+	    // Backends that were added or removed change the tables
+	    window.location.reload();
+	},
+	error: function(xhr) {
+	    alert(xhr.responseText);
+	},
+    });
+};
+
+addConstructor("loadbalancer_dashboard", function() {
+    addDestructor(function() {
+	BACKEND_POLLING_STOP = true;
+    });
+    var lbId = getLoadBalancerId();
+    if (lbId != null) {
+	pollBackends(lbId, BACKEND_POLLING_INTERVAL);
+    };
+
+    $("form#addbackend").submit(function(e) {
+	e.preventDefault();
+	reconfigureLoadBalancer("addbackend", {
+	    host: $(this).find("input[name=host]").val(),
+	    addr: $(this).find("input[name=addr]").val(),
+	});
+    });
+    $("a.removebackend").click(function(e) {
+	e.preventDefault();
+	var $a = $(this);
+	if (confirm("Remove "+$a.data("addr")+" from "+$a.data("host")+"? In-flight requests will be allowed to finish.")) {
+	    reconfigureLoadBalancer("removebackend", {
+		host: $a.data("host"),
+		addr: $a.data("addr"),
+	    });
+	};
+    });
+    $("table#splits input[name=percent]").change(function() {
+	var $input = $(this);
+	$.ajax({
+	    url: "/loadbalancer/json/setsplit",
+	    type: "POST",
+	    data: {
+		lb: getLoadBalancerId(),
+		host: $input.data("route"),
+		percent: $input.val(),
+	    },
+	    error: function(xhr) {
+		alert(xhr.responseText);
+	    },
+	});
+    });
+    $("td.weight input").change(function() {
+	var $input = $(this);
+	$.ajax({
+	    url: "/loadbalancer/json/setweight",
+	    type: "POST",
+	    data: {
+		lb: getLoadBalancerId(),
+		addr: $input.data("addr"),
+		weight: $input.val(),
+	    },
+	    error: function(xhr) {
+		alert(xhr.responseText);
+	    },
+	});
+    });
+});
+
+var STATS_POLLING_INTERVAL = 2000;
+var STATS_POLLING_STOP = false;
+
+// Formats a duration in nanoseconds
+function formatLatency(ns) {
+    if (ns == 0) {
+	return "";
+    };
+    if (ns < 1e6) {
+	return (ns / 1e3).toFixed(0)+"\u00b5s";
+    };
+    return (ns / 1e6).toFixed(1)+"ms";
+};
+
+function trafficCells(st) {
+    var rate = st.Requests > 0 ? st.Errors / st.Requests * 100 : 0;
+    return [
+	st.Requests,
+	st.Errors+" ("+rate.toFixed(1)+"%)",
+	st.StatusClasses.slice(1).join("/"),
+	st.StatusClasses[0],
+	st.BytesIn,
+	st.BytesOut,
+	formatLatency(st.LatencyP50),
+	formatLatency(st.LatencyP90),
+	formatLatency(st.LatencyP99),
+    ];
+};
+
+function statsRow(cells) {
+    var $row = $("<tr>");
+    $.each(cells, function(i, v) {
+	$row.append($("<td>").text(v));
+    });
+    return $row;
+};
+
+function pollStats(lbId, interval) {
+    if (STATS_POLLING_STOP) {
+	STATS_POLLING_STOP = false;
+	return;
+    };
+    $.ajax({
+	url: "/loadbalancer/json/stats",
+	data: {
+	    lb: lbId,
+	},
+	dataType: "json",
+	contentType: "application/json",
+	success: function(data) {
+	    if (data.tcp != null) {
+		var $tcp = $("table#tcpstats");
+		$tcp.find("td.connections").text(data.tcp.Connections);
+		$tcp.find("td.active").text(data.tcp.Active);
+		$tcp.find("td.failed").text(data.tcp.Failed);
+		$tcp.find("td.bytesin").text(data.tcp.BytesIn);
+		$tcp.find("td.bytesout").text(data.tcp.BytesOut);
+	    };
+	    var $routes = $("table#routestats tbody").empty();
+	    var routes = [];
+	    $.each(data.routes || {}, function(k) {
+		routes.push(k);
+	    });
+	    routes.sort();
+	    $.each(routes, function(i, k) {
+		$routes.append(statsRow([k].concat(trafficCells(data.routes[k]))));
+	    });
+	    var $backends = $("table#backendstats tbody").empty();
+	    $.each(data.backends || [], function(i, b) {
+		var health = "Healthy";
+		if (b.Draining) {
+		    health = "Draining";
+		} else if (!b.Healthy) {
+		    health = "Unhealthy";
+		} else if (b.Ejected) {
+		    health = "Ejected";
+		};
+		$backends.append(statsRow([b.Addr, health, b.Active].concat(trafficCells(b))));
+	    });
+	},
+	complete: function() {
+	    setTimeout(function() {pollStats(lbId, interval);}, interval);
+	},
+    });
+};
+
+addConstructor("loadbalancer_stats", function() {
+    addDestructor(function() {
+	STATS_POLLING_STOP = true;
+    });
+    var lbId = getLoadBalancerId();
+    if (lbId != null) {
+	pollStats(lbId, STATS_POLLING_INTERVAL);
+    };
 });
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"github.com/pmylund/sniffy/sniff"
+
 	"fmt"
 	"html/template"
 	"path/filepath"
@@ -22,14 +24,18 @@ var (
 		"front.html",
 		"auditor_dashboard.html",
 		"auditor_interceptor.html",
+		"auditor_servertls.html",
 		"proxy_dashboard.html",
 		"proxy_settings.html",
 		"proxyserver_selector.html",
+		"loadbalancer_dashboard.html",
+		"loadbalancer_stats.html",
 	}
 	templates     = map[string]*template.Template{}
 	templateFuncs = template.FuncMap{
 		"equal":     Equal,
 		"summarize": Summarize,
+		"label":     SeverityLabel,
 	}
 )
 
@@ -57,3 +63,16 @@ func Summarize(x interface{}, l int) string {
 func Equal(x interface{}, y interface{}) bool {
 	return reflect.DeepEqual(x, y)
 }
+
+// Returns the label class for a finding severity
+func SeverityLabel(severity string) string {
+	switch severity {
+	case sniff.SeverityHigh:
+		return "important"
+	case sniff.SeverityMedium:
+		return "warning"
+	case sniff.SeverityLow:
+		return "notice"
+	}
+	return "success"
+}
@@ -46,6 +46,8 @@ func (ws *WebServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		ws.auditorDashboard(w, req)
 	case "/auditor/interceptor":
 		ws.auditorInterceptor(w, req)
+	case "/auditor/servertls":
+		ws.auditorServerTLS(w, req)
 	case "/auditor/json/toggle":
 		ws.auditorJsonToggle(w, req)
 	case "/auditor/json/getrequest":
@@ -54,8 +56,34 @@ func (ws *WebServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		ws.auditorJsonGetRequests(w, req)
 	case "/auditor/json/deleterequests":
 		ws.auditorJsonDeleteRequests(w, req)
+	case "/auditor/json/addbypass":
+		ws.auditorJsonBypass(w, req, "addbypass")
+	case "/auditor/json/removebypass":
+		ws.auditorJsonBypass(w, req, "removebypass")
+	case "/auditor/json/clearlearnedbypasses":
+		ws.auditorJsonBypass(w, req, "clearlearnedbypasses")
+	case "/auditor/json/moderatewebsocket":
+		ws.auditorJsonModerateWebSocket(w, req)
+	case "/auditor/json/injectwebsocket":
+		ws.auditorJsonInjectWebSocket(w, req)
 	case "/auditor/json/makerequest":
 		ws.auditorMakeRequest(w, req)
+	case "/loadbalancer":
+		ws.loadBalancerDashboard(w, req)
+	case "/loadbalancer/stats":
+		ws.loadBalancerStats(w, req)
+	case "/loadbalancer/json/status":
+		ws.loadBalancerJsonStatus(w, req)
+	case "/loadbalancer/json/stats":
+		ws.loadBalancerJsonStats(w, req)
+	case "/loadbalancer/json/addbackend":
+		ws.loadBalancerJsonReconfigure(w, req, "addbackend")
+	case "/loadbalancer/json/removebackend":
+		ws.loadBalancerJsonReconfigure(w, req, "removebackend")
+	case "/loadbalancer/json/setweight":
+		ws.loadBalancerJsonReconfigure(w, req, "setweight")
+	case "/loadbalancer/json/setsplit":
+		ws.loadBalancerJsonReconfigure(w, req, "setsplit")
 	case "/proxy":
 		ws.proxyDashboard(w, req)
 	case "/proxy/settings":
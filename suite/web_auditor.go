@@ -2,16 +2,39 @@ package main
 
 import (
 	"github.com/pmylund/sniffy/proxy"
+	"github.com/pmylund/sniffy/sniff"
 
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
 func (ws *WebServer) auditorDashboard(w http.ResponseWriter, req *http.Request) {
-	ws.template(w, "auditor_dashboard", nil)
+	servers, err := getServerTLSs()
+	if err != nil {
+		log.Println("Couldn't get upstream TLS connections:", err)
+	}
+	ws.template(w, "auditor_dashboard", map[string]interface{}{
+		"servers": servers,
+	})
+}
+
+// Shows the recorded TLS connection to the upstream server ?host=<host>
+func (ws *WebServer) auditorServerTLS(w http.ResponseWriter, req *http.Request) {
+	st, err := getServerTLS(strings.ToLower(req.FormValue("host")))
+	if err != nil {
+		http.Error(w, "Host not found", http.StatusNotFound)
+		return
+	}
+	ws.template(w, "auditor_servertls", map[string]interface{}{
+		"st": st,
+	})
 }
 
 func (ws *WebServer) auditorInterceptor(w http.ResponseWriter, req *http.Request) {
@@ -32,6 +55,9 @@ func (ws *WebServer) auditorInterceptor(w http.ResponseWriter, req *http.Request
 	ws.template(w, "auditor_interceptor", map[string]interface{}{
 		"proxyservers": proxyServers,
 		"ps":           ps,
+		"certcache":    sslInterceptor.Cache.Stats(),
+		"tls":          req.FormValue("tls"),
+		"fingerprint":  req.FormValue("fingerprint"),
 	})
 }
 
@@ -126,6 +152,8 @@ func (ws *WebServer) auditorJsonToggle(w http.ResponseWriter, req *http.Request)
 		ps.toggleLogRequests()
 	case "moderaterequests":
 		ps.toggleModerateRequests()
+	case "moderatewebsockets":
+		ps.toggleModerateWebSockets()
 	case "interceptssl":
 		ps.toggleInterceptSSL()
 	}
@@ -162,7 +190,8 @@ func (ws *WebServer) auditorJsonGetRequests(w http.ResponseWriter, req *http.Req
 		// TODO: Could do another SQL query for e.g. the 100th, then set since from that
 		var temp []requestEntry
 		// Need to get in DESC order, then reverse it, to get the most recent entries with LIMIT
-		temp, err = getRequests(joinRes, "WHERE ps_id = $1 ORDER BY requests.time DESC LIMIT 100", ps.Id)
+		filter, vals := requestFilter(req, 2)
+		temp, err = getRequests(joinRes, "WHERE ps_id = $1"+filter+" ORDER BY requests.time DESC LIMIT 100", append([]interface{}{ps.Id}, vals...)...)
 		num := len(temp)
 		if num > 0 {
 			rs = make([]requestEntry, num)
@@ -182,7 +211,8 @@ func (ws *WebServer) auditorJsonGetRequests(w http.ResponseWriter, req *http.Req
 			}
 		}
 		if !cached {
-			rs, err = getRequests(joinRes, "WHERE ps_id = $1 AND requests.time > $2 ORDER BY requests.time ASC", ps.Id, since)
+			filter, vals := requestFilter(req, 3)
+			rs, err = getRequests(joinRes, "WHERE ps_id = $1 AND requests.time > $2"+filter+" ORDER BY requests.time ASC", append([]interface{}{ps.Id, since}, vals...)...)
 		}
 	}
 	if err != nil {
@@ -199,11 +229,16 @@ func (ws *WebServer) auditorJsonGetRequests(w http.ResponseWriter, req *http.Req
 	if ps.ModerateRequests {
 		queue = ps.queue.List()
 	}
+	var wsQueue []*pendingWebSocketMessage
+	if ps.ModerateWebSockets {
+		wsQueue = ps.websockets.list()
+	}
 
 	data := map[string]interface{}{
-		"since": since,
-		"rs":    rs,
-		"queue": queue,
+		"since":   since,
+		"rs":      rs,
+		"queue":   queue,
+		"wsqueue": wsQueue,
 	}
 	json, err := json.Marshal(data)
 	if err != nil {
@@ -214,6 +249,28 @@ func (ws *WebServer) auditorJsonGetRequests(w http.ResponseWriter, req *http.Req
 	}
 }
 
+// Returns the SQL conditions, with parameters numbered from $n, and their values
+// for the ?tls=<outdated|below13> and ?fingerprint=<JA3 or JA4> filters
+func requestFilter(req *http.Request, n int) (string, []interface{}) {
+	var (
+		filter string
+		vals   []interface{}
+	)
+	switch req.FormValue("tls") {
+	case "outdated":
+		filter += fmt.Sprintf(" AND tlsmaxversion > 0 AND tlsmaxversion < $%d", n+len(vals))
+		vals = append(vals, tls.VersionTLS12)
+	case "below13":
+		filter += fmt.Sprintf(" AND tlsmaxversion > 0 AND tlsmaxversion < $%d", n+len(vals))
+		vals = append(vals, tls.VersionTLS13)
+	}
+	if fp := strings.ToLower(strings.TrimSpace(req.FormValue("fingerprint"))); fp != "" {
+		filter += fmt.Sprintf(" AND (ja3 = $%d OR ja4 = $%d)", n+len(vals), n+len(vals))
+		vals = append(vals, fp)
+	}
+	return filter, vals
+}
+
 func (ws *WebServer) auditorJsonGetRequest(w http.ResponseWriter, req *http.Request) {
 	errorMessage := func() {
 		http.Error(w, "Couldn't get post", http.StatusInternalServerError)
@@ -232,6 +289,12 @@ func (ws *WebServer) auditorJsonGetRequest(w http.ResponseWriter, req *http.Requ
 	data := map[string]interface{}{
 		"r": r,
 	}
+	if r.Response != nil && r.Response.StatusCode == http.StatusSwitchingProtocols {
+		data["messages"], err = getWebSocketMessages(id)
+		if err != nil {
+			log.Println("Couldn't get WebSocket messages for request", id, "-", err)
+		}
+	}
 	json, err := json.Marshal(data)
 	if err != nil {
 		errorMessage()
@@ -259,3 +322,150 @@ func (ws *WebServer) auditorJsonDeleteRequests(w http.ResponseWriter, req *http.
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// Adds or removes a host that the proxy server tunnels instead of intercepting,
+// or clears the learned ones, and writes a JSON payload with the remaining ones
+func (ws *WebServer) auditorJsonBypass(w http.ResponseWriter, req *http.Request, action string) {
+	if req.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+	ps, err := getActiveProxyServer(req.FormValue("ps"))
+	if err != nil {
+		http.Error(w, "Could not get proxy server: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pattern := strings.ToLower(strings.TrimSpace(req.FormValue("pattern")))
+	if action != "clearlearnedbypasses" && !sniff.ValidBypassPattern(pattern) {
+		http.Error(w, "Invalid host pattern", http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case "addbypass":
+		err = ps.addBypass(pattern)
+	case "removebypass":
+		err = ps.removeBypass(pattern)
+	case "clearlearnedbypasses":
+		err = ps.clearLearnedBypasses()
+	}
+	if err != nil {
+		log.Println("Error updating intercept bypasses for proxy server", ps.Id, "-", err)
+		http.Error(w, "Couldn't save intercept bypasses", http.StatusInternalServerError)
+		return
+	}
+	json, err := json.Marshal(ps.Bypasses())
+	if err != nil {
+		http.Error(w, "Couldn't get intercept bypasses", http.StatusInternalServerError)
+	} else {
+		w.Header()["Pragma"] = []string{"no-cache"}
+		w.Write(json)
+	}
+}
+
+// Returns the ?payload=<data> of a WebSocket message, which is decoded if
+// ?encoding=base64, or nil if there is none
+func webSocketPayloadValue(req *http.Request) ([]byte, error) {
+	if _, found := req.Form["payload"]; !found {
+		return nil, nil
+	}
+	payload := req.FormValue("payload")
+	switch req.FormValue("encoding") {
+	case "", "text":
+		return []byte(payload), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(payload)
+	}
+	return nil, errors.New("Invalid encoding")
+}
+
+// Forwards (?action=forward), optionally with a new ?payload=, or drops
+// (?action=drop) the pending WebSocket message ?id=
+func (ws *WebServer) auditorJsonModerateWebSocket(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+	ps, err := getActiveProxyServer(req.FormValue("ps"))
+	if err != nil {
+		http.Error(w, "Could not get proxy server: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 0)
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+	payload, err := webSocketPayloadValue(req)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.FormValue("action") {
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	case "forward":
+		err = ps.websockets.forward(id, payload)
+	case "drop":
+		err = ps.websockets.drop(id)
+	}
+	if err != nil {
+		http.Error(w, "Couldn't moderate message: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Sends a ?opcode=<text|binary> message with ?payload= on the live WebSocket
+// connection requested by request ?id=, to the ?direction=<client|server>
+func (ws *WebServer) auditorJsonInjectWebSocket(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+	ps, err := getActiveProxyServer(req.FormValue("ps"))
+	if err != nil {
+		http.Error(w, "Could not get proxy server: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 0)
+	if err != nil {
+		http.Error(w, "Invalid request id", http.StatusBadRequest)
+		return
+	}
+	var opcode byte
+	switch req.FormValue("opcode") {
+	default:
+		http.Error(w, "Invalid opcode", http.StatusBadRequest)
+		return
+	case "text":
+		opcode = proxy.WebSocketText
+	case "binary":
+		opcode = proxy.WebSocketBinary
+	}
+	var toClient bool
+	switch req.FormValue("direction") {
+	default:
+		http.Error(w, "Invalid direction", http.StatusBadRequest)
+		return
+	case "client":
+		toClient = true
+	case "server":
+	}
+	payload, err := webSocketPayloadValue(req)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := ps.websockets.session(id)
+	if s == nil {
+		http.Error(w, "The WebSocket connection is closed", http.StatusNotFound)
+		return
+	}
+	err = s.SendWebSocketMessage(toClient, opcode, payload)
+	if err != nil {
+		http.Error(w, "Couldn't send message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
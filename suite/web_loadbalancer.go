@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/pmylund/sniffy/proxy"
+
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (ws *WebServer) loadBalancerDashboard(w http.ResponseWriter, req *http.Request) {
+	var (
+		lb  *loadBalancer
+		err error
+	)
+	lbIdStr := req.FormValue("lb")
+	if lbIdStr != "" {
+		lb, err = getActiveLoadBalancer(lbIdStr)
+		if err != nil {
+			http.Error(w, "Could not get load balancer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if len(loadBalancers) > 0 {
+		lb = loadBalancers[0]
+	}
+	ws.template(w, "loadbalancer_dashboard", map[string]interface{}{
+		"loadbalancers": loadBalancers,
+		"lb":            lb,
+	})
+}
+
+func (ws *WebServer) loadBalancerStats(w http.ResponseWriter, req *http.Request) {
+	var (
+		lb  *loadBalancer
+		err error
+	)
+	lbIdStr := req.FormValue("lb")
+	if lbIdStr != "" {
+		lb, err = getActiveLoadBalancer(lbIdStr)
+		if err != nil {
+			http.Error(w, "Could not get load balancer: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if len(loadBalancers) > 0 {
+		lb = loadBalancers[0]
+	}
+	ws.template(w, "loadbalancer_stats", map[string]interface{}{
+		"loadbalancers": loadBalancers,
+		"lb":            lb,
+	})
+}
+
+// backendStats is the state and traffic stats of a backend
+type backendStats struct {
+	proxy.BackendStatus
+	proxy.TrafficStats
+}
+
+// Writes a JSON payload with the traffic stats of every route and backend of a
+// load balancer
+func (ws *WebServer) loadBalancerJsonStats(w http.ResponseWriter, req *http.Request) {
+	lb, err := getActiveLoadBalancer(req.FormValue("lb"))
+	if err != nil {
+		http.Error(w, "Could not get load balancer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats := lb.lb.BackendStats()
+	backends := []backendStats{}
+	for _, v := range lb.Backends() {
+		backends = append(backends, backendStats{v, stats[v.Addr]})
+	}
+	data := map[string]interface{}{
+		"routes":   lb.lb.RouteStats(),
+		"backends": backends,
+	}
+	if lb.IsTCP() {
+		data["tcp"] = lb.TCPStats()
+	}
+	json, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Couldn't get load balancer stats", http.StatusInternalServerError)
+	} else {
+		w.Header()["Pragma"] = []string{"no-cache"}
+		w.Write(json)
+	}
+}
+
+// Writes a JSON payload with the state of every backend of a load balancer
+func (ws *WebServer) loadBalancerJsonStatus(w http.ResponseWriter, req *http.Request) {
+	lb, err := getActiveLoadBalancer(req.FormValue("lb"))
+	if err != nil {
+		http.Error(w, "Could not get load balancer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := map[string]interface{}{
+		"backends": lb.Backends(),
+		"routes":   lb.lb.RouteStats(),
+	}
+	json, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Couldn't get load balancer status", http.StatusInternalServerError)
+	} else {
+		w.Header()["Pragma"] = []string{"no-cache"}
+		w.Write(json)
+	}
+}
+
+// Adds a backend to a route, or removes it, or changes a backend's weight or a
+// route's canary percentage, depending on the action, and writes the new routes
+// as a JSON payload
+func (ws *WebServer) loadBalancerJsonReconfigure(w http.ResponseWriter, req *http.Request, action string) {
+	if req.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+	lb, err := getActiveLoadBalancer(req.FormValue("lb"))
+	if err != nil {
+		http.Error(w, "Could not get load balancer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := strings.ToLower(strings.TrimSpace(req.FormValue("host")))
+	addr := strings.TrimSpace(req.FormValue("addr"))
+	switch action {
+	case "setweight":
+		if addr == "" {
+			http.Error(w, "Backend address is required", http.StatusBadRequest)
+			return
+		}
+	case "setsplit":
+		if host == "" {
+			http.Error(w, "Route is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		if host == "" || addr == "" {
+			http.Error(w, "Host and backend address are required", http.StatusBadRequest)
+			return
+		}
+	}
+	switch action {
+	case "addbackend":
+		if _, err = proxy.ParseBackend(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = lb.addBackend(host, addr)
+	case "removebackend":
+		err = lb.removeBackend(host, addr)
+	case "setweight":
+		var weight int
+		weight, err = strconv.Atoi(req.FormValue("weight"))
+		if err != nil || weight < 0 {
+			http.Error(w, "Invalid weight", http.StatusBadRequest)
+			return
+		}
+		err = lb.setWeight(addr, weight)
+	case "setsplit":
+		var percent float64
+		percent, err = strconv.ParseFloat(req.FormValue("percent"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			http.Error(w, "Invalid percentage", http.StatusBadRequest)
+			return
+		}
+		err = lb.setSplitPercent(host, percent)
+	}
+	if err != nil {
+		log.Println("Error reconfiguring load balancer", lb.Name, "-", err)
+		http.Error(w, "Couldn't save load balancer configuration", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"routes": lb.Routes(),
+	}
+	json, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Couldn't get load balancer routes", http.StatusInternalServerError)
+	} else {
+		w.Header()["Pragma"] = []string{"no-cache"}
+		w.Write(json)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/pmylund/sniffy/proxy"
+
+	"errors"
+	"sort"
+	"sync"
+)
+
+// A webSocket is a live WebSocket connection relayed by a proxy server.
+type webSocket struct {
+	reqId int64 // 0 until the request has been saved
+	url   string
+	s     *proxy.ProxySession
+}
+
+// A pendingWebSocketMessage is a WebSocket message that is held until it is
+// forwarded, edited or dropped from the web interface.
+type pendingWebSocketMessage struct {
+	webSocketMessageEntry
+	ReqId    int64
+	URL      string
+	ws       *webSocket
+	message  *proxy.WebSocketMessage
+	decision chan *proxy.WebSocketMessage
+}
+
+// A webSocketModerator keeps track of a proxy server's WebSocket connections, and
+// the messages on them that are waiting to be moderated.
+type webSocketModerator struct {
+	sockets map[*proxy.ProxySession]*webSocket
+	pending map[int64]*pendingWebSocketMessage
+	lastId  int64
+	mu      *sync.Mutex
+}
+
+func (wm *webSocketModerator) addSocket(s *proxy.ProxySession, url string) *webSocket {
+	ws := &webSocket{
+		url: url,
+		s:   s,
+	}
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.sockets[s] = ws
+	return ws
+}
+
+func (wm *webSocketModerator) setReqId(ws *webSocket, reqId int64) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	ws.reqId = reqId
+}
+
+func (wm *webSocketModerator) removeSocket(ws *webSocket) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	delete(wm.sockets, ws.s)
+}
+
+// session returns the live connection that was requested by request reqId.
+func (wm *webSocketModerator) session(reqId int64) *proxy.ProxySession {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for _, v := range wm.sockets {
+		if reqId != 0 && v.reqId == reqId {
+			return v.s
+		}
+	}
+	return nil
+}
+
+// hold waits for a message on ws to be moderated, and returns what to send
+// instead, or nil to drop it. It gives up and returns m if ws is closed.
+func (wm *webSocketModerator) hold(ws *webSocket, m *proxy.WebSocketMessage) *proxy.WebSocketMessage {
+	p := &pendingWebSocketMessage{
+		webSocketMessageEntry: webSocketMessageEntry{
+			Time:       m.Time.Unix(),
+			FromClient: m.FromClient,
+			Opcode:     m.Opcode,
+			OpcodeName: m.OpcodeName(),
+			Payload:    m.Payload,
+			Length:     m.Length,
+			Compressed: m.Compressed,
+		},
+		URL:      ws.url,
+		ws:       ws,
+		message:  m,
+		decision: make(chan *proxy.WebSocketMessage, 1),
+	}
+	wm.mu.Lock()
+	wm.lastId++
+	p.Id = wm.lastId
+	wm.pending[p.Id] = p
+	wm.mu.Unlock()
+	select {
+	case res := <-p.decision:
+		return res
+	case <-ws.s.WebSocketDone():
+		wm.mu.Lock()
+		delete(wm.pending, p.Id)
+		wm.mu.Unlock()
+		return m
+	}
+}
+
+// forward releases pending message id, replacing its payload if payload isn't
+// nil and differs from it.
+func (wm *webSocketModerator) forward(id int64, payload []byte) error {
+	p, err := wm.take(id)
+	if err != nil {
+		return err
+	}
+	m := p.message
+	if payload != nil && string(payload) != string(m.Payload) {
+		m = &proxy.WebSocketMessage{
+			Opcode:  m.Opcode,
+			Payload: payload,
+		}
+	}
+	p.decision <- m
+	return nil
+}
+
+// drop releases pending message id without sending it.
+func (wm *webSocketModerator) drop(id int64) error {
+	p, err := wm.take(id)
+	if err != nil {
+		return err
+	}
+	p.decision <- nil
+	return nil
+}
+
+func (wm *webSocketModerator) take(id int64) (*pendingWebSocketMessage, error) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	p, found := wm.pending[id]
+	if !found {
+		return nil, errors.New("No such message")
+	}
+	delete(wm.pending, id)
+	return p, nil
+}
+
+// flush forwards all pending messages unchanged.
+func (wm *webSocketModerator) flush() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for _, v := range wm.pending {
+		v.decision <- v.message
+	}
+	wm.pending = map[int64]*pendingWebSocketMessage{}
+}
+
+// list returns the pending messages in the order they were received.
+func (wm *webSocketModerator) list() []*pendingWebSocketMessage {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	res := make([]*pendingWebSocketMessage, 0, len(wm.pending))
+	for _, v := range wm.pending {
+		p := *v
+		p.ReqId = v.ws.reqId
+		res = append(res, &p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Id < res[j].Id
+	})
+	return res
+}
+
+func newWebSocketModerator() *webSocketModerator {
+	wm := webSocketModerator{
+		sockets: map[*proxy.ProxySession]*webSocket{},
+		pending: map[int64]*pendingWebSocketMessage{},
+		mu:      &sync.Mutex{},
+	}
+	return &wm
+}